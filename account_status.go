@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"github.com/auth_backend/models"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	REDIS_ACCOUNT_STATUS = "ACCOUNT_STATUS:" //set only for accounts which are not active
+)
+
+//changes status of the user, sessions of an account which is no longer active are revoked
+func (ac *AuthController) setUserStatus(ud *models.UserData, id int64, status string) (*models.AuthUser, error) {
+	au, err := ac.dbHandler.SetStatus(id, status, ud)
+	if err != nil {
+		return nil, err
+	}
+	k := fmt.Sprintf("%s%d", REDIS_ACCOUNT_STATUS, id)
+	if status == models.STATUS_ACTIVE {
+		if _, err = ac.store.Del(k); err != nil {
+			log.Error(err)
+		}
+		return au, nil
+	}
+	//checked on every request, till the sessions are gone
+	if err = ac.store.Set(k, status, 0); err != nil {
+		log.Error(err)
+	}
+	if err = ac.revokeSessions(id); err != nil {
+		log.Errorf("Unable to revoke sessions of user %d : %s", id, err.Error())
+		return nil, models.SERVER_ERROR
+	}
+	return au, nil
+}
+
+//error if account is no longer active
+func (ac *AuthController) checkAccountStatus(id int64) error {
+	status, err := ac.store.Get(fmt.Sprintf("%s%d", REDIS_ACCOUNT_STATUS, id))
+	if err == KEY_NOT_FOUND {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return models.StatusError(status)
+}
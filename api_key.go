@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/auth_backend/models"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	API_KEY_PREFIX = "ak_"
+	REDIS_API_KEY = "API_KEY:"
+	REDIS_API_KEY_EXPIRY = 5 //minutes
+	REDIS_API_KEY_USED = "API_KEY_USED:"
+	API_KEY_TOUCH_INTERVAL = 1 //minutes, last used is updated at most once in this interval
+)
+
+//returned only when key is created, secret cannot be read again
+type NewAPIKey struct {
+	*models.APIKey
+	Key string `json:"key"`
+}
+
+//key details cached to avoid a db lookup on every request
+type cachedAPIKey struct {
+	Id      int64
+	Hash    string
+	Expires *time.Time
+	Ud      *models.UserData
+	Scope   []models.ScopeEntry
+}
+
+//key is <prefix>.<secret>, prefix is public and used to find the key
+func newAPIKeySecret() (string, string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	prefix := API_KEY_PREFIX + strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	s := make([]byte, 32)
+	if _, err := rand.Read(s); err != nil {
+		return "", "", err
+	}
+	return prefix, base64.RawURLEncoding.EncodeToString(s), nil
+}
+
+//expires is in days, key never expires for 0
+func keyExpiry(expires int) *time.Time {
+	if expires <= 0 {
+		return nil
+	}
+	t := time.Now().Add(time.Duration(expires) * 24 * time.Hour)
+	return &t
+}
+
+func (ac *AuthController) issueAPIKey(au *models.AuthUser, name string, expires *time.Time,
+	scope []models.ScopeEntry) (*NewAPIKey, error) {
+	prefix, secret, err := newAPIKeySecret()
+	if err != nil {
+		return nil, err
+	}
+	k, err := ac.dbHandler.CreateAPIKey(au, name, prefix, secret, expires, scope)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("API key %d issued for user %d", k.Id, au.GetId())
+	return &NewAPIKey{APIKey: k, Key: prefix + "." + secret}, nil
+}
+
+//resolves api key into the session data of its user
+func (ac *AuthController) authenticateAPIKey(token string) (*models.UserData, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	prefix, secret := parts[0], parts[1]
+	ck, err := ac.cachedKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(ck.Hash), []byte(models.HashAPIKeySecret(secret))) != 1 {
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	if ck.Expires != nil && time.Now().After(*ck.Expires) {
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	if err = ac.checkAccountStatus(ck.Ud.Id); err != nil {
+		return nil, err
+	}
+	ud, changed, err := ac.currentUserData(ck.Ud)
+	if err != nil {
+		return nil, err
+	} else if changed {
+		ac.store.Del(REDIS_API_KEY + prefix)
+	}
+	ud.Expires = ck.Expires
+	//applied on every use so the token never has more rights than its user currently has
+	if len(ck.Scope) > 0 {
+		if err = ac.dbHandler.ApplyScope(ud, ck.Scope); err != nil {
+			log.Errorf("Scope of API key %d is not valid anymore : %s", ck.Id, err.Error())
+			return nil, models.USER_NOT_AUTHENTICATED
+		}
+	}
+	if ok, err := ac.store.SetNX(REDIS_API_KEY_USED+prefix, 1, API_KEY_TOUCH_INTERVAL*time.Minute); err == nil && ok {
+		if err = ac.dbHandler.TouchAPIKey(ck.Id); err != nil {
+			log.Error(err)
+		}
+	}
+	return ud, nil
+}
+
+func (ac *AuthController) cachedKey(prefix string) (*cachedAPIKey, error) {
+	k := REDIS_API_KEY + prefix
+	str, err := ac.store.Get(k)
+	if err == nil {
+		ck := &cachedAPIKey{}
+		if err = json.Unmarshal([]byte(str), ck); err != nil {
+			return nil, err
+		}
+		return ck, nil
+	} else if err != KEY_NOT_FOUND {
+		return nil, err
+	}
+
+	key, err := ac.dbHandler.FindAPIKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if key == nil || !key.Valid(now) {
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	ud, err := ac.buildUserData(key.AuthUserId)
+	if err != nil {
+		log.Debugf("API key %d cannot be used : %s", key.Id, err.Error())
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	ud.Uuid = prefix
+	ck := &cachedAPIKey{Id: key.Id, Hash: key.Hash, Expires: key.ExpiresAt, Ud: ud, Scope: key.Scope}
+	ttl := REDIS_API_KEY_EXPIRY * time.Minute
+	if key.ExpiresAt != nil && key.ExpiresAt.Sub(now) < ttl {
+		ttl = key.ExpiresAt.Sub(now)
+	}
+	if ckjson, err := json.Marshal(ck); err != nil {
+		return nil, err
+	} else if err = ac.store.Set(k, ckjson, ttl); err != nil {
+		log.Error(err)
+	}
+	return ck, nil
+}
+
+//creates service account along with its first key
+func (ac *AuthController) createServiceAccount(ud *models.UserData, data []byte) (*models.AuthUser, *NewAPIKey, error) {
+	au, err := ac.dbHandler.CreateServiceAccount(data, ud)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ac.issueAPIKey(au, "default", nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return au, key, nil
+}
+
+//expires is in days, 0 means key never expires
+func (ac *AuthController) createAPIKey(ud *models.UserData, userId int64, name string, expires int) (*NewAPIKey, error) {
+	au, err := ac.dbHandler.GetManagedServiceAccount(userId, ud)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("{\"name\":\"required\"}")
+	}
+	return ac.issueAPIKey(au, name, keyExpiry(expires), nil)
+}
+
+//token of ud limited to scope, expires is in days
+func (ac *AuthController) createPersonalToken(ud *models.UserData, name string, expires int,
+	scope []models.ScopeEntry) (*NewAPIKey, error) {
+	if name == "" {
+		return nil, fmt.Errorf("{\"name\":\"required\"}")
+	}
+	prefix, secret, err := newAPIKeySecret()
+	if err != nil {
+		return nil, err
+	}
+	k, err := ac.dbHandler.CreatePersonalToken(ud, name, prefix, secret, keyExpiry(expires), scope)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Personal token %d issued for user %d", k.Id, ud.Id)
+	return &NewAPIKey{APIKey: k, Key: prefix + "." + secret}, nil
+}
+
+func (ac *AuthController) listAPIKeys(ud *models.UserData, userId int64) ([]*models.APIKey, error) {
+	if _, err := ac.dbHandler.GetManagedServiceAccount(userId, ud); err != nil {
+		return nil, err
+	}
+	return ac.dbHandler.ListAPIKeys(userId)
+}
+
+//key along with its user, if ud can manage it
+//users manage their own tokens, except when using a scoped token
+func (ac *AuthController) managedKey(ud *models.UserData, keyId int64) (*models.APIKey, *models.AuthUser, error) {
+	key, err := ac.dbHandler.GetAPIKey(keyId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key.AuthUserId == ud.Id && ud.Scope == nil {
+		au, err := ac.dbHandler.GetAuthUser(ud.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, au, nil
+	}
+	au, err := ac.dbHandler.GetManagedServiceAccount(key.AuthUserId, ud)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, au, nil
+}
+
+//replaces the key with a new one having same name & lifetime, old key stops working immediately
+func (ac *AuthController) rotateAPIKey(ud *models.UserData, keyId int64) (*NewAPIKey, error) {
+	key, au, err := ac.managedKey(ud, keyId)
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, models.INVALID_ENTRY
+	}
+	var exp *time.Time
+	if key.ExpiresAt != nil {
+		t := time.Now().Add(key.ExpiresAt.Sub(key.DateAdd))
+		exp = &t
+	}
+	nk, err := ac.issueAPIKey(au, key.Name, exp, key.Scope)
+	if err != nil {
+		return nil, err
+	}
+	if err = ac.removeAPIKey(key); err != nil {
+		return nil, err
+	}
+	return nk, nil
+}
+
+func (ac *AuthController) revokeAPIKey(ud *models.UserData, keyId int64) error {
+	key, _, err := ac.managedKey(ud, keyId)
+	if err != nil {
+		return err
+	}
+	return ac.removeAPIKey(key)
+}
+
+func (ac *AuthController) removeAPIKey(key *models.APIKey) error {
+	if err := ac.dbHandler.RevokeAPIKey(key.Id); err != nil {
+		return err
+	}
+	if _, err := ac.store.Del(REDIS_API_KEY + key.Prefix); err != nil {
+		log.Error(err)
+	}
+	log.Infof("API key %d of user %d revoked", key.Id, key.AuthUserId)
+	return nil
+}
@@ -3,132 +3,335 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
-	"github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/auth_backend/models"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type AuthController struct {
-	redis_client *redis.Client
+	store SessionStore
 	dbHandler *models.DBRequestHandler
+	signupOrg int64
+	signupRole int64
+	notifier Notifier
+	jwt *JWTIssuer //access tokens are signed jwt when set
+	totpIssuer string //shown in authenticator apps
+	oauth map[string]*OAuthProvider
+	samlBaseUrl string //public url of this server, saml endpoints of orgs are under it
+	throttle *LoginThrottle
 }
 
 const (
-	REDIS_USER_ID_KEY = "USER_ID_KEY:"
 	REDIS_USER_UUID_KEY = "USER_UUID_KEY:"
 	REDIS_USER_EXPIRY = 10*24 //hours
 	REDIS_PASSWORD_TOKEN = "REDIS_PASSWORD_TOKEN:"
 	REDIS_PASSWORD_EXPIRY = 12 //hours
+	REDIS_VERIFY_TOKEN = "REDIS_VERIFY_TOKEN:"
+	REDIS_VERIFY_EXPIRY = 48 //hours
+	REDIS_RESET_EXPIRY = 1 //hours
+	REDIS_JWT_REVOKED = "JWT_REVOKED:"
+	REDIS_SESSION_VERSION = "SESSION_VERSION:"
 	)
 
 func (ac *AuthController) authenticate(uuid string) (*models.UserData, error) {
+	if strings.HasPrefix(uuid, API_KEY_PREFIX) {
+		return ac.authenticateAPIKey(uuid)
+	}
+	if ac.jwt != nil {
+		return ac.authenticateJWT(uuid)
+	}
 	k := fmt.Sprintf("%s%s",REDIS_USER_UUID_KEY, uuid)
-	str, err := ac.redis_client.Get(k).Result();
-	if err == redis.Nil {
+	str, err := ac.store.Get(k);
+	if err == KEY_NOT_FOUND {
 		return nil, server_errors.USER_NOT_AUTHENTICATED
 	} else if err != nil {
 		return nil, err
 	} else {
-		log.Debug("Redis: " +str)
+		log.Debug("Session: " +str)
 		ud := &models.UserData{}
 		if err = json.Unmarshal([]byte(str), ud); err != nil {
 			return nil, err
 		}
-		return ud, err
+		if err = ac.checkAccountStatus(ud.Id); err != nil {
+			return nil, err
+		}
+		return ac.refreshPermissions(ud)
 	}
 }
 
-func (ac *AuthController) setPassword(token string, pass string) error {
+func (ac *AuthController) setPassword(token string, pass string, ip string) error {
 	//if token == "su" {
 	//	if err := ac.dbHandler.SetPassword(1, pass); err != nil {
 	//		log.Error(err.Error())
 	//		return err
 	//	}
 	//}
-	k := fmt.Sprintf("%s%s",REDIS_PASSWORD_TOKEN, token)
-	str, err := ac.redis_client.Get(k).Result();
-	if err == redis.Nil {
-		return errors.New("invalid token")
-	} else if err != nil {
+	if err := ac.throttle.check(ac.throttle.ipKey(ip)); err != nil {
+		return err
+	}
+	if id, err := ac.getToken(REDIS_PASSWORD_TOKEN, token); err != nil {
+		if err == models.INVALID_TOKEN {
+			ac.throttle.fail(ac.throttle.ipKey(ip))
+		}
 		return err
 	} else {
-		if id,err := strconv.ParseInt(str, 10, 64); err != nil {
-			log.Error(str)
-			return errors.New("data not valid")
+		if err = ac.dbHandler.SetPassword(id, pass); err != nil {
+			log.Error(err.Error())
+			return err
 		} else {
-			if err = ac.dbHandler.SetPassword(id, pass); err != nil {
-				log.Error(err.Error())
-				return err
-			} else {
-				ac.redis_client.Del(k).Result()
-				return nil
+			ac.deleteToken(REDIS_PASSWORD_TOKEN, token)
+			//token was sent to user's email, so it is verified as well
+			if _, err = ac.dbHandler.ActivatePending(id); err != nil {
+				log.Error(err)
 			}
+			//old password might be compromised
+			if err = ac.revokeSessions(id); err != nil {
+				log.Error(err)
+			}
+			return nil
 		}
 	}
 }
 
-func (ac *AuthController) logout(data *models.UserData) error {
-	k1 := fmt.Sprintf("%s%d",REDIS_USER_ID_KEY, data.Id)
-	k2 := fmt.Sprintf("%s%s",REDIS_USER_UUID_KEY, data.Uuid)
+//sends a reset password token if a user with given username/email exists
+//org slug is needed when same username is used in many orgs
+//never tells the caller if user exists, errors are only logged
+func (ac *AuthController) forgotPassword(identifier string, orgSlug string) {
+	var org *models.Org
+	if orgSlug != "" {
+		var err error
+		if org, err = ac.dbHandler.FindOrgBySlug(orgSlug); err != nil {
+			log.Error(err.Error())
+			return
+		} else if org == nil {
+			log.Debugf("forgot password requested for unknown org %s", orgSlug)
+			return
+		}
+	}
+	au, err := ac.dbHandler.FindAuthUser(identifier, org)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	if au == nil || au.AccountType == models.ACCOUNT_SERVICE {
+		log.Debugf("forgot password requested for unknown user %s", identifier)
+		return
+	}
+	if tok, err := ac.issueToken(REDIS_PASSWORD_TOKEN, au.GetId(), REDIS_RESET_EXPIRY*time.Hour); err != nil {
+		log.Errorf("Unable to generate reset token for user %d : %s", au.GetId(), err.Error())
+	} else {
+		ac.notify(MSG_RESET_PASSWORD, au, tok)
+	}
+}
+
+//creates a one time token for given user id, token is valid till expiry
+func (ac *AuthController) issueToken(prefix string, id int64, expiry time.Duration) (string, error) {
+	if tok, err := newUUID(); err != nil {
+		return "", err
+	} else {
+		k := fmt.Sprintf("%s%s", prefix, tok)
+		if err := ac.store.Set(k, id, expiry); err != nil {
+			return "", err
+		} else {
+			return tok, nil
+		}
+	}
+}
+
+//PASSWORD_EXPIRED along with a token to set the new password
+type passwordExpiredError struct {
+	token string
+}
+
+func (e *passwordExpiredError) Error() string {
+	return models.PASSWORD_EXPIRED.Error()
+}
+
+func (e *passwordExpiredError) Cause() error {
+	return models.PASSWORD_EXPIRED
+}
+
+//user has proven the old password, it can only be used to set a new one
+func (ac *AuthController) passwordExpired(user models.BaseModel) error {
+	if tok, err := ac.issueToken(REDIS_PASSWORD_TOKEN, user.GetId(), REDIS_RESET_EXPIRY*time.Hour); err != nil {
+		log.Errorf("Unable to generate password token for user %d : %s", user.GetId(), err.Error())
+		return models.PASSWORD_EXPIRED
+	} else {
+		return &passwordExpiredError{token: tok}
+	}
+}
+
+//returns user id for which token was issued
+func (ac *AuthController) getToken(prefix string, token string) (int64, error) {
+	k := fmt.Sprintf("%s%s", prefix, token)
+	str, err := ac.store.Get(k);
+	if err == KEY_NOT_FOUND {
+		return 0, models.INVALID_TOKEN
+	} else if err != nil {
+		return 0, err
+	} else {
+		if id, err := strconv.ParseInt(str, 10, 64); err != nil {
+			log.Error(str)
+			return 0, errors.New("data not valid")
+		} else {
+			return id, nil
+		}
+	}
+}
+
+func (ac *AuthController) deleteToken(prefix string, token string) {
+	k := fmt.Sprintf("%s%s", prefix, token)
+	if _, err := ac.store.Del(k); err != nil {
+		log.Error(err)
+	}
+}
 
-	if str, err := ac.redis_client.Del(k1, k2).Result(); err != nil {
+func (ac *AuthController) logout(data *models.UserData) error {
+	if err := ac.revokeAccess(data.Uuid); err != nil {
 		log.Error(err)
 		return errors.New("Unable to logout at this time")
-	} else {
-		log.Info(str)
+	}
+	if err := ac.revokeFamily(data.Family); err != nil {
+		log.Error(err)
+		return errors.New("Unable to logout at this time")
+	}
+	return nil
+}
+
+//access token can no longer be used
+func (ac *AuthController) revokeAccess(uuid string) error {
+	if uuid == "" {
 		return nil
 	}
+	var err error
+	if ac.jwt != nil {
+		//signed token stays valid till expiry, keep it in deny list till then
+		err = ac.store.Set(fmt.Sprintf("%s%s", REDIS_JWT_REVOKED, uuid), 1,
+			REDIS_ACCESS_EXPIRY*time.Minute)
+	} else {
+		_, err = ac.store.Del(fmt.Sprintf("%s%s", REDIS_USER_UUID_KEY, uuid))
+	}
+	return err
+}
+
+//sends message to the user, failure to deliver is only logged
+func (ac *AuthController) notify(typ string, u *models.AuthUser, token string) {
+	if ac.notifier == nil || u == nil {
+		return
+	}
+	msg := &Message{Type: typ, To: u.Email, Username: u.Username, Token: token}
+	if err := ac.notifier.Notify(msg); err != nil {
+		log.Errorf("Unable to send %s to user %d : %s", typ, u.GetId(), err.Error())
+	}
 }
 
 func (ac *AuthController) NewUserCreate(u models.BaseModel, creator *models.UserData) (string, error) {
-	if uuid, err := uuid.NewV4(); err != nil {
-		return "", errors.New("Unable to generate unique identifier at this time. Please try again")
+	if tok, err := ac.issueToken(REDIS_PASSWORD_TOKEN, u.GetId(), REDIS_PASSWORD_EXPIRY*time.Hour); err != nil {
+		return "", err
 	} else {
-		k := fmt.Sprintf("%s%s",REDIS_PASSWORD_TOKEN, uuid.String())
-		if str, err := ac.redis_client.Set(k, u.GetId(), REDIS_PASSWORD_EXPIRY*time.Hour).Result(); err != nil {
-			return "", err
+		au, _ := u.(*models.AuthUser)
+		ac.notify(MSG_SET_PASSWORD, au, tok)
+		return tok, nil
+	}
+}
+
+//creates an inactive user and sends a token to verify the account
+func (ac *AuthController) signup(data []byte, pass string) (models.BaseModel, error) {
+	u, err := ac.dbHandler.Signup(data, pass, ac.signupOrg, ac.signupRole)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := ac.issueToken(REDIS_VERIFY_TOKEN, u.GetId(), REDIS_VERIFY_EXPIRY*time.Hour)
+	if err != nil {
+		log.Errorf("Unable to generate verification token for user %d : %s", u.GetId(), err.Error())
+		//user could never be verified, username & email can be used to sign up again
+		if rerr := ac.dbHandler.RemovePendingUser(u.GetId()); rerr != nil {
+			log.Error(rerr)
+		}
+		return nil, err
+	}
+	au, _ := u.(*models.AuthUser)
+	ac.notify(MSG_VERIFICATION, au, tok)
+	return u, nil
+}
+
+//activates the pending user for which verification token was issued
+func (ac *AuthController) verify(token string, ip string) error {
+	if err := ac.throttle.check(ac.throttle.ipKey(ip)); err != nil {
+		return err
+	}
+	if id, err := ac.getToken(REDIS_VERIFY_TOKEN, token); err != nil {
+		if err == models.INVALID_TOKEN {
+			ac.throttle.fail(ac.throttle.ipKey(ip))
+		}
+		return err
+	} else {
+		if _, err = ac.dbHandler.ActivatePending(id); err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		ac.deleteToken(REDIS_VERIFY_TOKEN, token)
+		if au, err := ac.dbHandler.GetAuthUser(id); err != nil {
+			log.Error(err.Error())
 		} else {
-			log.Debug("Redis: " + str)
-			return uuid.String(), nil
+			ac.notify(MSG_WELCOME, au, "")
 		}
+		return nil
 	}
 }
 
-func (ac *AuthController) login(username string, pass string) (string, error) {
-	if user, perms, err := ac.dbHandler.Authenticate(username, pass); err != nil {
-		return "",err
+//returns session tokens, or a challenge if user has to verify second factor
+//identifier is username or email, org slug is optional
+//failures are counted per account (or identifier if none matches) & client ip, either of them can get locked
+func (ac *AuthController) login(identifier string, org string, pass string, client *SessionMeta) (*SessionTokens, *MFAChallenge, error) {
+	var ip string
+	if client != nil {
+		ip = client.Ip
+	}
+	uk := ac.loginKey(identifier, org)
+	keys := []throttleKey{uk, ac.throttle.ipKey(ip)}
+	if err := ac.throttle.check(keys...); err != nil {
+		return nil, nil, err
+	}
+	if user, perms, err := ac.dbHandler.Authenticate(identifier, org, pass); err != nil {
+		if err == models.INVALID_CREDENTIALS {
+			ac.throttle.fail(keys...)
+		} else if err == models.PASSWORD_EXPIRED {
+			ac.throttle.reset(uk)
+			return nil, nil, ac.passwordExpired(user)
+		}
+		return nil, nil, err
 	} else {
-		if uuid, err := uuid.NewV4(); err != nil {
-			return "", errors.New("Unable to generate unique identifier at this time. Please try again")
+		//user may have been provisioned by this login, so its key is cleared too
+		ac.throttle.reset(uk, ac.throttle.userKey(user.GetId()))
+		var orgid int64
+		if bom, ok := user.(models.BaseOrgModel); !ok {
+			return nil, nil, models.SERVER_ERROR
 		} else {
-			var orgid int64
-			if bom, ok := user.(models.BaseOrgModel); !ok {
-				return "", err
-			} else {
-				orgid = bom.GetOrgId()
-			}
-			ud := &models.UserData{user.GetId(), uuid.String(), orgid, perms}
-			var udjson []byte
-			if udjson, err = json.Marshal(ud); err != nil {
-				return "", err
-			}
-			k := fmt.Sprintf("%s%d", REDIS_USER_ID_KEY, user.GetId())
-			if str, err := ac.redis_client.Set(k, udjson, REDIS_USER_EXPIRY*time.Hour).Result(); err != nil {
-				return "", err
-			} else {
-				log.Debug("Redis: " + str)
-				k := fmt.Sprintf("%s%s", REDIS_USER_UUID_KEY, uuid.String())
-				if str, err := ac.redis_client.Set(k, udjson, REDIS_USER_EXPIRY*time.Hour).Result(); err != nil {
-					return "", err
-				} else {
-					log.Debug("Redis: " + str)
-					return uuid.String(), nil
-				}
-			}
+			orgid = bom.GetOrgId()
 		}
+		ud := &models.UserData{Id: user.GetId(), Org_id: orgid, P: perms}
+		if au, ok := user.(*models.AuthUser); ok {
+			ud.RoleId = au.UserRoleId
+		}
+		if err = ac.setPermVersions(ud); err != nil {
+			return nil, nil, err
+		}
+		return ac.startSession(ud, client)
+	}
+}
+
+//creates session for an authenticated user, asks for second factor if user has one
+func (ac *AuthController) startSession(ud *models.UserData, client *SessionMeta) (*SessionTokens, *MFAChallenge, error) {
+	if secret, err := ac.dbHandler.GetTOTPSecret(ud.Id); err != nil {
+		return nil, nil, err
+	} else if secret != "" {
+		c, err := ac.mfaChallenge(ud, client)
+		return nil, c, err
 	}
+	tokens, err := ac.createSession(ud, client)
+	return tokens, nil, err
 }
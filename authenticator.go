@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"github.com/auth_backend/models"
+)
+
+//one entry of authenticators, entries are tried in the same order at login
+type AuthenticatorConfig struct {
+	Type    string                 `mapstructure:"type"` //local, ldap or a registered custom type
+	Ldap    LDAPConfig             `mapstructure:"ldap"`
+	Options map[string]interface{} `mapstructure:"options"` //passed as is to custom authenticators
+}
+
+//builds authenticator for an entry of authenticators
+type AuthenticatorFactory func(cfg AuthenticatorConfig, dbh *models.DBRequestHandler) (models.Authenticator, error)
+
+var authenticatorFactories = map[string]AuthenticatorFactory{
+	"local": func(cfg AuthenticatorConfig, dbh *models.DBRequestHandler) (models.Authenticator, error) {
+		return models.NewLocalAuthenticator(dbh), nil
+	},
+	"ldap": func(cfg AuthenticatorConfig, dbh *models.DBRequestHandler) (models.Authenticator, error) {
+		return NewLDAPAuthenticator(cfg.Ldap, dbh)
+	},
+}
+
+//custom authenticators have to be registered before the config is loaded
+func RegisterAuthenticator(typ string, f AuthenticatorFactory) {
+	authenticatorFactories[typ] = f
+}
+
+//chain as configured, nil if nothing is configured so the default is kept
+func NewAuthenticators(cfgs []AuthenticatorConfig, dbh *models.DBRequestHandler) ([]models.Authenticator, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+	chain := make([]models.Authenticator, 0, len(cfgs))
+	for _, c := range cfgs {
+		f, ok := authenticatorFactories[c.Type]
+		if !ok {
+			return nil, errors.New("unknown authenticator type " + c.Type)
+		}
+		a, err := f(c, dbh)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+	return chain, nil
+}
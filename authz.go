@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/pkg/errors"
+)
+
+//one question asked to the policy decision point
+type AuthzCheck struct {
+	Table  string                 `json:"table"`
+	Action string                 `json:"action"` //c, r, u or d
+	Values map[string]interface{} `json:"values"` //candidate row or new field values, optional
+}
+
+//subject is given by its token or user id, a single check can be sent without checks
+type AuthzRequest struct {
+	Token  string       `json:"token"`
+	UserId int64        `json:"user_id"`
+	Checks []AuthzCheck `json:"checks"`
+	AuthzCheck
+}
+
+type AuthzResponse struct {
+	UserId  int64              `json:"user_id"`
+	Results []*models.Decision `json:"results"`
+}
+
+//session data of the subject, inspecting by user id needs read access to the user
+func (ac *AuthController) authzSubject(caller *models.UserData, req *AuthzRequest) (*models.UserData, error) {
+	if req.Token != "" {
+		return ac.authenticate(req.Token)
+	}
+	if req.UserId <= 0 {
+		return nil, errors.New("token or user_id required")
+	}
+	if req.UserId == caller.Id {
+		return caller, nil
+	}
+	au, err := ac.dbHandler.GetAuthUser(req.UserId)
+	if err != nil {
+		return nil, models.INVALID_ENTRY
+	}
+	if !ac.dbHandler.CanInspect(caller, au) {
+		return nil, models.UNAUTHORIZED
+	}
+	return ac.buildUserData(req.UserId)
+}
+
+func (ac *AuthController) checkAccess(caller *models.UserData, req *AuthzRequest) (*AuthzResponse, error) {
+	checks := req.Checks
+	if len(checks) == 0 {
+		if req.Table == "" {
+			return nil, errors.New("checks required")
+		}
+		checks = []AuthzCheck{req.AuthzCheck}
+	}
+	if len(checks) > models.MAX_AUTHZ_CHECKS {
+		return nil, errors.New(fmt.Sprintf("at most %d checks are allowed", models.MAX_AUTHZ_CHECKS))
+	}
+	ud, err := ac.authzSubject(caller, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := &AuthzResponse{UserId: ud.Id, Results: make([]*models.Decision, len(checks))}
+	for i, c := range checks {
+		resp.Results[i] = ac.dbHandler.CheckAccess(ud, c.Table, c.Action, c.Values)
+	}
+	return resp, nil
+}
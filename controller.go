@@ -8,6 +8,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -40,7 +41,11 @@ func setPassword(s *Server) httprouter.Handle{
 			return
 		}
 
-		if err := s.ac.setPassword(token, pass); err != nil {
+		if err := s.ac.setPassword(token, pass, clientIp(r, s.trustProxy)); err != nil {
+			if errors.Cause(err) == models.ACCOUNT_LOCKED {
+				writeLocked(w, err)
+				return
+			}
 			writeResp(w, http.StatusBadRequest, err, nil)
 		} else {
 			writeResp(w, http.StatusOK, nil, map[string]string{"status": "success"})
@@ -48,6 +53,93 @@ func setPassword(s *Server) httprouter.Handle{
 	}
 }
 
+func handleForgotPassword(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeResp(w, http.StatusBadRequest, errors.New("username/email required"), nil)
+			return
+		}
+		var creds map[string]string
+		if err = json.Unmarshal(body, &creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		identifier := creds["username"]
+		if identifier == "" {
+			identifier = creds["email"]
+		}
+		if identifier == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("username/email required"),
+				map[string]string{"username": "required"})
+			return
+		}
+		//same response irrespective of user being present, user is looked up & mailed in background
+		//so response time does not tell either
+		go s.ac.forgotPassword(identifier, creds["org"])
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "success"})
+	}
+}
+
+func handleSignup(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		var creds map[string]interface{}
+		if err = json.Unmarshal(body, &creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		pass, ok := creds["password"].(string)
+		if !ok || pass == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("password required"),
+				map[string]string{"password": "required"})
+			return
+		}
+
+		if u, err := s.ac.signup(body, pass); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+		} else {
+			writeResp(w, http.StatusOK, nil, u)
+		}
+	}
+}
+
+func handleVerify(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeResp(w, http.StatusBadRequest, errors.New("token required"), nil)
+			return
+		}
+		var creds map[string]string
+		if err = json.Unmarshal(body, &creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		var token string
+		var ok bool
+		if token, ok = creds["token"]; !ok {
+			writeResp(w, http.StatusBadRequest, errors.New("token required"),
+				map[string]string{"token": "required"})
+			return
+		}
+
+		if err := s.ac.verify(token, clientIp(r, s.trustProxy)); err != nil {
+			if errors.Cause(err) == models.ACCOUNT_LOCKED {
+				writeLocked(w, err)
+				return
+			}
+			writeResp(w, http.StatusBadRequest, err, nil)
+		} else {
+			writeResp(w, http.StatusOK, nil, map[string]string{"status": "success"})
+		}
+	}
+}
 
 func handleLogin(s *Server) httprouter.Handle{
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -66,19 +158,282 @@ func handleLogin(s *Server) httprouter.Handle{
 		if pass, ok = creds["password"]; !ok {
 			writeResp(w, http.StatusBadRequest, errors.New("password required"),
 				map[string]string{"password": "required"})
+			return
 		}
+		//email can be used in place of username
 		if un, ok = creds["username"]; !ok {
-			writeResp(w, http.StatusBadRequest, errors.New("username required"),
-				map[string]string{"username": "required"})
+			if un, ok = creds["email"]; !ok {
+				writeResp(w, http.StatusBadRequest, errors.New("username required"),
+					map[string]string{"username": "required"})
+				return
+			}
 		}
-		if uuid, err := s.ac.login(un, pass); err != nil {
-			switch err {
+		if tokens, challenge, err := s.ac.login(un, creds["org"], pass, clientMeta(s, r)); err != nil {
+			switch errors.Cause(err) {
 			case models.INVALID_CREDENTIALS : writeResp(w, http.StatusUnauthorized, err, nil)
+			case models.ACCOUNT_LOCKED : writeLocked(w, err)
+			case models.INACTIVE_USER, models.ACCOUNT_NOT_VERIFIED, models.PASSWORD_LOGIN_DISABLED :
+				writeResp(w, http.StatusForbidden, err, nil)
+			case models.PASSWORD_EXPIRED :
+				//client should ask for a new password and use setpassword with this token
+				if pe, ok := err.(*passwordExpiredError); ok {
+					writeResp(w, http.StatusForbidden, err, map[string]string{"password_token": pe.token})
+				} else {
+					writeResp(w, http.StatusForbidden, err, nil)
+				}
+			default:
+				writeResp(w, http.StatusBadRequest, err, nil)
+			}
+		} else if challenge != nil {
+			writeResp(w, http.StatusOK, nil, challenge)
+		} else {
+			writeResp(w, http.StatusOK, nil, tokens)
+		}
+	}
+}
+
+//second step of login for users with two factor authentication
+func handleLoginMFA(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeResp(w, http.StatusBadRequest, errors.New("mfa_token required"), nil)
+			return
+		}
+		var creds map[string]string
+		if err = json.Unmarshal(body, &creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		token := creds["mfa_token"]
+		if token == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("mfa_token required"),
+				map[string]string{"mfa_token": "required"})
+			return
+		}
+		if creds["code"] == "" && creds["recovery_code"] == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("code required"),
+				map[string]string{"code": "required"})
+			return
+		}
+		if tokens, err := s.ac.loginMFA(token, creds["code"], creds["recovery_code"], clientIp(r, s.trustProxy)); err != nil {
+			switch errors.Cause(err) {
+			case models.USER_NOT_AUTHENTICATED, models.INVALID_MFA_CODE:
+				writeResp(w, http.StatusUnauthorized, err, nil)
+			case models.ACCOUNT_LOCKED:
+				writeLocked(w, err)
+			default:
+				writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+			}
+		} else {
+			writeResp(w, http.StatusOK, nil, tokens)
+		}
+	}
+}
+
+//{"email": "a@b.com"}, response is same whether or not the user exists
+func handleMagicLink(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var creds map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		email := creds["email"]
+		if email == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("email required"),
+				map[string]string{"email": "required"})
+			return
+		}
+		if err := s.ac.requestMagicLink(email, clientIp(r, s.trustProxy)); err != nil {
+			if errors.Cause(err) == models.ACCOUNT_LOCKED {
+				writeLocked(w, err)
+				return
+			}
+			writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+		} else {
+			writeResp(w, http.StatusOK, nil, map[string]string{"status": "success"})
+		}
+	}
+}
+
+//exchanges token from the magic link, response is same as login
+func handleMagicLinkLogin(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var creds map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		token := creds["token"]
+		if token == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("token required"),
+				map[string]string{"token": "required"})
+			return
+		}
+		if tokens, challenge, err := s.ac.loginMagicLink(token, clientMeta(s, r)); err != nil {
+			switch errors.Cause(err) {
+			case models.USER_NOT_AUTHENTICATED : writeResp(w, http.StatusUnauthorized, err, nil)
+			case models.ACCOUNT_LOCKED : writeLocked(w, err)
+			case models.INACTIVE_USER, models.ACCOUNT_NOT_VERIFIED : writeResp(w, http.StatusForbidden, err, nil)
+			default:
+				writeResp(w, http.StatusBadRequest, err, nil)
+			}
+		} else if challenge != nil {
+			writeResp(w, http.StatusOK, nil, challenge)
+		} else {
+			writeResp(w, http.StatusOK, nil, tokens)
+		}
+	}
+}
+
+func handleRefresh(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeResp(w, http.StatusBadRequest, errors.New("refresh_token required"), nil)
+			return
+		}
+		var creds map[string]string
+		if err = json.Unmarshal(body, &creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		var token string
+		var ok bool
+		if token, ok = creds["refresh_token"]; !ok {
+			writeResp(w, http.StatusBadRequest, errors.New("refresh_token required"),
+				map[string]string{"refresh_token": "required"})
+			return
+		}
+		if tokens, err := s.ac.refresh(token, clientMeta(s, r)); err != nil {
+			switch err {
+			case models.USER_NOT_AUTHENTICATED, models.REFRESH_TOKEN_REUSED:
+				writeResp(w, http.StatusUnauthorized, err, nil)
+			default:
+				writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+			}
+		} else {
+			writeResp(w, http.StatusOK, nil, tokens)
+		}
+	}
+}
+
+//redirects user to the identity provider
+func handleOAuthLogin(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if url, err := s.ac.oauthRedirect(ps.ByName("provider")); err == models.INVALID_ENTRY {
+			writeResp(w, http.StatusNotFound, err, nil)
+		} else if err != nil {
+			writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+		} else {
+			http.Redirect(w, r, url, http.StatusFound)
+		}
+	}
+}
+
+//identity provider redirects back here with the authorization code
+func handleOAuthCallback(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		qValues := r.URL.Query()
+		if e := qValues.Get("error"); e != "" {
+			writeResp(w, http.StatusUnauthorized, errors.New("login failed : "+e), nil)
+			return
+		}
+		code, state := qValues.Get("code"), qValues.Get("state")
+		if code == "" || state == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("code & state required"), nil)
+			return
+		}
+		if tokens, challenge, err := s.ac.oauthCallback(ps.ByName("provider"), code, state, clientMeta(s, r)); err != nil {
+			switch errors.Cause(err) {
+			case models.INVALID_ENTRY:
+				writeResp(w, http.StatusNotFound, err, nil)
+			case models.USER_NOT_AUTHENTICATED, models.EXTERNAL_USER_NOT_FOUND:
+				writeResp(w, http.StatusUnauthorized, err, nil)
+			case models.INACTIVE_USER, models.ACCOUNT_NOT_VERIFIED:
+				writeResp(w, http.StatusForbidden, err, nil)
 			default:
 				writeResp(w, http.StatusBadRequest, err, nil)
 			}
+		} else if challenge != nil {
+			writeResp(w, http.StatusOK, nil, challenge)
 		} else {
-			writeResp(w, http.StatusOK, nil, map[string]string{"token": uuid})
+			writeResp(w, http.StatusOK, nil, tokens)
+		}
+	}
+}
+
+//service provider metadata of the org for its identity provider, served as is
+func handleSamlMetadata(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if d, err := s.ac.samlMetadata(ps.ByName("org")); err == models.INVALID_ENTRY {
+			writeResp(w, http.StatusNotFound, err, nil)
+		} else if err != nil {
+			logrus.Error(err)
+			writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+		} else {
+			w.Header().Set("Content-Type", "application/samlmetadata+xml")
+			w.Write(d)
+		}
+	}
+}
+
+//redirects user to the identity provider of the org
+func handleSamlLogin(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if url, err := s.ac.samlRedirect(ps.ByName("org")); err == models.INVALID_ENTRY {
+			writeResp(w, http.StatusNotFound, err, nil)
+		} else if err != nil {
+			logrus.Error(err)
+			writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+		} else {
+			http.Redirect(w, r, url, http.StatusFound)
+		}
+	}
+}
+
+//identity provider posts the signed response here
+func handleSamlACS(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if err := r.ParseForm(); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		response := r.PostForm.Get("SAMLResponse")
+		if response == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("SAMLResponse required"), nil)
+			return
+		}
+		if tokens, challenge, err := s.ac.samlACS(ps.ByName("org"), response, r.PostForm.Get("RelayState"),
+			clientMeta(s, r)); err != nil {
+			switch errors.Cause(err) {
+			case models.INVALID_ENTRY:
+				writeResp(w, http.StatusNotFound, err, nil)
+			case models.USER_NOT_AUTHENTICATED:
+				writeResp(w, http.StatusUnauthorized, err, nil)
+			case models.INACTIVE_USER, models.ACCOUNT_NOT_VERIFIED:
+				writeResp(w, http.StatusForbidden, err, nil)
+			default:
+				writeResp(w, http.StatusBadRequest, err, nil)
+			}
+		} else if challenge != nil {
+			writeResp(w, http.StatusOK, nil, challenge)
+		} else {
+			writeResp(w, http.StatusOK, nil, tokens)
+		}
+	}
+}
+
+//public keys to verify access tokens, served as is (not wrapped in response)
+func handleJWKS(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if d, err := json.Marshal(s.ac.jwt.JWKS()); err != nil {
+			writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+		} else {
+			w.Write(d)
 		}
 	}
 }
@@ -91,6 +446,582 @@ func handleLogout(s *Server,w http.ResponseWriter, r *http.Request, ps httproute
 	writeResp(w, http.StatusOK, nil, map[string]string{"status": "ok"})
 }
 
+func handleMe(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if m, err := s.ac.me(ud); err != nil {
+		writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+	} else {
+		writeResp(w, http.StatusOK, nil, m)
+	}
+}
+
+//{"current_password": "...", "email": "new@example.org"}, only models.SELF_UPDATE_FIELDS can be changed
+func handleUpdateMe(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	var creds map[string]interface{}
+	if err = json.Unmarshal(body, &creds); err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if pass, _ := creds["current_password"].(string); pass == "" {
+		writeResp(w, http.StatusBadRequest, errors.New("current_password required"),
+			map[string]string{"current_password": "required"})
+		return
+	}
+	if au, sent, err := s.ac.updateMe(ud, body, clientIp(r, s.trustProxy)); err != nil {
+		switch errors.Cause(err) {
+		case models.INVALID_CREDENTIALS:
+			writeResp(w, http.StatusUnauthorized, err, nil)
+		case models.ACCOUNT_LOCKED:
+			writeLocked(w, err)
+		default:
+			writeManageError(w, err)
+		}
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]interface{}{"user": au, "email_verification_sent": sent})
+	}
+}
+
+//{"token": "..."} sent to the new email on PATCH /auth/me
+func handleConfirmEmail(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var creds map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		if creds["token"] == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("token required"),
+				map[string]string{"token": "required"})
+			return
+		}
+		if err := s.ac.confirmEmail(creds["token"], clientIp(r, s.trustProxy)); err != nil {
+			if errors.Cause(err) == models.ACCOUNT_LOCKED {
+				writeLocked(w, err)
+				return
+			}
+			writeResp(w, http.StatusBadRequest, err, nil)
+		} else {
+			writeResp(w, http.StatusOK, nil, map[string]string{"status": "success"})
+		}
+	}
+}
+
+//{"current_password": "...", "password": "..."}
+func handleChangePassword(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	var creds map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if creds["current_password"] == "" {
+		writeResp(w, http.StatusBadRequest, errors.New("current_password required"),
+			map[string]string{"current_password": "required"})
+		return
+	}
+	if creds["password"] == "" {
+		writeResp(w, http.StatusBadRequest, errors.New("password required"),
+			map[string]string{"password": "required"})
+		return
+	}
+	if err := s.ac.changePassword(ud, creds["current_password"], creds["password"], clientIp(r, s.trustProxy)); err != nil {
+		switch errors.Cause(err) {
+		case models.INVALID_CREDENTIALS:
+			writeResp(w, http.StatusUnauthorized, err, nil)
+		case models.ACCOUNT_LOCKED:
+			writeLocked(w, err)
+		case models.UNAUTHORIZED:
+			writeResp(w, http.StatusForbidden, err, nil)
+		default:
+			writeResp(w, http.StatusBadRequest, err, nil)
+		}
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "success"})
+	}
+}
+
+//policy decision point for other services, see AuthzRequest
+func handleAuthzCheck(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	req := &AuthzRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if resp, err := s.ac.checkAccess(ud, req); err != nil {
+		switch err {
+		case models.USER_NOT_AUTHENTICATED, models.INACTIVE_USER, models.ACCOUNT_NOT_VERIFIED:
+			//subject token is not usable, nothing is allowed
+			writeResp(w, http.StatusOK, err, map[string]interface{}{"authenticated": false})
+		default:
+			writeManageError(w, err)
+		}
+	} else {
+		writeResp(w, http.StatusOK, nil, resp)
+	}
+}
+
+func handleListSessions(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if sessions, err := s.ac.listSessions(ud); err != nil {
+		writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+	} else {
+		writeResp(w, http.StatusOK, nil, sessions)
+	}
+}
+
+func handleRevokeSession(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if err := s.ac.revokeSession(ud, ps.ByName("id")); err == models.INVALID_ENTRY {
+		writeResp(w, http.StatusNotFound, err, nil)
+	} else if err != nil {
+		writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "ok"})
+	}
+}
+
+func handleRevokeOtherSessions(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if err := s.ac.revokeOtherSessions(ud); err == models.UNAUTHORIZED {
+		writeResp(w, http.StatusForbidden, err, nil)
+	} else if err != nil {
+		writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "ok"})
+	}
+}
+
+//SU only, logs out the user from all devices
+func handleRevokeUserSessions(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if !s.DBh.IsSU(ud) {
+		writeResp(w, http.StatusForbidden, models.UNAUTHORIZED, nil)
+		return
+	}
+	uid, err := strconv.ParseInt(ps.ByName("user_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if err := s.ac.revokeSessions(uid); err != nil {
+		writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "ok"})
+	}
+}
+
+//reads code, recovery_code & current_password from request body
+func readMFACreds(r *http.Request) (map[string]string, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.New("code required")
+	}
+	var creds map[string]string
+	if err = json.Unmarshal(body, &creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+//reads code & recovery_code from request body
+func readMFACode(r *http.Request) (string, string, error) {
+	creds, err := readMFACreds(r)
+	if err != nil {
+		return "", "", err
+	}
+	if creds["code"] == "" && creds["recovery_code"] == "" {
+		return "", "", errors.New("code required")
+	}
+	return creds["code"], creds["recovery_code"], nil
+}
+
+func writeMFAError(w http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case models.INVALID_MFA_CODE, models.MFA_ALREADY_ENABLED, models.MFA_NOT_ENABLED:
+		writeResp(w, http.StatusBadRequest, err, nil)
+	case models.INVALID_CREDENTIALS:
+		writeResp(w, http.StatusUnauthorized, err, nil)
+	case models.UNAUTHORIZED:
+		writeResp(w, http.StatusForbidden, err, nil)
+	case models.ACCOUNT_LOCKED:
+		writeLocked(w, err)
+	default:
+		writeResp(w, http.StatusInternalServerError, err, nil)
+	}
+}
+
+//{"current_password": "..."}, secret is not stored till a code is verified
+func handleEnrollTOTP(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	creds, err := readMFACreds(r)
+	if err != nil || creds["current_password"] == "" {
+		writeResp(w, http.StatusBadRequest, errors.New("current_password required"),
+			map[string]string{"current_password": "required"})
+		return
+	}
+	if e, err := s.ac.enrollTOTP(ud, creds["current_password"], clientIp(r, s.trustProxy)); err != nil {
+		writeMFAError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, e)
+	}
+}
+
+//{"code": "123456", "current_password": "..."}
+func handleConfirmTOTP(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	creds, err := readMFACreds(r)
+	if err != nil || creds["code"] == "" {
+		writeResp(w, http.StatusBadRequest, errors.New("code required"), map[string]string{"code": "required"})
+		return
+	}
+	if creds["current_password"] == "" {
+		writeResp(w, http.StatusBadRequest, errors.New("current_password required"),
+			map[string]string{"current_password": "required"})
+		return
+	}
+	if codes, err := s.ac.confirmTOTP(ud, creds["code"], creds["current_password"], clientIp(r, s.trustProxy)); err != nil {
+		writeMFAError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string][]string{"recovery_codes": codes})
+	}
+}
+
+func handleDisableTOTP(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	code, recovery, err := readMFACode(r)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, map[string]string{"code": "required"})
+		return
+	}
+	if err := s.ac.disableTOTP(ud, code, recovery); err != nil {
+		writeMFAError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "ok"})
+	}
+}
+
+func handleRecoveryCodes(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	code, _, err := readMFACode(r)
+	if err != nil || code == "" {
+		writeResp(w, http.StatusBadRequest, errors.New("code required"), map[string]string{"code": "required"})
+		return
+	}
+	if codes, err := s.ac.regenerateRecoveryCodes(ud, code); err != nil {
+		writeMFAError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string][]string{"recovery_codes": codes})
+	}
+}
+
+//SU only, removes login lockout of the user
+func handleUnlockUser(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if !s.DBh.IsSU(ud) {
+		writeResp(w, http.StatusForbidden, models.UNAUTHORIZED, nil)
+		return
+	}
+	uid, err := strconv.ParseInt(ps.ByName("user_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if err := s.ac.unlockUser(uid); err == models.INVALID_ENTRY {
+		writeResp(w, http.StatusNotFound, err, nil)
+	} else if err != nil {
+		writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "ok"})
+	}
+}
+
+//SU or users with update access to status of users in their org
+func handleSetUserStatus(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	uid, err := strconv.ParseInt(ps.ByName("user_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, errors.New("status required"), nil)
+		return
+	}
+	var req map[string]string
+	if err = json.Unmarshal(body, &req); err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if req["status"] == "" {
+		writeResp(w, http.StatusBadRequest, errors.New("status required"),
+			map[string]string{"status": "required"})
+		return
+	}
+	if au, err := s.ac.setUserStatus(ud, uid, req["status"]); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, au)
+	}
+}
+
+//SU only, returns access token of the user which expires in a few minutes
+func handleImpersonate(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	uid, err := strconv.ParseInt(ps.ByName("user_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if tokens, err := s.ac.impersonate(ud, uid, clientIp(r, s.trustProxy)); err != nil {
+		switch err {
+		case models.INACTIVE_USER, models.ACCOUNT_NOT_VERIFIED:
+			writeResp(w, http.StatusForbidden, err, nil)
+		default:
+			writeManageError(w, err)
+		}
+	} else {
+		writeResp(w, http.StatusOK, nil, tokens)
+	}
+}
+
+//errors of actions on other users & their keys
+func writeManageError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.UNAUTHORIZED:
+		writeResp(w, http.StatusForbidden, err, nil)
+	case models.INVALID_ENTRY:
+		writeResp(w, http.StatusNotFound, err, nil)
+	case models.SERVER_ERROR:
+		writeResp(w, http.StatusInternalServerError, err, nil)
+	default:
+		writeResp(w, http.StatusBadRequest, err, nil)
+	}
+}
+
+//creates service account in org of the caller, response has its first api key
+func handleCreateServiceAccount(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if au, key, err := s.ac.createServiceAccount(ud, body); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]interface{}{"account": au, "api_key": key})
+	}
+}
+
+func handleListServiceAccounts(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if m, err := s.DBh.ListServiceAccounts(ud); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, m)
+	}
+}
+
+//{"name": "ci", "expires_in": 90}, expires_in is in days, key never expires if missing
+func handleCreateAPIKey(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	uid, err := strconv.ParseInt(ps.ByName("user_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	var req struct {
+		Name      string `json:"name"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if req.ExpiresIn < 0 {
+		writeResp(w, http.StatusBadRequest, errors.New("invalid expiry"), map[string]string{"expires_in": "min"})
+		return
+	}
+	if key, err := s.ac.createAPIKey(ud, uid, req.Name, req.ExpiresIn); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, key)
+	}
+}
+
+//{"name": "reports", "expires_in": 30, "scope": [{"table_name": "test_table", "column_name": "s_value", "value": "B", "permission": "r"}]}
+//scope can only contain access which the caller has
+func handleCreatePersonalToken(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	var req struct {
+		Name      string              `json:"name"`
+		ExpiresIn int                 `json:"expires_in"`
+		Scope     []models.ScopeEntry `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if req.ExpiresIn < 0 {
+		writeResp(w, http.StatusBadRequest, errors.New("invalid expiry"), map[string]string{"expires_in": "min"})
+		return
+	}
+	if key, err := s.ac.createPersonalToken(ud, req.Name, req.ExpiresIn, req.Scope); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, key)
+	}
+}
+
+func handleListPersonalTokens(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if keys, err := s.DBh.ListAPIKeys(ud.Id); err != nil {
+		writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
+	} else {
+		writeResp(w, http.StatusOK, nil, keys)
+	}
+}
+
+func handleListAPIKeys(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	uid, err := strconv.ParseInt(ps.ByName("user_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if keys, err := s.ac.listAPIKeys(ud, uid); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, keys)
+	}
+}
+
+func handleRotateAPIKey(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	kid, err := strconv.ParseInt(ps.ByName("key_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if key, err := s.ac.rotateAPIKey(ud, kid); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, key)
+	}
+}
+
+func handleRevokeAPIKey(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	kid, err := strconv.ParseInt(ps.ByName("key_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if err := s.ac.revokeAPIKey(ud, kid); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "ok"})
+	}
+}
+
+//{"email": "a@b.com", "user_role_id": 2}, SU also sends "org"
+func handleCreateInvitation(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	var req struct {
+		Email      string `json:"email"`
+		UserRoleId int64  `json:"user_role_id"`
+		Org        int64  `json:"org"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if inv, err := s.ac.invite(ud, req.Email, req.UserRoleId, req.Org); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, inv)
+	}
+}
+
+func handleListInvitations(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if l, err := s.DBh.ListInvitations(ud); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, l)
+	}
+}
+
+func handleResendInvitation(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	id, err := strconv.ParseInt(ps.ByName("invitation_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if inv, err := s.ac.resendInvitation(ud, id); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, inv)
+	}
+}
+
+func handleRevokeInvitation(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	id, err := strconv.ParseInt(ps.ByName("invitation_id"), 10, 64)
+	if err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if err := s.ac.revokeInvitation(ud, id); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, map[string]string{"status": "ok"})
+	}
+}
+
+func handleGetSamlConfig(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	if c, err := s.ac.samlConfig(ud, ps.ByName("org")); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, c)
+	}
+}
+
+//replaces saml config of the org, see models.SamlConfig
+func handleSaveSamlConfig(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
+	c := &models.SamlConfig{}
+	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
+		writeResp(w, http.StatusBadRequest, err, nil)
+		return
+	}
+	if c, err := s.ac.saveSamlConfig(ud, ps.ByName("org"), c); err != nil {
+		writeManageError(w, err)
+	} else {
+		writeResp(w, http.StatusOK, nil, c)
+	}
+}
+
+//{"token": "...", "username": "new_user", "password": "..."}
+func handleAcceptInvitation(s *Server) httprouter.Handle{
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		var creds map[string]interface{}
+		if err = json.Unmarshal(body, &creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+		token, ok := creds["token"].(string)
+		if !ok || token == "" {
+			writeResp(w, http.StatusBadRequest, errors.New("token required"),
+				map[string]string{"token": "required"})
+			return
+		}
+		//not needed for orgs without password login, checked while creating the user
+		pass, _ := creds["password"].(string)
+		delete(creds, "token")
+		if body, err = json.Marshal(creds); err != nil {
+			writeResp(w, http.StatusBadRequest, err, nil)
+			return
+		}
+
+		if au, err := s.ac.acceptInvitation(token, body, pass, clientIp(r, s.trustProxy)); err != nil {
+			if errors.Cause(err) == models.ACCOUNT_LOCKED {
+				writeLocked(w, err)
+				return
+			}
+			writeResp(w, http.StatusBadRequest, err, nil)
+		} else {
+			writeResp(w, http.StatusOK, nil, au)
+		}
+	}
+}
+
 func handleRead(s *Server,w http.ResponseWriter, r *http.Request, ps httprouter.Params, ud *models.UserData) {
 	table := ps.ByName("table")
 	w.Header().Set("Content-Type", "application/json")
@@ -182,11 +1113,8 @@ func handleCreate(s *Server,w http.ResponseWriter, r *http.Request, ps httproute
 	if dbModel, err := s.DBh.SaveObj(body, table, ud); err == nil {
 		if s.DBh.IsAuthTable(table) {
 			//this needs special care to create a new password,
-			if tok, err := s.ac.NewUserCreate(dbModel, ud); err != nil {
+			if _, err := s.ac.NewUserCreate(dbModel, ud); err != nil {
 				logrus.Error("Unable to generate token for this user")
-			} else {
-				//TODO: should mail this to user
-				logrus.Debug("token="+tok)
 			}
 		}
 		writeResp(w, http.StatusOK, nil, dbModel)
@@ -204,9 +1132,16 @@ func BasicAuth(request HandleRequest, s *Server) httprouter.Handle {
 		if len(auth) > len (prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
 			token := auth[len(prefix):]
 			if ud, err := s.ac.authenticate(token); err == nil {
+				if err = s.ac.auditImpersonation(w, r, ud, clientIp(r, s.trustProxy)); err != nil {
+					writeResp(w, http.StatusInternalServerError, err, nil)
+					return
+				}
 				//when access is checked
 				request(s, w, r, ps, ud)
 				return
+			} else if err == models.INACTIVE_USER || err == models.ACCOUNT_NOT_VERIFIED {
+				writeResp(w, http.StatusForbidden, err, nil)
+				return
 			} else if err != models.USER_NOT_AUTHENTICATED {
 				writeResp(w, http.StatusInternalServerError, models.SERVER_ERROR, nil)
 				return
@@ -219,6 +1154,14 @@ func BasicAuth(request HandleRequest, s *Server) httprouter.Handle {
 	}
 }
 
+//too many failures, tells the client when to retry
+func writeLocked(w http.ResponseWriter, err error) {
+	if le, ok := err.(*lockedError); ok {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(le.wait.Seconds())), 10))
+	}
+	writeResp(w, http.StatusTooManyRequests, models.ACCOUNT_LOCKED, nil)
+}
+
 func writeResp(w http.ResponseWriter, status int, err error, data interface{}) {
 	w.WriteHeader(status)
 	var msg string
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	IMPERSONATION_EXPIRY = 10 //minutes, impersonation sessions cannot be refreshed
+	HEADER_IMPERSONATED_BY = "X-Impersonated-By"
+)
+
+//issues a short lived access token of user id for SU
+//session data is built exactly as for a login of the user, the SU is kept as actor
+func (ac *AuthController) impersonate(actor *models.UserData, id int64, ip string) (*SessionTokens, error) {
+	if !ac.dbHandler.IsSU(actor) {
+		return nil, models.UNAUTHORIZED
+	}
+	if id == actor.Id {
+		return nil, errors.New("cannot impersonate self")
+	}
+	ud, err := ac.buildUserData(id)
+	if err != nil {
+		return nil, err
+	}
+	ud.ActorId = actor.Id
+	if ud.Uuid, err = newUUID(); err != nil {
+		return nil, err
+	}
+	token := ud.Uuid
+	if ac.jwt != nil {
+		if token, err = ac.signAccess(ud, IMPERSONATION_EXPIRY*time.Minute); err != nil {
+			return nil, err
+		}
+	} else {
+		udjson, err := json.Marshal(ud)
+		if err != nil {
+			return nil, err
+		}
+		k := fmt.Sprintf("%s%s", REDIS_USER_UUID_KEY, ud.Uuid)
+		if err = ac.store.Set(k, udjson, IMPERSONATION_EXPIRY*time.Minute); err != nil {
+			return nil, err
+		}
+	}
+	//session without audit record should not be usable
+	if err = ac.dbHandler.AddAudit(actor.Id, id, models.AUDIT_IMPERSONATE, "session "+ud.Uuid, ip); err != nil {
+		ac.revokeAccess(ud.Uuid)
+		return nil, models.SERVER_ERROR
+	}
+	log.Warnf("User %d is impersonating user %d, session %s", actor.Id, id, ud.Uuid)
+	return &SessionTokens{Token: token, ExpiresIn: IMPERSONATION_EXPIRY * 60}, nil
+}
+
+//tags the request made in an impersonation session in response, logs & audit trail
+//request should not be served if it could not be audited
+func (ac *AuthController) auditImpersonation(w http.ResponseWriter, r *http.Request, ud *models.UserData, ip string) error {
+	if ud.ActorId == 0 {
+		return nil
+	}
+	w.Header().Set(HEADER_IMPERSONATED_BY, strconv.FormatInt(ud.ActorId, 10))
+	log.WithFields(log.Fields{"actor": ud.ActorId, "user": ud.Id, "session": ud.Uuid}).
+		Infof("Impersonated request %s %s", r.Method, r.URL.Path)
+	if err := ac.dbHandler.AddAudit(ud.ActorId, ud.Id, models.AUDIT_IMPERSONATED_REQUEST, r.Method+" "+r.URL.Path, ip); err != nil {
+		log.Errorf("Unable to audit request of user %d impersonating user %d : %s", ud.ActorId, ud.Id, err.Error())
+		return models.SERVER_ERROR
+	}
+	return nil
+}
@@ -39,9 +39,13 @@ DROP TABLE IF EXISTS `database_name_`.`org` ;
 CREATE TABLE IF NOT EXISTS `database_name_`.`org` (
   `id` INT NOT NULL AUTO_INCREMENT,
   `name` VARCHAR(63) NOT NULL,
+  `slug` VARCHAR(63) NULL,
+  `magic_link` TINYINT(1) NOT NULL DEFAULT 0,
+  `password_disabled` TINYINT(1) NOT NULL DEFAULT 0,
   `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
   `date_upd` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-  PRIMARY KEY (`id`))
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `slug_UNIQUE` (`slug` ASC) VISIBLE)
 ENGINE = InnoDB;
 
 
@@ -55,18 +59,23 @@ CREATE TABLE IF NOT EXISTS `database_name_`.`auth_user` (
   `username` VARCHAR(16) NULL,
   `email` VARCHAR(255) NULL,
   `password` VARCHAR(255) NULL,
+  `password_changed_at` TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `user_role_id` INT NOT NULL,
-  `is_active` TINYINT(1) NULL DEFAULT 0,
+  `status` ENUM('pending', 'active', 'suspended', 'locked', 'deleted') NOT NULL DEFAULT 'pending',
+  `account_type` ENUM('user', 'service') NOT NULL DEFAULT 'user',
   `org_id` INT NOT NULL,
   `facebook_id` VARCHAR(128) NULL,
   `google_id` VARCHAR(128) NULL,
+  `ldap_dn` VARCHAR(255) NULL,
+  `saml_id` VARCHAR(255) NULL,
   `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
   `date_upd` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
   PRIMARY KEY (`id`),
   UNIQUE INDEX `id_UNIQUE` (`id` ASC) VISIBLE,
   INDEX `fk_auth_user_user_roles1_idx` (`user_role_id` ASC) VISIBLE,
   INDEX `idx_username` (`username` ASC) VISIBLE,
-  INDEX `idx_is_active` (`is_active` ASC) VISIBLE,
+  INDEX `idx_email` (`email` ASC) VISIBLE,
+  INDEX `idx_status` (`status` ASC) VISIBLE,
   INDEX `fk_auth_user_org1_idx` (`org_id` ASC) VISIBLE,
   CONSTRAINT `fk_auth_user_user_roles1`
     FOREIGN KEY (`user_role_id`)
@@ -133,6 +142,201 @@ CREATE TABLE IF NOT EXISTS `database_name_`.`user_permission` (
     ON UPDATE NO ACTION)
 ENGINE = InnoDB;
 
+-- -----------------------------------------------------
+-- Table `database_name_`.`user_totp`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`user_totp` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`user_totp` (
+  `auth_user_id` INT NOT NULL,
+  `secret` VARCHAR(64) NOT NULL,
+  `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+  `date_upd` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`auth_user_id`),
+  CONSTRAINT `fk_user_totp_auth_user1`
+    FOREIGN KEY (`auth_user_id`)
+    REFERENCES `database_name_`.`auth_user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `database_name_`.`user_recovery_code`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`user_recovery_code` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`user_recovery_code` (
+  `id` INT NOT NULL AUTO_INCREMENT,
+  `auth_user_id` INT NOT NULL,
+  `code_hash` CHAR(64) NOT NULL,
+  `used_at` TIMESTAMP NULL,
+  `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  INDEX `idx_user_code` (`auth_user_id` ASC, `code_hash` ASC) VISIBLE,
+  CONSTRAINT `fk_user_recovery_code_auth_user1`
+    FOREIGN KEY (`auth_user_id`)
+    REFERENCES `database_name_`.`auth_user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `database_name_`.`password_history`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`password_history` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`password_history` (
+  `id` INT NOT NULL AUTO_INCREMENT,
+  `auth_user_id` INT NOT NULL,
+  `password` VARCHAR(255) NOT NULL,
+  `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  INDEX `fk_password_history_auth_user1_idx` (`auth_user_id` ASC) VISIBLE,
+  CONSTRAINT `fk_password_history_auth_user1`
+    FOREIGN KEY (`auth_user_id`)
+    REFERENCES `database_name_`.`auth_user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `database_name_`.`api_key`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`api_key` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`api_key` (
+  `id` INT NOT NULL AUTO_INCREMENT,
+  `auth_user_id` INT NOT NULL,
+  `org_id` INT NOT NULL,
+  `name` VARCHAR(63) NOT NULL,
+  `prefix` VARCHAR(32) NOT NULL,
+  `key_hash` CHAR(64) NOT NULL,
+  `expires_at` TIMESTAMP NULL,
+  `last_used_at` TIMESTAMP NULL,
+  `revoked_at` TIMESTAMP NULL,
+  `scope` TEXT NULL,
+  `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+  `date_upd` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `prefix_UNIQUE` (`prefix` ASC) VISIBLE,
+  INDEX `fk_api_key_auth_user1_idx` (`auth_user_id` ASC) VISIBLE,
+  CONSTRAINT `fk_api_key_auth_user1`
+    FOREIGN KEY (`auth_user_id`)
+    REFERENCES `database_name_`.`auth_user` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION,
+  CONSTRAINT `fk_api_key_org1`
+    FOREIGN KEY (`org_id`)
+    REFERENCES `database_name_`.`org` (`id`)
+    ON DELETE NO ACTION
+    ON UPDATE NO ACTION)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `database_name_`.`invitation`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`invitation` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`invitation` (
+  `id` INT NOT NULL AUTO_INCREMENT,
+  `org_id` INT NOT NULL,
+  `email` VARCHAR(255) NOT NULL,
+  `user_role_id` INT NOT NULL,
+  `invited_by` INT NOT NULL,
+  `token_hash` CHAR(64) NOT NULL,
+  `expires_at` TIMESTAMP NOT NULL,
+  `accepted_at` TIMESTAMP NULL,
+  `revoked_at` TIMESTAMP NULL,
+  `auth_user_id` INT NULL,
+  `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+  `date_upd` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE INDEX `token_hash_UNIQUE` (`token_hash` ASC) VISIBLE,
+  INDEX `idx_email` (`email` ASC) VISIBLE,
+  INDEX `fk_invitation_org1_idx` (`org_id` ASC) VISIBLE,
+  CONSTRAINT `fk_invitation_org1`
+    FOREIGN KEY (`org_id`)
+    REFERENCES `database_name_`.`org` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION,
+  CONSTRAINT `fk_invitation_user_role1`
+    FOREIGN KEY (`user_role_id`)
+    REFERENCES `database_name_`.`user_role` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `database_name_`.`saml_config`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`saml_config` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`saml_config` (
+  `org_id` INT NOT NULL,
+  `enabled` TINYINT(1) NOT NULL DEFAULT 0,
+  `idp_entity_id` VARCHAR(255) NOT NULL,
+  `idp_sso_url` VARCHAR(1024) NOT NULL,
+  `idp_cert` TEXT NOT NULL,
+  `username_attr` VARCHAR(255) NOT NULL DEFAULT '',
+  `email_attr` VARCHAR(255) NOT NULL DEFAULT 'email',
+  `role_attr` VARCHAR(255) NOT NULL DEFAULT '',
+  `role_map` TEXT NOT NULL,
+  `default_role` INT NOT NULL DEFAULT 0,
+  `allow_idp_initiated` TINYINT(1) NOT NULL DEFAULT 0,
+  `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+  `date_upd` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`org_id`),
+  CONSTRAINT `fk_saml_config_org1`
+    FOREIGN KEY (`org_id`)
+    REFERENCES `database_name_`.`org` (`id`)
+    ON DELETE CASCADE
+    ON UPDATE NO ACTION)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `database_name_`.`audit_log`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`audit_log` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`audit_log` (
+  `id` INT NOT NULL AUTO_INCREMENT,
+  `actor_id` INT NOT NULL,
+  `auth_user_id` INT NOT NULL,
+  `action` VARCHAR(63) NOT NULL,
+  `detail` VARCHAR(511) NULL,
+  `ip` VARCHAR(45) NULL,
+  `date_add` TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  INDEX `audit_log_actor_idx` (`actor_id` ASC) VISIBLE,
+  INDEX `audit_log_user_idx` (`auth_user_id` ASC) VISIBLE)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `database_name_`.`session_store`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`session_store` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`session_store` (
+  `k` VARCHAR(255) NOT NULL,
+  `v` TEXT NOT NULL,
+  `expires_at` TIMESTAMP(6) NULL,
+  PRIMARY KEY (`k`),
+  INDEX `session_store_expires_idx` (`expires_at` ASC) VISIBLE)
+ENGINE = InnoDB;
+
+-- -----------------------------------------------------
+-- Table `database_name_`.`session_store_member`
+-- -----------------------------------------------------
+DROP TABLE IF EXISTS `database_name_`.`session_store_member` ;
+
+CREATE TABLE IF NOT EXISTS `database_name_`.`session_store_member` (
+  `k` VARCHAR(255) NOT NULL,
+  `member` VARCHAR(255) NOT NULL,
+  `expires_at` TIMESTAMP(6) NULL,
+  PRIMARY KEY (`k`, `member`),
+  INDEX `session_store_member_expires_idx` (`expires_at` ASC) VISIBLE)
+ENGINE = InnoDB;
+
 DROP TABLE IF EXISTS `database_name_`.`test_table` ;
 
 CREATE TABLE IF NOT EXISTS `database_name_`.`test_table` (
@@ -200,8 +404,8 @@ ENGINE = InnoDB;
 
 insert into user_role set id=1, role="super_admin";
 insert into user_role set id=2, role="another_user";
-insert into org set id=1, name="super_users";
-insert into org set id=2, name="another_org";
+insert into org set id=1, name="super_users", slug="super_users";
+insert into org set id=2, name="another_org", slug="another_org";
 
 insert into user_role_permission set table_name='test_table2', column_name='', permission='r', user_role_id=2;
 insert into user_role_permission set table_name='test_table2', column_name='', permission='c', user_role_id=2;
@@ -220,8 +424,8 @@ insert into user_role_permission set table_name='test_table', column_name='u_val
 -- -----------------------------------------------------
 -- Password  : nkktest
 -- -----------------------------------------------------
-insert into auth_user set id=1, username="su", user_role_id=1, org_id=1, is_active=1, password="$2a$04$p9zm7fqZVajMyiSE1bXgl.kJpt4Nw2mOzdAoY57Wp43NqVJ.kGMOq";
-insert into auth_user set id=2, username="simple_user", user_role_id=2, org_id=2, is_active=1, password="$2a$04$p9zm7fqZVajMyiSE1bXgl.kJpt4Nw2mOzdAoY57Wp43NqVJ.kGMOq";
+insert into auth_user set id=1, username="su", user_role_id=1, org_id=1, status='active', password="$2a$04$p9zm7fqZVajMyiSE1bXgl.kJpt4Nw2mOzdAoY57Wp43NqVJ.kGMOq";
+insert into auth_user set id=2, username="simple_user", user_role_id=2, org_id=2, status='active', password="$2a$04$p9zm7fqZVajMyiSE1bXgl.kJpt4Nw2mOzdAoY57Wp43NqVJ.kGMOq";
 
 insert into test_table(name, s_value, i_value, u_value, f_value, d_value, auth_user_id, org_id) values("yes", 'B', 1, 1, 1.1, 1.2, 2, 2);
 insert into test_table(name, s_value, i_value, u_value, f_value, d_value, auth_user_id, org_id) values("yes", 'B', 1, 2, 1.1, 1.2, 2, 2);
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/auth_backend/models"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	INVITATION_EXPIRY = 7 //days
+)
+
+//token is sent only to the invitee, only its hash is stored
+func newInvitationToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func invitationExpiry() time.Time {
+	return time.Now().Add(INVITATION_EXPIRY * 24 * time.Hour)
+}
+
+//invites email into org of ud (or given org for SU) with the role
+func (ac *AuthController) invite(ud *models.UserData, email string, roleId int64, org int64) (*models.Invitation, error) {
+	tok, err := newInvitationToken()
+	if err != nil {
+		return nil, err
+	}
+	inv, err := ac.dbHandler.CreateInvitation(ud, email, roleId, org, models.HashAPIKeySecret(tok), invitationExpiry())
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("User %d invited %s into org %d", ud.Id, inv.Email, inv.OrgId)
+	ac.sendInvitation(inv, tok)
+	return inv, nil
+}
+
+//failure to deliver is only logged, invitation can be resent
+func (ac *AuthController) sendInvitation(inv *models.Invitation, token string) {
+	if ac.notifier == nil {
+		return
+	}
+	msg := &Message{Type: MSG_INVITATION, To: inv.Email, Token: token}
+	if org, err := ac.dbHandler.GetOrg(inv.OrgId); err == nil {
+		msg.Org = org.Name
+	}
+	if err := ac.notifier.Notify(msg); err != nil {
+		log.Errorf("Unable to send invitation %d : %s", inv.Id, err.Error())
+	}
+}
+
+//sends a new token, expiry starts again
+func (ac *AuthController) resendInvitation(ud *models.UserData, id int64) (*models.Invitation, error) {
+	inv, err := ac.dbHandler.GetManagedInvitation(id, ud)
+	if err != nil {
+		return nil, err
+	}
+	if inv.AcceptedAt != nil || inv.RevokedAt != nil {
+		return nil, models.INVALID_ENTRY
+	}
+	tok, err := newInvitationToken()
+	if err != nil {
+		return nil, err
+	}
+	exp := invitationExpiry()
+	if err = ac.dbHandler.RenewInvitation(inv.Id, models.HashAPIKeySecret(tok), exp); err != nil {
+		return nil, err
+	}
+	inv.ExpiresAt = exp
+	ac.sendInvitation(inv, tok)
+	return inv, nil
+}
+
+func (ac *AuthController) revokeInvitation(ud *models.UserData, id int64) error {
+	inv, err := ac.dbHandler.GetManagedInvitation(id, ud)
+	if err != nil {
+		return err
+	}
+	if err = ac.dbHandler.RevokeInvitation(inv.Id); err != nil {
+		return err
+	}
+	log.Infof("Invitation %d revoked by user %d", inv.Id, ud.Id)
+	return nil
+}
+
+//creates the invited user with username from data and given password
+func (ac *AuthController) acceptInvitation(token string, data []byte, pass string, ip string) (*models.AuthUser, error) {
+	if err := ac.throttle.check(ac.throttle.ipKey(ip)); err != nil {
+		return nil, err
+	}
+	inv, err := ac.dbHandler.FindInvitation(models.HashAPIKeySecret(token))
+	if err != nil {
+		return nil, err
+	}
+	if inv == nil || !inv.Pending(time.Now()) {
+		ac.throttle.fail(ac.throttle.ipKey(ip))
+		return nil, models.INVALID_TOKEN
+	}
+	au, err := ac.dbHandler.AcceptInvitation(inv, data, pass)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Invitation %d accepted, user %d created", inv.Id, au.GetId())
+	ac.notify(MSG_WELCOME, au, "")
+	return au, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+const (
+	SESSION_MODE_REDIS = "redis" //access tokens are looked up in session store
+	SESSION_MODE_JWT   = "jwt"
+)
+
+//key as configured in jwt.keys
+//HS256 keys need secret, RS256/EdDSA keys need a pem encoded private key file
+type JWTKeyConfig struct {
+	Kid        string `mapstructure:"kid"`
+	Alg        string `mapstructure:"alg"`
+	Secret     string `mapstructure:"secret"`
+	PrivateKey string `mapstructure:"private_key"`
+}
+
+type jwtKey struct {
+	kid    string
+	method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+//claims carried by the access token, enough to build UserData without a lookup
+type sessionClaims struct {
+	jwt.RegisteredClaims
+	Org    int64              `json:"org"`
+	Role   int64              `json:"role"`
+	Pv     int64              `json:"pv"`
+	Rv     int64              `json:"rv"`
+	Uv     int64              `json:"uv"`
+	Family string             `json:"fam,omitempty"`
+	P      *models.Permissions `json:"perms,omitempty"`
+	Act    *actorClaim         `json:"act,omitempty"`
+}
+
+//user acting on behalf of the subject, as in RFC 8693
+type actorClaim struct {
+	Subject string `json:"sub"`
+}
+
+//Signs & verifies access tokens, all configured keys are accepted for verification
+//only the active key is used to sign, this allows rotating keys without logging out users
+type JWTIssuer struct {
+	keys   map[string]*jwtKey
+	active *jwtKey
+	issuer string
+	expiry time.Duration
+}
+
+func NewJWTIssuer(issuer string, activeKid string, defaultAlg string, expiry time.Duration, cfgs []JWTKeyConfig) (*JWTIssuer, error) {
+	if len(cfgs) == 0 {
+		return nil, errors.New("no jwt keys configured")
+	}
+	j := &JWTIssuer{keys: make(map[string]*jwtKey), issuer: issuer, expiry: expiry}
+	for _, c := range cfgs {
+		if c.Kid == "" {
+			return nil, errors.New("jwt key without kid")
+		}
+		if _, ok := j.keys[c.Kid]; ok {
+			return nil, errors.New("duplicate jwt key " + c.Kid)
+		}
+		alg := c.Alg
+		if alg == "" {
+			alg = defaultAlg
+		}
+		k, err := loadJWTKey(c, alg)
+		if err != nil {
+			return nil, errors.Wrap(err, "jwt key "+c.Kid)
+		}
+		j.keys[c.Kid] = k
+	}
+	if activeKid == "" {
+		activeKid = cfgs[0].Kid
+	}
+	var ok bool
+	if j.active, ok = j.keys[activeKid]; !ok {
+		return nil, errors.New("active jwt key not found : " + activeKid)
+	}
+	return j, nil
+}
+
+func loadJWTKey(c JWTKeyConfig, alg string) (*jwtKey, error) {
+	k := &jwtKey{kid: c.Kid}
+	switch alg {
+	case "HS256":
+		if len(c.Secret) < 32 {
+			return nil, errors.New("HS256 secret should be atleast 32 chars")
+		}
+		k.method = jwt.SigningMethodHS256
+		k.sign = []byte(c.Secret)
+		k.verify = k.sign
+	case "RS256", "EdDSA":
+		pem, err := ioutil.ReadFile(c.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if alg == "RS256" {
+			pk, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			k.method = jwt.SigningMethodRS256
+			k.sign = pk
+			k.verify = &pk.PublicKey
+		} else {
+			pk, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+			k.method = jwt.SigningMethodEdDSA
+			k.sign = pk
+			k.verify = pk.(crypto.Signer).Public()
+		}
+	default:
+		return nil, errors.New("unsupported jwt alg " + alg)
+	}
+	return k, nil
+}
+
+//creates a signed access token, jti is the session uuid
+//token expires after configured expiry if expiry is 0
+func (j *JWTIssuer) Sign(ud *models.UserData, pv int64, expiry time.Duration) (string, error) {
+	if expiry == 0 {
+		expiry = j.expiry
+	}
+	now := time.Now()
+	claims := &sessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    j.issuer,
+			Subject:   strconv.FormatInt(ud.Id, 10),
+			ID:        ud.Uuid,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiry)),
+		},
+		Org:    ud.Org_id,
+		Role:   ud.RoleId,
+		Pv:     pv,
+		Rv:     ud.Rv,
+		Uv:     ud.Uv,
+		Family: ud.Family,
+		P:      ud.P,
+	}
+	if ud.ActorId != 0 {
+		claims.Act = &actorClaim{Subject: strconv.FormatInt(ud.ActorId, 10)}
+	}
+	t := jwt.NewWithClaims(j.active.method, claims)
+	t.Header["kid"] = j.active.kid
+	return t.SignedString(j.active.sign)
+}
+
+//verifies signature, expiry & issuer, returns the session data in token
+func (j *JWTIssuer) Parse(token string) (*models.UserData, int64, error) {
+	claims := &sessionClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, ok := j.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown kid %s", kid)
+		}
+		if t.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("unexpected alg %s", t.Method.Alg())
+		}
+		return k.verify, nil
+	})
+	if err != nil {
+		return nil, 0, models.USER_NOT_AUTHENTICATED
+	}
+	if claims.Issuer != j.issuer {
+		return nil, 0, models.USER_NOT_AUTHENTICATED
+	}
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, 0, models.USER_NOT_AUTHENTICATED
+	}
+	ud := &models.UserData{Id: id, Uuid: claims.ID, Org_id: claims.Org, P: claims.P, Family: claims.Family,
+		RoleId: claims.Role, Rv: claims.Rv, Uv: claims.Uv}
+	if claims.ExpiresAt != nil {
+		ud.Expires = &claims.ExpiresAt.Time
+	}
+	if claims.Act != nil {
+		if ud.ActorId, err = strconv.ParseInt(claims.Act.Subject, 10, 64); err != nil {
+			return nil, 0, models.USER_NOT_AUTHENTICATED
+		}
+	}
+	return ud, claims.Pv, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//public keys in JWK set format, symmetric keys are never published
+func (j *JWTIssuer) JWKS() map[string]interface{} {
+	keys := make([]map[string]string, 0)
+	for _, k := range j.keys {
+		switch pub := k.verify.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{"kty": "RSA", "use": "sig", "alg": k.method.Alg(),
+				"kid": k.kid, "n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())})
+		case ed25519.PublicKey:
+			keys = append(keys, map[string]string{"kty": "OKP", "crv": "Ed25519", "use": "sig",
+				"alg": k.method.Alg(), "kid": k.kid, "x": b64(pub)})
+		}
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+//verifies the token, session store is only used to check if token or account has been revoked
+func (ac *AuthController) authenticateJWT(token string) (*models.UserData, error) {
+	ud, pv, err := ac.jwt.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := ac.store.MGet(fmt.Sprintf("%s%s", REDIS_JWT_REVOKED, ud.Uuid),
+		fmt.Sprintf("%s%d", REDIS_SESSION_VERSION, ud.Id),
+		fmt.Sprintf("%s%d", REDIS_ACCOUNT_STATUS, ud.Id))
+	if err != nil {
+		return nil, err
+	}
+	if vals[0] != nil {
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	if vals[2] != nil {
+		if err = models.StatusError(fmt.Sprintf("%v", vals[2])); err != nil {
+			return nil, err
+		}
+	}
+	if vals[1] != nil {
+		if cur, err := strconv.ParseInt(fmt.Sprintf("%v", vals[1]), 10, 64); err == nil && cur > pv {
+			//issued before sessions of the user were revoked
+			return nil, models.USER_NOT_AUTHENTICATED
+		}
+	}
+	return ac.refreshPermissions(ud)
+}
+
+//signs the session with current session version of the user
+func (ac *AuthController) signAccess(ud *models.UserData, expiry time.Duration) (string, error) {
+	var pv int64
+	str, err := ac.store.Get(fmt.Sprintf("%s%d", REDIS_SESSION_VERSION, ud.Id))
+	if err != nil && err != KEY_NOT_FOUND {
+		return "", err
+	} else if err == nil {
+		if pv, err = strconv.ParseInt(str, 10, 64); err != nil {
+			return "", err
+		}
+	}
+	return ac.jwt.Sign(ud, pv, expiry)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/auth_backend/utils"
+	"github.com/golang-jwt/jwt/v4"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// issuer with HS256 keys k1 & k2 and RS256 key rs, active key is activeKid
+func newTestJWTIssuer(t *testing.T, dir string, activeKid string) *JWTIssuer {
+	pk := filepath.Join(dir, "rs.pem")
+	if _, err := os.Stat(pk); err != nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		utils.Ok(t, err)
+		utils.Ok(t, ioutil.WriteFile(pk, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600))
+	}
+	j, err := NewJWTIssuer("auth", activeKid, "HS256", time.Minute, []JWTKeyConfig{
+		{Kid: "k1", Secret: testSecret}, {Kid: "k2", Secret: strings.ToUpper(testSecret)},
+		{Kid: "rs", Alg: "RS256", PrivateKey: pk}})
+	utils.Ok(t, err)
+	return j
+}
+
+func TestJWTIssuer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	utils.Ok(t, err)
+	defer os.RemoveAll(dir)
+	j := newTestJWTIssuer(t, dir, "k1")
+
+	ud := &models.UserData{Id: 5, Uuid: "sess", Org_id: 2, RoleId: 3, Family: "fam", ActorId: 1, Rv: 4, Uv: 6}
+	token, err := j.Sign(ud, 7, 0)
+	utils.Ok(t, err)
+	pud, pv, err := j.Parse(token)
+	utils.Ok(t, err)
+	utils.Equals(t, int64(7), pv)
+	utils.Assert(t, pud.Expires != nil && time.Until(*pud.Expires) <= time.Minute, "expiry from issuer, got %v", pud.Expires)
+	pud.Expires = nil
+	utils.Equals(t, ud, pud)
+
+	//key rotation, tokens signed by older key are accepted
+	rotated := newTestJWTIssuer(t, dir, "k2")
+	_, _, err = rotated.Parse(token)
+	utils.Ok(t, err)
+	rs := newTestJWTIssuer(t, dir, "rs")
+	rstoken, err := rs.Sign(ud, 0, 0)
+	utils.Ok(t, err)
+	_, _, err = j.Parse(rstoken)
+	utils.Ok(t, err)
+
+	parts := strings.Split(token, ".")
+	header := func(alg, kid string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"alg":"%s","kid":"%s","typ":"JWT"}`, alg, kid)))
+	}
+	hs := func(kid string, key []byte, claims jwt.Claims) string {
+		tk := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		tk.Header["kid"] = kid
+		s, err := tk.SignedString(key)
+		utils.Ok(t, err)
+		return s
+	}
+	valid := &sessionClaims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "auth", Subject: "5",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}}
+	//public key of rs used as HS256 secret
+	pub, err := ioutil.ReadFile(filepath.Join(dir, "rs.pem"))
+	utils.Ok(t, err)
+
+	test_table := map[string]string{
+		"tampered claims": parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"auth","sub":"1"}`)) +
+			"." + parts[2],
+		"tampered signature": parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])-4] + "AAAA",
+		"alg none":           header("none", "k1") + "." + parts[1] + ".",
+		"unknown kid":        hs("k9", []byte(testSecret), valid),
+		"no kid":             hs("", []byte(testSecret), valid),
+		"wrong key for kid":  hs("k2", []byte(testSecret), valid),
+		"alg of other key":   hs("rs", pub, valid),
+		"expired": hs("k1", []byte(testSecret), &sessionClaims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "auth",
+			Subject: "5", ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}}),
+		"other issuer": hs("k1", []byte(testSecret), &sessionClaims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "other",
+			Subject: "5", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}}),
+		"invalid subject": hs("k1", []byte(testSecret), &sessionClaims{RegisteredClaims: jwt.RegisteredClaims{Issuer: "auth",
+			Subject: "x", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}}),
+		"not a token": "abc",
+	}
+	_, _, err = j.Parse(hs("k1", []byte(testSecret), valid))
+	utils.Ok(t, err)
+	for name, tok := range test_table {
+		_, _, err := j.Parse(tok)
+		utils.Assert(t, err == models.USER_NOT_AUTHENTICATED, "%s : should be rejected, got %v", name, err)
+	}
+	expired, err := j.Sign(ud, 0, -time.Minute)
+	utils.Ok(t, err)
+	_, _, err = j.Parse(expired)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	cfg_table := map[string][]JWTKeyConfig{
+		"no keys":         nil,
+		"no kid":          {{Secret: testSecret}},
+		"short secret":    {{Kid: "k1", Secret: "short"}},
+		"duplicate kid":   {{Kid: "k1", Secret: testSecret}, {Kid: "k1", Secret: testSecret}},
+		"unsupported alg": {{Kid: "k1", Alg: "HS512", Secret: testSecret}},
+		"missing key":     {{Kid: "k1", Alg: "RS256", PrivateKey: filepath.Join(dir, "missing.pem")}},
+	}
+	for name, cfgs := range cfg_table {
+		_, err := NewJWTIssuer("auth", "", "HS256", time.Minute, cfgs)
+		utils.Assert(t, err != nil, "%s : should fail", name)
+	}
+	_, err = NewJWTIssuer("auth", "k9", "HS256", time.Minute, []JWTKeyConfig{{Kid: "k1", Secret: testSecret}})
+	utils.Assert(t, err != nil, "unknown active kid should fail")
+
+	jwks := rs.JWKS()["keys"].([]map[string]string)
+	utils.Equals(t, 1, len(jwks))
+	utils.Equals(t, "rs", jwks[0]["kid"])
+}
+
+func TestJWTRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	utils.Ok(t, err)
+	defer os.RemoveAll(dir)
+	ms := NewMemoryStore(0)
+	defer ms.Close()
+	ac := &AuthController{store: ms, jwt: newTestJWTIssuer(t, dir, "k1")}
+
+	ud := &models.UserData{Id: 5, Org_id: 2, RoleId: 3}
+	tokens, err := ac.createSession(ud, nil)
+	utils.Ok(t, err)
+	aud, err := ac.authenticate(tokens.Token)
+	utils.Ok(t, err)
+	utils.Equals(t, int64(5), aud.Id)
+	utils.Equals(t, ud.Family, aud.Family)
+
+	//deny list
+	other, err := ac.createSession(&models.UserData{Id: 5, Org_id: 2, RoleId: 3}, nil)
+	utils.Ok(t, err)
+	oud, err := ac.authenticate(other.Token)
+	utils.Ok(t, err)
+	utils.Ok(t, ac.revokeAccess(oud.Uuid))
+	_, err = ac.authenticate(other.Token)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+	_, err = ac.authenticate(tokens.Token)
+	utils.Ok(t, err)
+
+	//account no longer active
+	utils.Ok(t, ms.Set(fmt.Sprintf("%s%d", REDIS_ACCOUNT_STATUS, 5), models.STATUS_PENDING, 0))
+	_, err = ac.authenticate(tokens.Token)
+	utils.Equals(t, models.ACCOUNT_NOT_VERIFIED, err)
+	ms.Del(fmt.Sprintf("%s%d", REDIS_ACCOUNT_STATUS, 5))
+
+	//SESSION_VERSION is bumped when all sessions are revoked
+	utils.Ok(t, ac.revokeSessions(5))
+	_, err = ac.authenticate(tokens.Token)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+	token, err := ac.signAccess(&models.UserData{Id: 5, Uuid: "new", Org_id: 2, RoleId: 3}, 0)
+	utils.Ok(t, err)
+	_, err = ac.authenticate(token)
+	utils.Ok(t, err)
+	//other users are not affected
+	token, err = ac.jwt.Sign(&models.UserData{Id: 6, Uuid: "u6"}, 0, 0)
+	utils.Ok(t, err)
+	_, err = ac.authenticate(token)
+	utils.Ok(t, err)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/auth_backend/models"
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	LDAP_TIMEOUT = 10 //seconds
+	LDAP_DN_COLUMN = "ldap_dn"
+)
+
+//users in the group get the role, group is matched with values of group_attr
+type LDAPRoleMap struct {
+	Group string `mapstructure:"group"`
+	Role  int64  `mapstructure:"role"`
+}
+
+//directory of an org, as configured in authenticators
+//user is searched with bind_dn (anonymous if empty), then bound with its own DN & the login password
+type LDAPConfig struct {
+	Name         string        `mapstructure:"name"`
+	Url          string        `mapstructure:"url"` //ldap://host:389 or ldaps://host:636
+	StartTLS     bool          `mapstructure:"start_tls"`
+	SkipVerify   bool          `mapstructure:"skip_verify"` //do not verify server certificate, only for testing
+	BindDN       string        `mapstructure:"bind_dn"`
+	BindPassword string        `mapstructure:"bind_password"`
+	BaseDN       string        `mapstructure:"base_dn"`
+	UserFilter   string        `mapstructure:"user_filter"` //{identifier} is replaced with the escaped login identifier
+	UsernameAttr string        `mapstructure:"username_attr"`
+	EmailAttr    string        `mapstructure:"email_attr"`
+	GroupAttr    string        `mapstructure:"group_attr"`
+	Org          string        `mapstructure:"org"`          //slug of the org, users are provisioned into it
+	DefaultRole  int64         `mapstructure:"default_role"` //for users not in any mapped group, 0 denies them
+	RoleMap      []LDAPRoleMap `mapstructure:"role_map"`     //first matching entry decides the role
+	Timeout      int           `mapstructure:"timeout"`      //seconds
+}
+
+type LDAPAuthenticator struct {
+	cfg LDAPConfig
+	org *models.Org
+	dbh *models.DBRequestHandler
+}
+
+//entry of the user who could bind with the login password
+type ldapUser struct {
+	DN       string
+	Username string
+	Email    string
+	Role     int64
+}
+
+//zero values fallback to defaults
+func (cfg *LDAPConfig) validate() error {
+	if cfg.Url == "" || cfg.BaseDN == "" {
+		return errors.New("ldap url & base_dn are required")
+	}
+	if cfg.Org == "" {
+		return errors.New("ldap org is required")
+	}
+	if cfg.Name == "" {
+		cfg.Name = "ldap"
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = "(uid={identifier})"
+	}
+	if !strings.Contains(cfg.UserFilter, "{identifier}") {
+		return errors.New("ldap user_filter has to contain {identifier}")
+	}
+	if cfg.UsernameAttr == "" {
+		cfg.UsernameAttr = "uid"
+	}
+	if cfg.EmailAttr == "" {
+		cfg.EmailAttr = "mail"
+	}
+	if cfg.GroupAttr == "" {
+		cfg.GroupAttr = "memberOf"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = LDAP_TIMEOUT
+	}
+	return nil
+}
+
+func NewLDAPAuthenticator(cfg LDAPConfig, dbh *models.DBRequestHandler) (*LDAPAuthenticator, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	org, err := dbh.FindOrgBySlug(cfg.Org)
+	if err != nil {
+		return nil, err
+	} else if org == nil {
+		return nil, errors.New("no org with slug " + cfg.Org + " for ldap " + cfg.Name)
+	}
+	return &LDAPAuthenticator{cfg: cfg, org: org, dbh: dbh}, nil
+}
+
+func (l *LDAPAuthenticator) Name() string {
+	return l.cfg.Name
+}
+
+//only for logins into its org, without org only users it has already provisioned are tried
+func (l *LDAPAuthenticator) Authenticate(identifier string, org *models.Org, pass string) (*models.AuthUser, error) {
+	if org != nil && org.ID != l.org.ID {
+		return nil, nil
+	}
+	if org == nil {
+		if au, err := l.dbh.FindAuthUser(identifier, l.org); err != nil {
+			return nil, err
+		} else if au == nil || au.OrgId != l.org.ID || au.LdapDn == "" {
+			return nil, nil
+		}
+	}
+	u, err := l.lookup(identifier, pass)
+	if err != nil || u == nil {
+		return nil, err
+	}
+	if u.Role <= 0 {
+		log.Warnf("%s is not in any group mapped to a role of %s", u.DN, l.cfg.Name)
+		return nil, models.INVALID_CREDENTIALS
+	}
+	return l.dbh.SyncExternalUser(LDAP_DN_COLUMN, u.DN, u.Username, u.Email, l.org.ID, u.Role)
+}
+
+func (l *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(l.cfg.Url)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(l.cfg.Timeout) * time.Second
+	tc := &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: l.cfg.SkipVerify}
+	conn, err := ldap.DialURL(l.cfg.Url, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tc))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if l.cfg.StartTLS {
+		if err = conn.StartTLS(tc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+//nil user if directory does not have exactly one entry for identifier
+func (l *LDAPAuthenticator) lookup(identifier string, pass string) (*ldapUser, error) {
+	//empty password would be an unauthenticated bind, which always succeeds
+	if identifier == "" || pass == "" {
+		return nil, nil
+	}
+	conn, err := l.dial()
+	if err != nil {
+		log.Errorf("Unable to connect to %s : %s", l.cfg.Name, err.Error())
+		return nil, models.SERVER_ERROR
+	}
+	defer conn.Close()
+	if l.cfg.BindDN != "" {
+		if err = conn.Bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+			log.Errorf("Unable to bind to %s for search : %s", l.cfg.Name, err.Error())
+			return nil, models.SERVER_ERROR
+		}
+	}
+	filter := strings.ReplaceAll(l.cfg.UserFilter, "{identifier}", ldap.EscapeFilter(identifier))
+	req := ldap.NewSearchRequest(l.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, l.cfg.Timeout,
+		false, filter, []string{l.cfg.UsernameAttr, l.cfg.EmailAttr, l.cfg.GroupAttr}, nil)
+	res, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		log.Errorf("Multiple entries found in %s for %s", l.cfg.Name, identifier)
+		return nil, nil
+	} else if err != nil {
+		log.Errorf("Search failed in %s : %s", l.cfg.Name, err.Error())
+		return nil, models.SERVER_ERROR
+	}
+	if len(res.Entries) != 1 {
+		log.Debugf("%d entries found in %s for %s", len(res.Entries), l.cfg.Name, identifier)
+		return nil, nil
+	}
+	e := res.Entries[0]
+	if err = conn.Bind(e.DN, pass); ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, models.INVALID_CREDENTIALS
+	} else if err != nil {
+		log.Errorf("Bind failed in %s for %s : %s", l.cfg.Name, e.DN, err.Error())
+		return nil, models.SERVER_ERROR
+	}
+	return &ldapUser{DN: e.DN, Username: e.GetEqualFoldAttributeValue(l.cfg.UsernameAttr),
+		Email: strings.ToLower(e.GetEqualFoldAttributeValue(l.cfg.EmailAttr)),
+		Role: l.role(e.GetEqualFoldAttributeValues(l.cfg.GroupAttr))}, nil
+}
+
+func (l *LDAPAuthenticator) role(groups []string) int64 {
+	for _, m := range l.cfg.RoleMap {
+		for _, g := range groups {
+			if strings.EqualFold(g, m.Group) {
+				return m.Role
+			}
+		}
+	}
+	return l.cfg.DefaultRole
+}
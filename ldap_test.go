@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/auth_backend/models"
+	"github.com/auth_backend/utils"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"net"
+	"strings"
+	"testing"
+)
+
+type testLDAPEntry struct {
+	pass  string
+	attrs map[string][]string
+}
+
+//local directory for tests, supports simple bind & search with a single (attr=value) filter
+type testLDAPServer struct {
+	ln      net.Listener
+	entries map[string]testLDAPEntry
+}
+
+func startTestLDAP(t *testing.T, entries map[string]testLDAPEntry) *testLDAPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.Ok(t, err)
+	s := &testLDAPServer{ln: ln, entries: entries}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *testLDAPServer) url() string {
+	return "ldap://" + s.ln.Addr().String()
+}
+
+func ldapResponse(id int64, tag ber.Tag, code int64) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	r := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	r.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic"))
+	p.AppendChild(r)
+	return p
+}
+
+func (s *testLDAPServer) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			pass := op.Children[2].Data.String()
+			var code int64 = ldap.LDAPResultInvalidCredentials
+			if e, ok := s.entries[dn]; ok && pass != "" && e.pass == pass {
+				code = ldap.LDAPResultSuccess
+			}
+			c.Write(ldapResponse(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			kv := strings.SplitN(strings.Trim(filter, "()"), "=", 2)
+			for dn, e := range s.entries {
+				if len(kv) != 2 || len(e.attrs[kv[0]]) == 0 || e.attrs[kv[0]][0] != kv[1] {
+					continue
+				}
+				r := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Response")
+				r.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+				for name, vals := range e.attrs {
+					a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+					a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Name"))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+					for _, v := range vals {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+					}
+					a.AppendChild(set)
+					attrs.AppendChild(a)
+				}
+				entry.AppendChild(attrs)
+				r.AppendChild(entry)
+				c.Write(r.Bytes())
+			}
+			c.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+func TestLDAPLookup(t *testing.T) {
+	srv := startTestLDAP(t, map[string]testLDAPEntry{
+		"cn=reader,dc=example,dc=org": {pass: "readpass"},
+		"uid=alice,ou=people,dc=example,dc=org": {pass: "alicepass", attrs: map[string][]string{
+			"uid": {"alice"}, "mail": {"Alice@Example.org"},
+			"memberOf": {"cn=staff,ou=groups,dc=example,dc=org", "cn=admins,ou=groups,dc=example,dc=org"}}},
+		"uid=bob,ou=people,dc=example,dc=org": {pass: "bobpass", attrs: map[string][]string{
+			"uid": {"bob"}, "mail": {"bob@example.org"}}},
+	})
+	defer srv.ln.Close()
+
+	cfg := LDAPConfig{Url: srv.url(), BindDN: "cn=reader,dc=example,dc=org", BindPassword: "readpass",
+		BaseDN: "ou=people,dc=example,dc=org", Org: "another_org", DefaultRole: 2,
+		RoleMap: []LDAPRoleMap{{Group: "CN=admins,ou=groups,dc=example,dc=org", Role: 3},
+			{Group: "cn=staff,ou=groups,dc=example,dc=org", Role: 4}}}
+	utils.Ok(t, cfg.validate())
+	l := &LDAPAuthenticator{cfg: cfg}
+
+	u, err := l.lookup("alice", "alicepass")
+	utils.Ok(t, err)
+	utils.Equals(t, &ldapUser{DN: "uid=alice,ou=people,dc=example,dc=org", Username: "alice",
+		Email: "alice@example.org", Role: 3}, u)
+
+	u, err = l.lookup("bob", "bobpass")
+	utils.Ok(t, err)
+	utils.Equals(t, int64(2), u.Role)
+
+	_, err = l.lookup("alice", "wrong")
+	utils.Equals(t, models.INVALID_CREDENTIALS, err)
+
+	//unknown users, empty password & filter injection are not found
+	for _, c := range [][2]string{{"carol", "x"}, {"alice", ""}, {"*", "alicepass"}} {
+		u, err = l.lookup(c[0], c[1])
+		utils.Ok(t, err)
+		utils.Assert(t, u == nil, "%s should not be found", c[0])
+	}
+
+	l.cfg.BindPassword = "wrong"
+	_, err = l.lookup("alice", "alicepass")
+	utils.Equals(t, models.SERVER_ERROR, err)
+
+	bad := LDAPConfig{Url: srv.url(), BaseDN: "dc=example,dc=org", Org: "another_org", UserFilter: "(uid=x)"}
+	utils.Assert(t, bad.validate() != nil, "filter without identifier should fail")
+}
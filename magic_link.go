@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"github.com/auth_backend/models"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_MAGIC_TOKEN = "REDIS_MAGIC_TOKEN:"
+	REDIS_MAGIC_EXPIRY = 15 //minutes
+)
+
+//counts the request and sends the login link in background
+//never tells the caller if user exists, errors are only logged
+func (ac *AuthController) requestMagicLink(email string, ip string) error {
+	//every request is counted, so a mailbox cannot be flooded
+	mk := ac.throttle.magicKey(email)
+	if err := ac.throttle.check(mk, ac.throttle.ipKey(ip)); err != nil {
+		return err
+	}
+	ac.throttle.fail(mk)
+	//user is looked up & mailed in background, so response time does not tell if it exists
+	go ac.sendMagicLink(email)
+	return nil
+}
+
+//sends a login link if the user exists and its org allows it
+func (ac *AuthController) sendMagicLink(email string) {
+	au, err := ac.dbHandler.FindUserByEmail(email)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	if au == nil || !strings.EqualFold(au.Email, email) || au.AccountType == models.ACCOUNT_SERVICE {
+		log.Debugf("magic link requested for unknown user %s", email)
+		return
+	}
+	if err = au.CheckStatus(); err != nil {
+		log.Debugf("magic link requested for user %d : %s", au.GetId(), err.Error())
+		return
+	}
+	if org, err := ac.dbHandler.GetOrg(au.OrgId); err != nil {
+		log.Error(err.Error())
+		return
+	} else if !org.MagicLink {
+		log.Debugf("magic link is not enabled for org %d", org.ID)
+		return
+	}
+	if tok, err := ac.issueToken(REDIS_MAGIC_TOKEN, au.GetId(), REDIS_MAGIC_EXPIRY*time.Minute); err != nil {
+		log.Errorf("Unable to generate magic link for user %d : %s", au.GetId(), err.Error())
+	} else {
+		ac.notify(MSG_MAGIC_LINK, au, tok)
+	}
+}
+
+//exchanges the link token for a session, same as login with password
+func (ac *AuthController) loginMagicLink(token string, client *SessionMeta) (*SessionTokens, *MFAChallenge, error) {
+	var ip string
+	if client != nil {
+		ip = client.Ip
+	}
+	if err := ac.throttle.check(ac.throttle.ipKey(ip)); err != nil {
+		return nil, nil, err
+	}
+	id, err := ac.getToken(REDIS_MAGIC_TOKEN, token)
+	if err == models.INVALID_TOKEN {
+		ac.throttle.fail(ac.throttle.ipKey(ip))
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	} else if err != nil {
+		return nil, nil, err
+	}
+	//only one request can use the token
+	if n, err := ac.store.Del(fmt.Sprintf("%s%s", REDIS_MAGIC_TOKEN, token)); err != nil {
+		return nil, nil, err
+	} else if n == 0 {
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+	ud, err := ac.buildUserData(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	//org may have turned it off after the link was sent
+	if org, err := ac.dbHandler.GetOrg(ud.Org_id); err != nil {
+		return nil, nil, err
+	} else if !org.MagicLink {
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+	if au, err := ac.dbHandler.GetAuthUser(id); err == nil {
+		ac.throttle.reset(ac.throttle.magicKey(au.Email))
+	}
+	return ac.startSession(ud, client)
+}
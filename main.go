@@ -5,7 +5,6 @@ import (
 	"flag"
 	"fmt"
 	"github.com/auth_backend/models"
-	"github.com/go-redis/redis"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
@@ -16,6 +15,7 @@ import (
 	"reflect"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 func isProduction(env string) bool {
@@ -39,6 +39,43 @@ func initLogging(env string, file *os.File) {
 	}
 }
 
+//creates notifier based on config, messages are only logged if none is configured
+func initNotifier() (Notifier, error) {
+	tmpl, err := NewMessageTemplates(viper.GetString("notifier.templates"), viper.GetString("notifier.base_url"))
+	if err != nil {
+		return nil, err
+	}
+	from := viper.GetString("notifier.from")
+	switch viper.GetString("notifier.type") {
+	case "smtp":
+		return NewSMTPNotifier(viper.GetString("notifier.smtp.host"), viper.GetInt("notifier.smtp.port"),
+			viper.GetString("notifier.smtp.user"), viper.GetString("notifier.smtp.pass"), from, tmpl), nil
+	case "outbox":
+		return NewOutboxNotifier(viper.GetString("notifier.outbox"), from, tmpl)
+	case "":
+		return logNotifier{}, nil
+	default:
+		return nil, fmt.Errorf("invalid notifier type %s", viper.GetString("notifier.type"))
+	}
+}
+
+//creates jwt issuer if session mode is jwt, nil otherwise
+func initJWT() (*JWTIssuer, error) {
+	switch viper.GetString("session.mode") {
+	case "", SESSION_MODE_REDIS:
+		return nil, nil
+	case SESSION_MODE_JWT:
+		var keys []JWTKeyConfig
+		if err := viper.UnmarshalKey("jwt.keys", &keys); err != nil {
+			return nil, err
+		}
+		return NewJWTIssuer(viper.GetString("jwt.issuer"), viper.GetString("jwt.active_kid"),
+			viper.GetString("jwt.alg"), REDIS_ACCESS_EXPIRY*time.Minute, keys)
+	default:
+		return nil, fmt.Errorf("invalid session mode %s", viper.GetString("session.mode"))
+	}
+}
+
 func main() {
 	commandParams := flag.String("config", "", "Config file (Json format)")
 	flag.Parse()
@@ -82,18 +119,45 @@ func main() {
 		log.Fatal("Unable to open db connection : please add user:pass, host:port and db params")
 	}
 
+	var hcfg models.HasherConfig
+	if err := viper.UnmarshalKey("password", &hcfg); err != nil {
+		log.Fatal(fmt.Errorf("password config error: %s \n", err))
+	}
+	if h, err := models.NewPasswordHasher(hcfg); err != nil {
+		log.Fatal(fmt.Errorf("password config error: %s \n", err))
+	} else {
+		models.SetPasswordHasher(h)
+	}
+
+	var pcfg models.PasswordPolicyConfig
+	if err := viper.UnmarshalKey("password_policy", &pcfg); err != nil {
+		log.Fatal(fmt.Errorf("password policy config error: %s \n", err))
+	}
+	if p, err := models.NewPasswordPolicy(pcfg); err != nil {
+		log.Fatal(fmt.Errorf("password policy config error: %s \n", err))
+	} else {
+		models.SetPasswordPolicy(p)
+	}
+
 	dbHandler := models.InitDB(db, viper.GetString("org_col"),
 		viper.GetString("owner_col"), viper.GetInt("sudo"), viper.GetInt("sudo_org"));
 
-	//redis
-	redis_client := redis.NewClient(&redis.Options{
-		Addr : viper.GetString("redis.addr"),
-		Password: viper.GetString("redis.password"),
-		DB : viper.GetInt("redis.db"),
-	})
+	//only local passwords are checked unless configured
+	var authCfgs []AuthenticatorConfig
+	if err := viper.UnmarshalKey("authenticators", &authCfgs); err != nil {
+		log.Fatal(fmt.Errorf("authenticators config error: %s \n", err))
+	}
+	if chain, err := NewAuthenticators(authCfgs, dbHandler); err != nil {
+		log.Fatal(fmt.Errorf("authenticators config error: %s \n", err))
+	} else if chain != nil {
+		dbHandler.SetAuthenticators(chain...)
+	}
 
-	if _, err := redis_client.Ping().Result(); err != nil {
-		log.Fatal(fmt.Errorf("redis config error: %s \n", err))
+	//sessions are kept in redis unless another store is configured
+	store, err := initStore(db, viper.GetString("session_store.type"), viper.GetString("redis.addr"),
+		viper.GetString("redis.password"), viper.GetInt("redis.db"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("session store config error: %s \n", err))
 	}
 
 	port := viper.GetInt64("port")
@@ -101,8 +165,41 @@ func main() {
 		port = 3000
 	}
 	router := httprouter.New()
-	ac := &AuthController{dbHandler:dbHandler, redis_client:redis_client};
-	routing(&Server{dbHandler, redis_client, ac}, router, port)
+	notifier, err := initNotifier()
+	if err != nil {
+		log.Fatal(fmt.Errorf("notifier config error: %s \n", err))
+	}
+
+	jwtIssuer, err := initJWT()
+	if err != nil {
+		log.Fatal(fmt.Errorf("jwt config error: %s \n", err))
+	}
+
+	var oauthProviders []OAuthProviderConfig
+	if err := viper.UnmarshalKey("oauth.providers", &oauthProviders); err != nil {
+		log.Fatal(fmt.Errorf("oauth config error: %s \n", err))
+	}
+	oauth, err := NewOAuthProviders(oauthProviders)
+	if err != nil {
+		log.Fatal(fmt.Errorf("oauth config error: %s \n", err))
+	}
+
+	ac := &AuthController{dbHandler:dbHandler, store:store,
+		signupOrg:viper.GetInt64("signup.org"), signupRole:viper.GetInt64("signup.role"),
+		notifier:notifier, jwt:jwtIssuer, totpIssuer:viper.GetString("mfa.issuer"), oauth:oauth,
+		samlBaseUrl:viper.GetString("saml.base_url"),
+		throttle:NewLoginThrottle(store, viper.GetInt64("login_throttle.user_max"),
+			viper.GetInt64("login_throttle.ip_max"),
+			time.Duration(viper.GetInt64("login_throttle.window"))*time.Minute,
+			time.Duration(viper.GetInt64("login_throttle.lockout"))*time.Minute,
+			time.Duration(viper.GetInt64("login_throttle.max_lockout"))*time.Minute)};
+	if ac.totpIssuer == "" {
+		ac.totpIssuer = "auth_backend"
+	}
+	//sessions reload permissions when they change
+	dbHandler.SetPermissionListener(ac)
+	routing(&Server{DBh:dbHandler, Store:store, ac:ac,
+		trustProxy:viper.GetBool("trust_proxy")}, router, port)
 
 	// Respect OS stop signals.
 	c := make(chan os.Signal, 2)
@@ -111,21 +208,72 @@ func main() {
 	// Wait for a termination signal.
 	<-c
 	defer db.Close()
-	defer redis_client.Close()
+	defer store.Close()
 }
 
 type Server struct {
 	DBh *models.DBRequestHandler
-	RedisC *redis.Client
+	Store SessionStore
 	ac *AuthController
+	trustProxy bool //use X-Forwarded-For for client ip
 }
 
 func routing(s *Server, router *httprouter.Router, port int64 ) {
 	router.POST("/api/v1/auth/setpassword", setPassword(s));
-	//TODO
-	//router.POST("/api/v1/auth/signup", setPassword(s));
+	router.POST("/api/v1/auth/forgot", handleForgotPassword(s));
+	if viper.GetBool("signup.enabled") {
+		router.POST("/api/v1/auth/signup", handleSignup(s));
+		router.POST("/api/v1/auth/verify", handleVerify(s));
+	}
+	router.POST("/api/v1/auth/email/confirm", handleConfirmEmail(s));
+	router.POST("/api/v1/auth/invite/accept", handleAcceptInvitation(s));
 	router.POST("/api/v1/auth/login", handleLogin(s));
+	router.POST("/api/v1/auth/login/mfa", handleLoginMFA(s));
+	router.POST("/api/v1/auth/magic_link", handleMagicLink(s));
+	router.POST("/api/v1/auth/magic_link/login", handleMagicLinkLogin(s));
+	router.POST("/api/v1/auth/refresh", handleRefresh(s));
+	if len(s.ac.oauth) > 0 {
+		router.GET("/api/v1/auth/oauth/:provider", handleOAuthLogin(s));
+		router.GET("/api/v1/auth/oauth/:provider/callback", handleOAuthCallback(s));
+	}
+	if s.ac.samlBaseUrl != "" {
+		router.GET("/api/v1/auth/saml/:org/metadata", handleSamlMetadata(s));
+		router.GET("/api/v1/auth/saml/:org/login", handleSamlLogin(s));
+		router.POST("/api/v1/auth/saml/:org/acs", handleSamlACS(s));
+	}
+	if s.ac.jwt != nil {
+		router.GET("/.well-known/jwks.json", handleJWKS(s));
+	}
 	router.POST("/api/v1/auth/logout", BasicAuth(handleLogout, s));
+	router.GET("/api/v1/auth/me", BasicAuth(handleMe, s));
+	router.PATCH("/api/v1/auth/me", BasicAuth(handleUpdateMe, s));
+	router.POST("/api/v1/auth/password", BasicAuth(handleChangePassword, s));
+	router.GET("/api/v1/auth/sessions", BasicAuth(handleListSessions, s));
+	router.DELETE("/api/v1/auth/sessions/:id", BasicAuth(handleRevokeSession, s));
+	router.POST("/api/v1/auth/sessions/revoke_others", BasicAuth(handleRevokeOtherSessions, s));
+	router.DELETE("/api/v1/auth/users/:user_id/sessions", BasicAuth(handleRevokeUserSessions, s));
+	router.POST("/api/v1/auth/users/:user_id/unlock", BasicAuth(handleUnlockUser, s));
+	router.POST("/api/v1/auth/users/:user_id/status", BasicAuth(handleSetUserStatus, s));
+	router.POST("/api/v1/auth/impersonate/:user_id", BasicAuth(handleImpersonate, s));
+	router.POST("/api/v1/auth/service_accounts", BasicAuth(handleCreateServiceAccount, s));
+	router.GET("/api/v1/auth/service_accounts", BasicAuth(handleListServiceAccounts, s));
+	router.POST("/api/v1/auth/service_accounts/:user_id/keys", BasicAuth(handleCreateAPIKey, s));
+	router.GET("/api/v1/auth/service_accounts/:user_id/keys", BasicAuth(handleListAPIKeys, s));
+	router.POST("/api/v1/auth/tokens", BasicAuth(handleCreatePersonalToken, s));
+	router.GET("/api/v1/auth/tokens", BasicAuth(handleListPersonalTokens, s));
+	router.POST("/api/v1/auth/keys/:key_id/rotate", BasicAuth(handleRotateAPIKey, s));
+	router.DELETE("/api/v1/auth/keys/:key_id", BasicAuth(handleRevokeAPIKey, s));
+	router.POST("/api/v1/auth/invitations", BasicAuth(handleCreateInvitation, s));
+	router.GET("/api/v1/auth/invitations", BasicAuth(handleListInvitations, s));
+	router.POST("/api/v1/auth/invitations/:invitation_id/resend", BasicAuth(handleResendInvitation, s));
+	router.DELETE("/api/v1/auth/invitations/:invitation_id", BasicAuth(handleRevokeInvitation, s));
+	router.GET("/api/v1/auth/saml/:org/config", BasicAuth(handleGetSamlConfig, s));
+	router.PUT("/api/v1/auth/saml/:org/config", BasicAuth(handleSaveSamlConfig, s));
+	router.POST("/api/v1/auth/mfa/totp", BasicAuth(handleEnrollTOTP, s));
+	router.POST("/api/v1/auth/mfa/totp/verify", BasicAuth(handleConfirmTOTP, s));
+	router.DELETE("/api/v1/auth/mfa/totp", BasicAuth(handleDisableTOTP, s));
+	router.POST("/api/v1/auth/mfa/recovery_codes", BasicAuth(handleRecoveryCodes, s));
+	router.POST("/api/v1/authz/check", BasicAuth(handleAuthzCheck, s));
 	router.POST("/api/v1/data/:table/add", BasicAuth(handleCreate, s));
 	router.POST("/api/v1/data/:table/update/:id", BasicAuth(handleUpdate, s));
 	router.GET("/api/v1/data/:table/list", BasicAuth(handleRead, s));
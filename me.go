@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/auth_backend/models"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_EMAIL_TOKEN = "REDIS_EMAIL_TOKEN:"
+	REDIS_EMAIL_EXPIRY = 24 //hours
+	SESSION_TYPE_LOGIN = "login"
+	SESSION_TYPE_API_KEY = "api_key"
+	SESSION_TYPE_IMPERSONATION = "impersonation"
+)
+
+//identity & access of the caller, lets clients hide actions which are not allowed
+type Me struct {
+	User        *models.AuthUser              `json:"user"`
+	Org         *models.Org                   `json:"org"`
+	SU          bool                          `json:"su"` //has access to everything, permissions are not checked
+	Session     MeSession                     `json:"session"`
+	Permissions map[string]models.TableAccess `json:"permissions"`
+}
+
+//saved till the new email is confirmed
+type emailChange struct {
+	Id    int64
+	Email string
+}
+
+type MeSession struct {
+	Id             string     `json:"id,omitempty"` //same as id in session list
+	Type           string     `json:"type"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	ImpersonatedBy int64      `json:"impersonated_by,omitempty"`
+	Scoped         bool       `json:"scoped"` //permissions are limited by token scope
+}
+
+func (ac *AuthController) me(ud *models.UserData) (*Me, error) {
+	au, err := ac.dbHandler.GetAuthUser(ud.Id)
+	if err != nil {
+		return nil, err
+	}
+	if role, err := ac.dbHandler.GetUserRole(au.UserRoleId); err == nil {
+		au.UserRole = *role
+	}
+	org, err := ac.dbHandler.GetOrg(au.OrgId)
+	if err != nil {
+		return nil, err
+	}
+	m := &Me{User: au, Org: org, SU: ac.dbHandler.IsSU(ud), Permissions: ud.P.Describe(),
+		Session: MeSession{Id: ud.Family, Type: SESSION_TYPE_LOGIN, ExpiresAt: ud.Expires,
+			ImpersonatedBy: ud.ActorId, Scoped: ud.Scope != nil}}
+	if strings.HasPrefix(ud.Uuid, API_KEY_PREFIX) {
+		m.Session.Type = SESSION_TYPE_API_KEY
+	} else if ud.ActorId != 0 {
+		m.Session.Type = SESSION_TYPE_IMPERSONATION
+	}
+	if m.Session.ExpiresAt == nil && m.Session.Type != SESSION_TYPE_API_KEY && ac.jwt == nil {
+		k := fmt.Sprintf("%s%s", REDIS_USER_UUID_KEY, ud.Uuid)
+		if ttl, err := ac.store.TTL(k); err == nil && ttl > 0 {
+			t := time.Now().Add(ttl).Truncate(time.Second)
+			m.Session.ExpiresAt = &t
+		}
+	}
+	return m, nil
+}
+
+//account can be changed only from a login of the user itself, not with api keys, scoped tokens or impersonation
+func accountSession(ud *models.UserData) bool {
+	return !strings.HasPrefix(ud.Uuid, API_KEY_PREFIX) && ud.Scope == nil && ud.ActorId == 0
+}
+
+//password of the caller is checked again before sensitive changes
+//wrong ones count against the ip & the account, same as failed logins
+func (ac *AuthController) reauthenticate(ud *models.UserData, pass string, ip string) error {
+	if !accountSession(ud) {
+		return models.UNAUTHORIZED
+	}
+	keys := []throttleKey{ac.throttle.userKey(ud.Id), ac.throttle.ipKey(ip)}
+	if err := ac.throttle.check(keys...); err != nil {
+		return err
+	}
+	if _, err := ac.dbHandler.CheckPassword(ud.Id, pass); err != nil {
+		if err == models.INVALID_CREDENTIALS {
+			ac.throttle.fail(keys...)
+		}
+		return err
+	}
+	return nil
+}
+
+//changes SELF_UPDATE_FIELDS of the caller, a new email is only sent a token to verify it
+//returns true if verification was sent
+func (ac *AuthController) updateMe(ud *models.UserData, data []byte, ip string) (*models.AuthUser, bool, error) {
+	var kvp map[string]interface{}
+	if err := json.Unmarshal(data, &kvp); err != nil {
+		return nil, false, err
+	}
+	pass, _ := kvp["current_password"].(string)
+	delete(kvp, "current_password")
+	if err := ac.reauthenticate(ud, pass, ip); err != nil {
+		return nil, false, err
+	}
+	email, hasEmail := kvp["email"]
+	delete(kvp, "email")
+	e, _ := email.(string)
+	if hasEmail {
+		if err := ac.dbHandler.CheckNewEmail(ud.Id, e); err != nil {
+			return nil, false, err
+		}
+	}
+	var au *models.AuthUser
+	var err error
+	if len(kvp) == 0 {
+		au, err = ac.dbHandler.GetAuthUser(ud.Id)
+	} else if rest, merr := json.Marshal(kvp); merr != nil {
+		return nil, false, merr
+	} else {
+		au, err = ac.dbHandler.UpdateSelf(ud.Id, rest)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if hasEmail {
+		if err = ac.requestEmailChange(au, e); err != nil {
+			return nil, false, err
+		}
+	}
+	return au, hasEmail, nil
+}
+
+//token to confirm the new email is sent to it, email of the user is changed only on confirmation
+//new email must have been checked with CheckNewEmail
+func (ac *AuthController) requestEmailChange(au *models.AuthUser, email string) error {
+	tok, err := newUUID()
+	if err != nil {
+		return err
+	}
+	ejson, err := json.Marshal(&emailChange{Id: au.GetId(), Email: email})
+	if err != nil {
+		return err
+	}
+	if err = ac.store.Set(fmt.Sprintf("%s%s", REDIS_EMAIL_TOKEN, tok), ejson, REDIS_EMAIL_EXPIRY*time.Hour); err != nil {
+		return err
+	}
+	if ac.notifier != nil {
+		msg := &Message{Type: MSG_EMAIL_CHANGE, To: email, Username: au.Username, Token: tok}
+		if err = ac.notifier.Notify(msg); err != nil {
+			log.Errorf("Unable to send %s to user %d : %s", MSG_EMAIL_CHANGE, au.GetId(), err.Error())
+		}
+	}
+	return nil
+}
+
+//applies the email change with the token sent to the new email
+func (ac *AuthController) confirmEmail(token string, ip string) error {
+	if err := ac.throttle.check(ac.throttle.ipKey(ip)); err != nil {
+		return err
+	}
+	k := fmt.Sprintf("%s%s", REDIS_EMAIL_TOKEN, token)
+	str, err := ac.store.Get(k)
+	if err == KEY_NOT_FOUND {
+		ac.throttle.fail(ac.throttle.ipKey(ip))
+		return models.INVALID_TOKEN
+	} else if err != nil {
+		return err
+	}
+	//token can be used only once
+	if n, err := ac.store.Del(k); err != nil {
+		return err
+	} else if n == 0 {
+		return models.INVALID_TOKEN
+	}
+	ec := &emailChange{}
+	if err = json.Unmarshal([]byte(str), ec); err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]string{"email": ec.Email})
+	if err != nil {
+		return err
+	}
+	if _, err = ac.dbHandler.UpdateSelf(ec.Id, data); err != nil {
+		return err
+	}
+	log.Infof("Email of user %d changed", ec.Id)
+	return nil
+}
+
+//other sessions are logged out, as the old password might be compromised
+//wrong current passwords count against the account too, a stolen session can be used from many ips
+func (ac *AuthController) changePassword(ud *models.UserData, current string, pass string, ip string) error {
+	if !accountSession(ud) {
+		return models.UNAUTHORIZED
+	}
+	keys := []throttleKey{ac.throttle.userKey(ud.Id), ac.throttle.ipKey(ip)}
+	if err := ac.throttle.check(keys...); err != nil {
+		return err
+	}
+	if err := ac.dbHandler.ChangePassword(ud.Id, current, pass); err != nil {
+		if err == models.INVALID_CREDENTIALS {
+			ac.throttle.fail(keys...)
+		}
+		return err
+	}
+	if err := ac.revokeOtherSessions(ud); err != nil {
+		log.Error(err)
+	}
+	log.Infof("Password of user %d changed", ud.Id)
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/auth_backend/utils"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	REDIS_MFA_CHALLENGE = "MFA_CHALLENGE:"
+	REDIS_MFA_ATTEMPTS = "MFA_ATTEMPTS:"
+	REDIS_MFA_EXPIRY = 5 //minutes
+	REDIS_TOTP_PENDING = "TOTP_PENDING:"
+	REDIS_TOTP_PENDING_EXPIRY = 15 //minutes
+	REDIS_TOTP_USED = "TOTP_USED:"
+	MFA_MAX_ATTEMPTS = 5
+	TOTP_SKEW = 1 //steps accepted on either side for clock drift
+	RECOVERY_CODE_COUNT = 10
+)
+
+//returned by login instead of tokens when user has a second factor
+type MFAChallenge struct {
+	MfaRequired bool   `json:"mfa_required"`
+	MfaToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"` //seconds
+}
+
+//state kept till the second factor is verified
+type mfaPending struct {
+	Ud   *models.UserData
+	Meta SessionMeta
+}
+
+//details needed to add the secret to an authenticator app
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+//creates challenge for a user who passed the first factor
+func (ac *AuthController) mfaChallenge(ud *models.UserData, client *SessionMeta) (*MFAChallenge, error) {
+	tok, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	p := &mfaPending{Ud: ud}
+	if client != nil {
+		p.Meta = *client
+	}
+	pjson, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	k := fmt.Sprintf("%s%s", REDIS_MFA_CHALLENGE, tok)
+	if err = ac.store.Set(k, pjson, REDIS_MFA_EXPIRY*time.Minute); err != nil {
+		return nil, err
+	}
+	return &MFAChallenge{MfaRequired: true, MfaToken: tok, ExpiresIn: REDIS_MFA_EXPIRY * 60}, nil
+}
+
+//completes login started with password, challenge is dropped after too many wrong codes
+func (ac *AuthController) loginMFA(token string, code string, recovery string, ip string) (*SessionTokens, error) {
+	k := fmt.Sprintf("%s%s", REDIS_MFA_CHALLENGE, token)
+	str, err := ac.store.Get(k)
+	if err == KEY_NOT_FOUND {
+		return nil, models.USER_NOT_AUTHENTICATED
+	} else if err != nil {
+		return nil, err
+	}
+	p := &mfaPending{}
+	if err = json.Unmarshal([]byte(str), p); err != nil {
+		return nil, err
+	}
+	keys := []throttleKey{ac.throttle.mfaKey(p.Ud.Id), ac.throttle.ipKey(ip)}
+	if err = ac.throttle.check(keys...); err != nil {
+		return nil, err
+	}
+	if ok, err := ac.checkSecondFactor(p.Ud.Id, code, recovery); err != nil {
+		return nil, err
+	} else if !ok {
+		ac.throttle.fail(keys...)
+		ak := fmt.Sprintf("%s%s", REDIS_MFA_ATTEMPTS, token)
+		if n, err := ac.store.Incr(ak); err != nil {
+			return nil, err
+		} else if n >= MFA_MAX_ATTEMPTS {
+			log.Warnf("Too many invalid codes for user %d, dropping login", p.Ud.Id)
+			ac.store.Del(k, ak)
+		} else {
+			ac.store.Expire(ak, REDIS_MFA_EXPIRY*time.Minute)
+		}
+		return nil, models.INVALID_MFA_CODE
+	}
+	//only one request can complete the challenge
+	if n, err := ac.store.Del(k); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	ac.store.Del(fmt.Sprintf("%s%s", REDIS_MFA_ATTEMPTS, token))
+	ac.throttle.reset(ac.throttle.mfaKey(p.Ud.Id))
+	return ac.createSession(p.Ud, &p.Meta)
+}
+
+//verifies totp code, or recovery code if given, a code can be used only once
+func (ac *AuthController) checkSecondFactor(id int64, code string, recovery string) (bool, error) {
+	if recovery != "" {
+		return ac.dbHandler.UseRecoveryCode(id, recovery)
+	}
+	secret, err := ac.dbHandler.GetTOTPSecret(id)
+	if err != nil {
+		return false, err
+	} else if secret == "" {
+		return false, models.MFA_NOT_ENABLED
+	}
+	return ac.useTOTPCode(id, secret, code)
+}
+
+//second factor of a logged in user, wrong codes count towards the same lockout as login
+func (ac *AuthController) verifySecondFactor(id int64, code string, recovery string) error {
+	key := ac.throttle.mfaKey(id)
+	if err := ac.throttle.check(key); err != nil {
+		return err
+	}
+	if ok, err := ac.checkSecondFactor(id, code, recovery); err != nil {
+		return err
+	} else if !ok {
+		ac.throttle.fail(key)
+		return models.INVALID_MFA_CODE
+	}
+	ac.throttle.reset(key)
+	return nil
+}
+
+func (ac *AuthController) useTOTPCode(id int64, secret string, code string) (bool, error) {
+	step, ok := utils.ValidateTOTP(secret, code, time.Now(), TOTP_SKEW)
+	if !ok {
+		return false, nil
+	}
+	//remember the step till it can no longer be accepted
+	k := fmt.Sprintf("%s%d:%d", REDIS_TOTP_USED, id, step)
+	return ac.store.SetNX(k, 1, (2*TOTP_SKEW+1)*utils.TOTP_PERIOD*time.Second)
+}
+
+//new secret for the user, second factor is enabled only after a code is verified
+//only the user itself can enroll, after giving its password again
+func (ac *AuthController) enrollTOTP(ud *models.UserData, pass string, ip string) (*TOTPEnrollment, error) {
+	if err := ac.reauthenticate(ud, pass, ip); err != nil {
+		return nil, err
+	}
+	if secret, err := ac.dbHandler.GetTOTPSecret(ud.Id); err != nil {
+		return nil, err
+	} else if secret != "" {
+		return nil, models.MFA_ALREADY_ENABLED
+	}
+	au, err := ac.dbHandler.GetAuthUser(ud.Id)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	k := fmt.Sprintf("%s%d", REDIS_TOTP_PENDING, ud.Id)
+	if err = ac.store.Set(k, secret, REDIS_TOTP_PENDING_EXPIRY*time.Minute); err != nil {
+		return nil, err
+	}
+	account := au.Username
+	if account == "" {
+		account = au.Email
+	}
+	return &TOTPEnrollment{Secret: secret, Uri: utils.TOTPProvisioningURI(ac.totpIssuer, account, secret)}, nil
+}
+
+//enables second factor once the first code is verified, returns recovery codes
+func (ac *AuthController) confirmTOTP(ud *models.UserData, code string, pass string, ip string) ([]string, error) {
+	if err := ac.reauthenticate(ud, pass, ip); err != nil {
+		return nil, err
+	}
+	k := fmt.Sprintf("%s%d", REDIS_TOTP_PENDING, ud.Id)
+	secret, err := ac.store.Get(k)
+	if err == KEY_NOT_FOUND {
+		return nil, models.MFA_NOT_ENABLED
+	} else if err != nil {
+		return nil, err
+	}
+	if ok, err := ac.useTOTPCode(ud.Id, secret, code); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, models.INVALID_MFA_CODE
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err = ac.dbHandler.EnableTOTP(ud.Id, secret, codes); err != nil {
+		log.Error(err)
+		return nil, models.SERVER_ERROR
+	}
+	ac.store.Del(k)
+	log.Infof("Two factor authentication enabled for user %d", ud.Id)
+	return codes, nil
+}
+
+//removes second factor, needs a valid code so a stolen session cannot do this
+func (ac *AuthController) disableTOTP(ud *models.UserData, code string, recovery string) error {
+	if err := ac.verifySecondFactor(ud.Id, code, recovery); err != nil {
+		return err
+	}
+	if err := ac.dbHandler.DisableTOTP(ud.Id); err != nil {
+		log.Error(err)
+		return models.SERVER_ERROR
+	}
+	log.Infof("Two factor authentication disabled for user %d", ud.Id)
+	return nil
+}
+
+//replaces recovery codes of the user
+func (ac *AuthController) regenerateRecoveryCodes(ud *models.UserData, code string) ([]string, error) {
+	if err := ac.verifySecondFactor(ud.Id, code, ""); err != nil {
+		return nil, err
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err = ac.dbHandler.SetRecoveryCodes(ud.Id, codes); err != nil {
+		log.Error(err)
+		return nil, models.SERVER_ERROR
+	}
+	return codes, nil
+}
+
+//codes are shown only once, only their hash is stored
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	b := make([]byte, 5)
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c := base32.StdEncoding.EncodeToString(b)
+		codes[i] = c[:4] + "-" + c[4:]
+	}
+	return codes, nil
+}
@@ -18,4 +18,15 @@ const (
 	USER_ALREADY_EXISTS = ServerError("User with given username/email already exists")
 	DUPLICATE_ENTRY = ServerError("Duplicate entry")
 	INVALID_ENTRY = ServerError("Invalid entry")
+	REFRESH_TOKEN_REUSED = ServerError("Refresh token already used, session revoked")
+	INVALID_MFA_CODE = ServerError("Invalid verification code")
+	MFA_ALREADY_ENABLED = ServerError("Two factor authentication is already enabled")
+	MFA_NOT_ENABLED = ServerError("Two factor authentication is not enabled")
+	EXTERNAL_USER_NOT_FOUND = ServerError("No account is linked with this login")
+	ACCOUNT_LOCKED = ServerError("Too many failed attempts, try again later")
+	INVALID_TOKEN = ServerError("invalid token")
+	ACCOUNT_NOT_VERIFIED = ServerError("Account is not verified yet")
+	INVALID_STATUS_TRANSITION = ServerError("Invalid status change")
+	PASSWORD_EXPIRED = ServerError("Password has expired and has to be changed")
+	PASSWORD_LOGIN_DISABLED = ServerError("Password login is disabled for this org")
 )
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+//states of an account, only active accounts can login
+const (
+	STATUS_PENDING = "pending" //waiting for email verification or first password
+	STATUS_ACTIVE = "active"
+	STATUS_SUSPENDED = "suspended"
+	STATUS_LOCKED = "locked"
+	STATUS_DELETED = "deleted"
+)
+
+//allowed changes of state, deleted is final
+var statusTransitions = map[string][]string{
+	STATUS_PENDING:   {STATUS_ACTIVE, STATUS_SUSPENDED, STATUS_DELETED},
+	STATUS_ACTIVE:    {STATUS_SUSPENDED, STATUS_LOCKED, STATUS_DELETED},
+	STATUS_SUSPENDED: {STATUS_ACTIVE, STATUS_DELETED},
+	STATUS_LOCKED:    {STATUS_ACTIVE, STATUS_DELETED},
+}
+
+func ValidStatusTransition(from string, to string) bool {
+	for _, s := range statusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+//error to be returned when user with given status tries to login
+func StatusError(status string) error {
+	switch status {
+	case STATUS_ACTIVE:
+		return nil
+	case STATUS_PENDING:
+		return ACCOUNT_NOT_VERIFIED
+	default:
+		return INACTIVE_USER
+	}
+}
+
+func (au *AuthUser) CheckStatus() error {
+	return StatusError(au.Status)
+}
+
+//changes status of the user, SU can change any user
+//others need update access to status of users in their own org, nobody can change its own status
+func (rm *DBRequestHandler) SetStatus(id int64, status string, ud *UserData) (*AuthUser, error) {
+	if ud == nil {
+		return nil, UNAUTHORIZED
+	}
+	au, err := rm.GetAuthUser(id)
+	if err != nil {
+		return nil, INVALID_ENTRY
+	}
+	if !rm.isSU(ud) && (ud.Id == id || !rm.canManage(ud, au, map[string]interface{}{"status": status})) {
+		return nil, UNAUTHORIZED
+	}
+	if !ValidStatusTransition(au.Status, status) {
+		return nil, errors.New(fmt.Sprintf("%s : %s to %s", INVALID_STATUS_TRANSITION, au.Status, status))
+	}
+	if err = rm.updateStatus(id, au.Status, status); err != nil {
+		return nil, err
+	}
+	log.Infof("Status of user %d changed from %s to %s by %d", id, au.Status, status, ud.Id)
+	au.Status = status
+	return au, nil
+}
+
+//activates user if it is still pending, returns true if it was activated
+func (rm *DBRequestHandler) ActivatePending(id int64) (bool, error) {
+	s, err := rm.db.Exec("update "+rm.auth_table+" set status=? where id=? and status=?",
+		STATUS_ACTIVE, id, STATUS_PENDING)
+	if err != nil {
+		return false, err
+	}
+	upd, err := s.RowsAffected()
+	return upd == 1, err
+}
+
+//changes status only if it is still the one which was checked
+func (rm *DBRequestHandler) updateStatus(id int64, from string, to string) error {
+	s, err := rm.db.Exec("update "+rm.auth_table+" set status=? where id=? and status=?", to, id, from)
+	if err != nil {
+		return err
+	}
+	if upd, err := s.RowsAffected(); err != nil {
+		return err
+	} else if upd == 0 {
+		return errors.New("status was changed by another request, try again")
+	}
+	return nil
+}
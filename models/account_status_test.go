@@ -0,0 +1,36 @@
+package models
+
+import (
+	"github.com/auth_backend/utils"
+	"testing"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	test_table := map[string]struct {
+		from, to string
+		valid    bool
+	}{
+		"verify":          {STATUS_PENDING, STATUS_ACTIVE, true},
+		"suspend":         {STATUS_ACTIVE, STATUS_SUSPENDED, true},
+		"lock":            {STATUS_ACTIVE, STATUS_LOCKED, true},
+		"unlock":          {STATUS_LOCKED, STATUS_ACTIVE, true},
+		"reinstate":       {STATUS_SUSPENDED, STATUS_ACTIVE, true},
+		"delete":          {STATUS_SUSPENDED, STATUS_DELETED, true},
+		"lock_pending":    {STATUS_PENDING, STATUS_LOCKED, false},
+		"same":            {STATUS_ACTIVE, STATUS_ACTIVE, false},
+		"undelete":        {STATUS_DELETED, STATUS_ACTIVE, false},
+		"back_to_pending": {STATUS_ACTIVE, STATUS_PENDING, false},
+		"unknown":         {STATUS_ACTIVE, "archived", false},
+	}
+	for name, tc := range test_table {
+		utils.Assert(t, ValidStatusTransition(tc.from, tc.to) == tc.valid, "%s: %s -> %s", name, tc.from, tc.to)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	utils.Ok(t, StatusError(STATUS_ACTIVE))
+	utils.Equals(t, ACCOUNT_NOT_VERIFIED, StatusError(STATUS_PENDING))
+	for _, s := range []string{STATUS_SUSPENDED, STATUS_LOCKED, STATUS_DELETED, ""} {
+		utils.Equals(t, INACTIVE_USER, StatusError(s))
+	}
+}
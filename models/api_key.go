@@ -0,0 +1,346 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/auth_backend/utils"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	API_KEY_TABLE = "api_key"
+	ACCOUNT_USER = "user"
+	ACCOUNT_SERVICE = "service"
+)
+
+//key secret is never stored, only its hash
+//keys are not exposed through data api
+type APIKey struct {
+	Id         int64      `json:"api_key_id"`
+	AuthUserId int64      `json:"auth_user_id"`
+	OrgId      int64      `json:"org_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` //public part of the key, used for lookup
+	Hash       string     `json:"-"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	Scope      []ScopeEntry `json:"scope,omitempty"` //empty for keys having all rights of the user
+	DateAdd    time.Time  `json:"date_add"`
+}
+
+//one access given to a scoped token, same as a row of user_permission
+//empty column gives access to all rows
+type ScopeEntry struct {
+	TableName  string `json:"table_name"`
+	ColumnName string `json:"column_name"`
+	Value      string `json:"value"`
+	Permission string `json:"permission"`
+}
+
+func (se ScopeEntry) getTableName() string {
+	return se.TableName
+}
+
+func (se ScopeEntry) getColumnName() string {
+	return se.ColumnName
+}
+
+func (se ScopeEntry) getPermission() string {
+	return se.Permission
+}
+
+func (se ScopeEntry) getValue() string {
+	return se.Value
+}
+
+func (se ScopeEntry) GetId() int64 {
+	return 0
+}
+
+//secrets are random, a fast hash is enough
+func HashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//usable if not revoked and not expired
+func (k *APIKey) Valid(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+const apiKeyColumns = "id, auth_user_id, org_id, name, prefix, key_hash, expires_at, last_used_at, revoked_at, scope, date_add"
+
+func scanAPIKeys(rows *sql.Rows) ([]*APIKey, error) {
+	defer rows.Close()
+	ret := make([]*APIKey, 0)
+	for rows.Next() {
+		k := &APIKey{}
+		var exp, used, rev sql.NullTime
+		var scope sql.NullString
+		if err := rows.Scan(&k.Id, &k.AuthUserId, &k.OrgId, &k.Name, &k.Prefix, &k.Hash,
+			&exp, &used, &rev, &scope, &k.DateAdd); err != nil {
+			return nil, err
+		}
+		if scope.Valid && scope.String != "" {
+			if err := json.Unmarshal([]byte(scope.String), &k.Scope); err != nil {
+				return nil, err
+			}
+		}
+		if exp.Valid {
+			k.ExpiresAt = &exp.Time
+		}
+		if used.Valid {
+			k.LastUsedAt = &used.Time
+		}
+		if rev.Valid {
+			k.RevokedAt = &rev.Time
+		}
+		ret = append(ret, k)
+	}
+	return ret, rows.Err()
+}
+
+//true if ud can manage the user, SU can manage everyone
+//others need update access to users with the role of au, in their own org
+func (rm *DBRequestHandler) canManage(ud *UserData, au *AuthUser, kvp map[string]interface{}) bool {
+	if ud == nil {
+		return false
+	}
+	if rm.isSU(ud) {
+		return true
+	}
+	if au.ID == rm.su.Id || au.OrgId != ud.Org_id {
+		return false
+	}
+	if kvp == nil {
+		kvp = map[string]interface{}{"user_role_id": au.UserRoleId}
+	}
+	if err := ud.P.HasUpdateAccess(rm.auth_table, kvp, rm.queryBuilders[rm.auth_table].GetFieldInfo()); err != nil {
+		log.Debugf("User %d cannot manage %d : %s", ud.Id, au.ID, err.Error())
+		return false
+	}
+	return true
+}
+
+//creates an active service account in the org of creator (or given org for SU)
+//service accounts have no password, they authenticate with api keys only
+func (rm *DBRequestHandler) CreateServiceAccount(data []byte, ud *UserData) (*AuthUser, error) {
+	var vmap map[string]interface{}
+	if err := json.Unmarshal(data, &vmap); err != nil {
+		return nil, err
+	}
+	if vmap == nil {
+		return nil, FORM_ERROR
+	}
+	delete(vmap, "password")
+	udata, err := json.Marshal(vmap)
+	if err != nil {
+		return nil, err
+	}
+	//same access checks as creating any other user
+	bm, err := rm.SaveObj(udata, rm.auth_table, ud)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = rm.db.Exec("update "+rm.auth_table+" set account_type=?, status=? where id=?",
+		ACCOUNT_SERVICE, STATUS_ACTIVE, bm.GetId()); err != nil {
+		return nil, err
+	}
+	return rm.GetAuthUser(bm.GetId())
+}
+
+//service accounts of the org visible to ud
+func (rm *DBRequestHandler) ListServiceAccounts(ud *UserData) (*[]TableRow, error) {
+	m, err := rm.ReadObjOps(rm.auth_table,
+		[]Operation{{Name:"account_type", Value:ACCOUNT_SERVICE, Op:"=", NextOp:"noop"}},
+		0, MAX_READ_LIMIT, true, "", ud)
+	if err != nil {
+		return nil, err
+	}
+	return rm.queryBuilders[rm.auth_table].ConvertToJsonNames(m), nil
+}
+
+//service account with given id which ud can manage
+func (rm *DBRequestHandler) GetManagedServiceAccount(id int64, ud *UserData) (*AuthUser, error) {
+	au, err := rm.GetAuthUser(id)
+	if err != nil || au.AccountType != ACCOUNT_SERVICE {
+		return nil, INVALID_ENTRY
+	}
+	if !rm.canManage(ud, au, nil) {
+		return nil, UNAUTHORIZED
+	}
+	return au, nil
+}
+
+func (rm *DBRequestHandler) CreateAPIKey(au *AuthUser, name string, prefix string, secret string,
+	expires *time.Time, scope []ScopeEntry) (*APIKey, error) {
+	k := &APIKey{AuthUserId: au.ID, OrgId: au.OrgId, Name: name, Prefix: prefix,
+		Hash: HashAPIKeySecret(secret), ExpiresAt: expires, Scope: scope, DateAdd: time.Now()}
+	var sjson interface{}
+	if len(scope) > 0 {
+		b, err := json.Marshal(scope)
+		if err != nil {
+			return nil, err
+		}
+		sjson = string(b)
+	}
+	s, err := rm.db.Exec("insert into "+API_KEY_TABLE+"(auth_user_id, org_id, name, prefix, key_hash, expires_at, scope) "+
+		"values(?,?,?,?,?,?,?)", k.AuthUserId, k.OrgId, k.Name, k.Prefix, k.Hash, expires, sjson)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if k.Id, err = s.LastInsertId(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+//builds permissions of a token scope, validated like user permissions
+//access based on org & owner columns is not allowed, those are appended automatically
+func (rm *DBRequestHandler) scopePermissions(scope []ScopeEntry, ud *UserData) (*Permissions, error) {
+	if len(scope) == 0 {
+		return nil, errors.New("{\"scope\":\"required\"}")
+	}
+	ps := &Permissions{make(map[string]*TablePermission)}
+	for _, se := range scope {
+		if !checkPermissionValue(se.Permission) {
+			return nil, errors.New(fmt.Sprintf("Invalid permission type %s", se.Permission))
+		}
+		qb, ok := rm.queryBuilders[se.TableName]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Table %s not registered", se.TableName))
+		}
+		if !rm.isSU(ud) && (se.TableName == rm.role_table || se.TableName == rm.auth_role_permission_table ||
+			se.TableName == rm.org_table) {
+			return nil, errors.New("given table cannot be accessed")
+		}
+		if se.ColumnName != "" {
+			if se.ColumnName == rm.orgcol || se.ColumnName == rm.ownercol {
+				return nil, errors.New("can not add org or owner column condition on table")
+			}
+			found := false
+			for _, fi := range qb.GetFieldInfo() {
+				if fi.DBN == se.ColumnName {
+					found = true
+					if se.Value == "" {
+						return nil, errors.New(fmt.Sprintf("%s col has empty value", fi.DBN))
+					}
+					if _, err := utils.ConvertFromString([]byte(se.Value), fi.Type, DB_TIME_FORMAT); err != nil {
+						return nil, errors.New(fmt.Sprintf("%s col has invalid value : %s", fi.DBN, se.Value))
+					}
+					break
+				}
+			}
+			if !found {
+				return nil, errors.New(fmt.Sprintf("col has invalid column name : %s", se.ColumnName))
+			}
+		}
+		//type & value are validated above, only duplicates can fail
+		ps.addPermission(se.TableName, se.Permission, se.ColumnName, se.Value)
+	}
+	return ps, nil
+}
+
+//token with a subset of the rights of ud, I can only give access of what I have access to
+//scoped tokens & impersonation sessions cannot create other tokens
+func (rm *DBRequestHandler) CreatePersonalToken(ud *UserData, name string, prefix string, secret string,
+	expires *time.Time, scope []ScopeEntry) (*APIKey, error) {
+	if ud == nil || ud.Scope != nil || ud.ActorId != 0 {
+		return nil, UNAUTHORIZED
+	}
+	au, err := rm.GetAuthUser(ud.Id)
+	if err != nil {
+		return nil, err
+	}
+	if au.AccountType == ACCOUNT_SERVICE {
+		return nil, UNAUTHORIZED
+	}
+	sp, err := rm.scopePermissions(scope, ud)
+	if err != nil {
+		return nil, err
+	}
+	if !rm.isSU(ud) {
+		if err = ud.P.Covers(sp); err != nil {
+			log.Debugf("User %d cannot create token : %s", ud.Id, err.Error())
+			return nil, err
+		}
+	}
+	return rm.CreateAPIKey(au, name, prefix, secret, expires, scope)
+}
+
+//limits ud to the token scope, rights of the user which were removed after token creation stay removed
+func (rm *DBRequestHandler) ApplyScope(ud *UserData, scope []ScopeEntry) error {
+	sp, err := rm.scopePermissions(scope, ud)
+	if err != nil {
+		return err
+	}
+	if rm.isSU(ud) {
+		ud.P = sp
+	} else {
+		ud.P = ud.P.Intersect(sp)
+	}
+	ud.Scope = sp
+	return nil
+}
+
+//nil if no key has the prefix
+func (rm *DBRequestHandler) FindAPIKey(prefix string) (*APIKey, error) {
+	rows, err := rm.db.Query("select "+apiKeyColumns+" from "+API_KEY_TABLE+" where prefix=?", prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := scanAPIKeys(rows)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+func (rm *DBRequestHandler) GetAPIKey(id int64) (*APIKey, error) {
+	rows, err := rm.db.Query("select "+apiKeyColumns+" from "+API_KEY_TABLE+" where id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := scanAPIKeys(rows)
+	if err != nil {
+		return nil, err
+	} else if len(keys) == 0 {
+		return nil, INVALID_ENTRY
+	}
+	return keys[0], nil
+}
+
+//all keys of the user, including revoked ones
+func (rm *DBRequestHandler) ListAPIKeys(userId int64) ([]*APIKey, error) {
+	rows, err := rm.db.Query("select "+apiKeyColumns+" from "+API_KEY_TABLE+
+		" where auth_user_id=? order by id desc", userId)
+	if err != nil {
+		return nil, err
+	}
+	return scanAPIKeys(rows)
+}
+
+func (rm *DBRequestHandler) RevokeAPIKey(id int64) error {
+	s, err := rm.db.Exec("update "+API_KEY_TABLE+" set revoked_at=now() where id=? and revoked_at is null", id)
+	if err != nil {
+		return err
+	}
+	if upd, err := s.RowsAffected(); err != nil {
+		return err
+	} else if upd == 0 {
+		return errors.New("key is already revoked")
+	}
+	return nil
+}
+
+func (rm *DBRequestHandler) TouchAPIKey(id int64) error {
+	_, err := rm.db.Exec("update "+API_KEY_TABLE+" set last_used_at=now() where id=?", id)
+	return err
+}
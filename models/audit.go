@@ -0,0 +1,22 @@
+package models
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+//audit trail is append only and never exposed through data api
+const (
+	AUDIT_TABLE = "audit_log"
+	AUDIT_IMPERSONATE = "impersonate"
+	AUDIT_IMPERSONATED_REQUEST = "impersonated_request"
+)
+
+//records action done by actor on behalf of user, actor is same as user when acting for itself
+func (rm *DBRequestHandler) AddAudit(actor int64, user int64, action string, detail string, ip string) error {
+	if _, err := rm.db.Exec("insert into "+AUDIT_TABLE+"(actor_id, auth_user_id, action, detail, ip) values(?,?,?,?,?)",
+		actor, user, action, detail, ip); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	return nil
+}
@@ -4,21 +4,24 @@ import (
 	"database/sql"
 	"errors"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 	"time"
 )
 
 //ID should always be the first element, should be ro
 type AuthUser struct {
 	ID         int64     `json:"auth_user_id" v:"ro"`
-	Username   string    `json:"username" validate:"min=3,max=12" v:"uq"`
+	Username   string    `json:"username" validate:"min=3,max=12" v:"uq_org"`
 	Email      string    `json:"email" validate:"email" v:"uq"`
 	Password   string    `json:"_" v:"password,noread"`
 	UserRoleId int64     `json:"user_role_id" validate:"required"`
-	IsActive   int8	     `json:"is_active"`
+	Status     string    `json:"status" v:"ro"`
+	AccountType string   `json:"account_type" v:"ro"`
 	OrgId      int64	 `json:"_" v:"ro"`
 	FacebookId string	 `json:"_"`
 	GoogleId   string	 `json:"_"`
+	LdapDn     string	 `json:"_"`
+	SamlId     string	 `json:"_"`
+	PasswordChangedAt time.Time `json:"password_changed_at" v:"ro"`
 	DateAdd    time.Time `json:"date_add" v:"ro"`
 	DateUpd    time.Time `json:"date_upd" v:"ro"`
 	UserRole   UserRole  `json:"user_role" v:"ref" validate:"structonly"`
@@ -58,7 +61,7 @@ func (au *AuthUser) maskWrite() (map[string]interface{}, error) {
 		return nil, errors.New("Invalid username/FB Id/Google Id")
 	}
 	if au.Password != "" {
-		hash, err := bcrypt.GenerateFromPassword([]byte(au.Password), bcrypt.MinCost)
+		hash, err := hasher.Hash(au.Password)
 		if err != nil {
 			log.Error(err)
 			return nil, errors.New("Unable to hash password for AuthUser")
@@ -71,7 +74,7 @@ func (au *AuthUser) maskWrite() (map[string]interface{}, error) {
 }
 
 func (au *AuthUser) validatePassword(p string) error {
-	return bcrypt.CompareHashAndPassword([]byte(au.Password), []byte(p))
+	return hasher.Verify(au.Password, p)
 }
 
 var converter = func (rows *sql.Rows) ([]BaseModel, error){
@@ -79,7 +82,7 @@ var converter = func (rows *sql.Rows) ([]BaseModel, error){
 	for rows.Next() {
 		inst := AuthUser{}
 		err := rows.Scan(&inst.ID, &inst.Username, &inst.Email,
-			&inst.UserRoleId, &inst.IsActive, &inst.OrgId,
+			&inst.UserRoleId, &inst.Status, &inst.OrgId,
 			&inst.FacebookId, &inst.GoogleId,
 			&inst.DateAdd, &inst.DateUpd)
 		if err != nil {
@@ -120,7 +123,7 @@ var converter = func (rows *sql.Rows) ([]BaseModel, error){
 //		for rows.Next() {
 //			inst := AuthUser{}
 //			err := rows.Scan(&inst.ID, &inst.Username, &inst.Email, &inst.Password,
-//				&inst.UserRoleId, &inst.IsActive, &inst.OrgId, &inst.FacebookId, &inst.GoogleId,
+//				&inst.UserRoleId, &inst.Status, &inst.OrgId, &inst.FacebookId, &inst.GoogleId,
 //				&inst.DateAdd, &inst.DateUpd, &inst.UserRole.ID, &inst.UserRole.Role, &inst.UserRole.Desc,
 //				&inst.UserRole.DateAdd, &inst.UserRole.DateUpd)
 //			if err != nil {
@@ -0,0 +1,81 @@
+package models
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+//verifies credentials of a login, Authenticate tries them in order
+//nil user (or INVALID_CREDENTIALS) means user is not known or credentials do not match, next one is tried
+//any other error stops the chain, org is nil if login did not name one
+type Authenticator interface {
+	Name() string
+	Authenticate(identifier string, org *Org, pass string) (*AuthUser, error)
+}
+
+//replaces the chain, local authenticator is the only one by default
+func (rm *DBRequestHandler) SetAuthenticators(a ...Authenticator) {
+	rm.authenticators = a
+}
+
+//checks password stored in auth_user
+type LocalAuthenticator struct {
+	rm *DBRequestHandler
+}
+
+func NewLocalAuthenticator(rm *DBRequestHandler) *LocalAuthenticator {
+	return &LocalAuthenticator{rm: rm}
+}
+
+func (la *LocalAuthenticator) Name() string {
+	return "local"
+}
+
+func (la *LocalAuthenticator) Authenticate(identifier string, org *Org, pass string) (*AuthUser, error) {
+	rm := la.rm
+	users, err := rm.findLoginUsers(identifier, org)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	} else if len(users) > 1 {
+		log.Errorf("Multiple users found for %s, org is required", identifier)
+		return nil, INVALID_CREDENTIALS
+	}
+	au := users[0]
+	//service accounts can only use api keys
+	if au.AccountType == ACCOUNT_SERVICE {
+		return nil, INVALID_CREDENTIALS
+	}
+	//directory decides if linked users can login, a stale local password must not bypass it
+	if au.LdapDn != "" {
+		return nil, nil
+	}
+	if err = au.validatePassword(pass); err != nil {
+		log.Error(err)
+		return nil, INVALID_CREDENTIALS
+	}
+	//password is known only now, move the hash to current settings
+	if hasher.NeedsRehash(au.Password) {
+		if hash, err := hasher.Hash(pass); err != nil {
+			log.Error(err)
+		} else if err = rm.savePasswordHash(au.ID, hash, false); err != nil {
+			log.Errorf("Unable to rehash password of user %d : %s", au.ID, err.Error())
+		} else {
+			log.Debugf("Password of user %d rehashed", au.ID)
+		}
+	}
+	//only after password check, so status is not revealed to others
+	if err = au.CheckStatus(); err != nil {
+		return au, err
+	}
+	if o, err := rm.GetOrg(au.OrgId); err != nil {
+		return nil, err
+	} else if o.PasswordDisabled {
+		return au, PASSWORD_LOGIN_DISABLED
+	}
+	if policy.Expired(au.PasswordChangedAt) {
+		return au, PASSWORD_EXPIRED
+	}
+	return au, nil
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+const MAX_AUTHZ_CHECKS = 100
+
+//result of an access check, conditions are the rows to which access is limited
+type Decision struct {
+	Allowed    bool      `json:"allowed"`
+	Conditions Condition `json:"conditions,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+func deny(reason string) *Decision {
+	return &Decision{Reason: reason}
+}
+
+//values keyed by json, field or column name, converted to column names
+func rowByColumn(values map[string]interface{}, fis map[string]FieldInfo) map[string]interface{} {
+	row := make(map[string]interface{})
+	for k, v := range values {
+		if fi, ok := fis[k]; ok {
+			row[fi.DBN] = v
+		} else {
+			row[k] = v
+		}
+	}
+	return row
+}
+
+//fields of the model keyed by column name
+func modelRow(bm BaseModel, fis map[string]FieldInfo) map[string]interface{} {
+	val := reflect.ValueOf(bm).Elem()
+	row := make(map[string]interface{})
+	for i := 0; i < val.NumField(); i++ {
+		if fi, ok := fis[val.Type().Field(i).Name]; ok && !fi.IsRef {
+			row[fi.DBN] = val.Field(i).Interface()
+		}
+	}
+	return row
+}
+
+//true if row satisfies all column conditions, columns missing in the row do not match
+func rowMatches(cond *Condition, row map[string]interface{}) bool {
+	for col, _ := range *cond {
+		v, ok := row[col]
+		if !ok || !hasCUPermissionForCondition(col, fmt.Sprintf("%v", v), cond) {
+			return false
+		}
+	}
+	return true
+}
+
+//decides action on table using the same checks as data api
+//without values returns if action is allowed on any row, along with the conditions
+//with values, read & delete check the candidate row, create & update check the new values
+func (p *Permissions) decide(table string, action string, values map[string]interface{},
+	fis map[string]FieldInfo, model BaseModel) *Decision {
+	if !checkPermissionValue(action) {
+		return deny("invalid action")
+	}
+	if p == nil {
+		return deny("no access")
+	}
+	var ok bool
+	switch action {
+	case PERMISSION_R:
+		ok, _, _ = p.HasReadAccess(table)
+	case PERMISSION_D:
+		ok, _, _ = p.HasDeleteAccess(table)
+	default:
+		tp, found := p.Ps[table]
+		ok = found && tp.condition(action) != nil
+	}
+	if !ok {
+		return deny("no access")
+	}
+	cond := p.Ps[table].condition(action)
+	d := &Decision{Allowed: true, Conditions: *cond}
+	if len(values) == 0 {
+		return d
+	}
+	switch action {
+	case PERMISSION_R, PERMISSION_D:
+		if !rowMatches(cond, rowByColumn(values, fis)) {
+			return deny("row does not match conditions")
+		}
+	case PERMISSION_U:
+		if err := p.HasUpdateAccess(table, values, fis); err != nil {
+			return deny(err.Error())
+		}
+	case PERMISSION_C:
+		if err := p.HasCreateAccess(table, model, fis); err != nil {
+			return deny(err.Error())
+		}
+	}
+	return d
+}
+
+//Check if ud can do action on table, for other services reusing role & user permissions
+//rows of other orgs are never accessible to non SU users, org of the caller is part of the conditions
+func (rm *DBRequestHandler) CheckAccess(ud *UserData, table string, action string,
+	values map[string]interface{}) *Decision {
+	qb, ok := rm.queryBuilders[table]
+	if !ok {
+		return deny("invalid table")
+	}
+	if rm.isSU(ud) {
+		if !checkPermissionValue(action) {
+			return deny("invalid action")
+		}
+		return &Decision{Allowed: true}
+	}
+	fis := qb.GetFieldInfo()
+	orgTable := hasColumn(fis, rm.orgcol)
+	if orgTable && len(values) > 0 {
+		org, ok := rowByColumn(values, fis)[rm.orgcol]
+		if ok && fmt.Sprintf("%v", org) != fmt.Sprintf("%d", ud.Org_id) {
+			return deny("row belongs to other org")
+		}
+		//org of the candidate row has to be known, create & update always use the org of the caller
+		if !ok && (action == PERMISSION_R || action == PERMISSION_D) {
+			return deny("row without org")
+		}
+	}
+	var model BaseModel
+	if action == PERMISSION_C && len(values) > 0 {
+		model = qb.GetInstance()
+		data, err := json.Marshal(values)
+		if err == nil {
+			err = json.Unmarshal(data, model)
+		}
+		if err != nil {
+			return deny("invalid values : " + err.Error())
+		}
+	}
+	d := ud.P.decide(table, action, values, fis, model)
+	if d.Allowed && orgTable {
+		org := fmt.Sprintf("%d", ud.Org_id)
+		if _, ok := d.Conditions[rm.orgcol]; ok && !hasCUPermissionForCondition(rm.orgcol, org, &d.Conditions) {
+			return deny("no access in own org")
+		}
+		//conditions are shared with the permissions of the role, so they are copied
+		conds := Condition{rm.orgcol: []string{org}}
+		for col, v := range d.Conditions {
+			if col != rm.orgcol {
+				conds[col] = v
+			}
+		}
+		d.Conditions = conds
+	}
+	return d
+}
+
+func hasColumn(fis map[string]FieldInfo, col string) bool {
+	for _, fi := range fis {
+		if fi.DBN == col {
+			return true
+		}
+	}
+	return false
+}
+
+//true if ud can see permissions of au, needs read access to the user in its own org
+func (rm *DBRequestHandler) CanInspect(ud *UserData, au *AuthUser) bool {
+	if rm.isSU(ud) {
+		return true
+	}
+	if ud == nil || au.ID == rm.su.Id || au.OrgId != ud.Org_id {
+		return false
+	}
+	fis := rm.queryBuilders[rm.auth_table].GetFieldInfo()
+	return ud.P.decide(rm.auth_table, PERMISSION_R, modelRow(au, fis), fis, nil).Allowed
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"fmt"
+	"github.com/auth_backend/utils"
+	"sort"
+	"testing"
+)
+
+func TestDecideAccess(t *testing.T) {
+	fvdetails := map[string]FieldInfo {
+		"XC" : {DBN:"xc"},
+		"xc" : {DBN:"xc"},
+		"XI" : {DBN:"xi"},
+	}
+	ps := Permissions{Ps:make(map[string]*TablePermission)}
+	ps.addPermission("all", PERMISSION_R,"", "")
+	ps.addPermission("all", PERMISSION_U,"", "")
+	ps.addPermission("cond", PERMISSION_R,"xc", "a")
+	ps.addPermission("cond", PERMISSION_R,"xc", "b")
+	ps.addPermission("cond", PERMISSION_U,"xi", "1")
+	ps.addPermission("cond", PERMISSION_D,"xi", "2")
+
+	test_table := map[string]struct{
+		table, action string
+		values map[string]interface{}
+		allowed bool
+		conds int
+	} {
+		"1.1": {"all", PERMISSION_R, nil, true, 0},
+		"1.2": {"all", PERMISSION_D, nil, false, 0},
+		"1.3": {"all", PERMISSION_U, map[string]interface{}{"XC": "z"}, true, 0},
+		"1.4": {"none", PERMISSION_R, nil, false, 0},
+		"1.5": {"all", "x", nil, false, 0},
+		"2.1": {"cond", PERMISSION_R, nil, true, 1},
+		"2.2": {"cond", PERMISSION_R, map[string]interface{}{"xc": "b", "XI": 9}, true, 1},
+		"2.3": {"cond", PERMISSION_R, map[string]interface{}{"xc": "z"}, false, 0},
+		"2.4": {"cond", PERMISSION_R, map[string]interface{}{"XI": 1}, false, 0},
+		"2.5": {"cond", PERMISSION_U, map[string]interface{}{"XI": 1}, true, 1},
+		"2.6": {"cond", PERMISSION_U, map[string]interface{}{"XI": 3}, false, 0},
+		"2.7": {"cond", PERMISSION_D, map[string]interface{}{"XI": 2.0}, true, 1},
+		"2.8": {"cond", PERMISSION_C, nil, false, 0},
+	}
+
+	keys := make([]string, 0, len(test_table))
+	for k, _ := range test_table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		test := test_table[k]
+		fmt.Printf("Executing %s\n", k)
+		d := ps.decide(test.table, test.action, test.values, fvdetails, nil)
+		utils.Assert(t, d.Allowed == test.allowed, "%s : %v", k, d)
+		utils.Equals(t, test.conds, len(d.Conditions))
+	}
+
+	var nop *Permissions
+	utils.Equals(t, false, nop.decide("all", PERMISSION_R, nil, fvdetails, nil).Allowed)
+}
+
+func TestCheckAccessOrg(t *testing.T) {
+	fis := map[string]FieldInfo {
+		"XC" : {DBN:"xc"},
+		"OrgId" : {DBN:"org_id"},
+	}
+	rm := &DBRequestHandler{queryBuilders: map[string]*QueryBuilder{
+		"orgt": {fields: fis},
+		"plain": {fields: map[string]FieldInfo{"XC": {DBN:"xc"}}},
+	}, orgcol: "org_id", su: &UserData{Id: 1}}
+	ps := &Permissions{Ps:make(map[string]*TablePermission)}
+	ps.addPermission("orgt", PERMISSION_R, "xc", "a")
+	ps.addPermission("orgt", PERMISSION_D, "org_id", "3")
+	ps.addPermission("plain", PERMISSION_R, "", "")
+	ud := &UserData{Id: 2, Org_id: 2, P: ps}
+
+	d := rm.CheckAccess(ud, "orgt", PERMISSION_R, nil)
+	utils.Assert(t, d.Allowed, "%v", d)
+	utils.Equals(t, Condition{"xc": {"a"}, "org_id": {"2"}}, d.Conditions)
+	//permissions of the role are not changed
+	utils.Equals(t, 1, len(*ps.Ps["orgt"].condition(PERMISSION_R)))
+
+	utils.Assert(t, rm.CheckAccess(ud, "orgt", PERMISSION_R, map[string]interface{}{"xc": "a", "org_id": 2}).Allowed, "row in own org")
+	utils.Assert(t, !rm.CheckAccess(ud, "orgt", PERMISSION_R, map[string]interface{}{"xc": "a", "org_id": 3}).Allowed, "row in other org")
+	utils.Assert(t, !rm.CheckAccess(ud, "orgt", PERMISSION_R, map[string]interface{}{"xc": "a"}).Allowed, "row without org")
+	//role limited to another org has no rows in own org
+	utils.Assert(t, !rm.CheckAccess(ud, "orgt", PERMISSION_D, nil).Allowed, "role limited to other org")
+
+	d = rm.CheckAccess(ud, "plain", PERMISSION_R, map[string]interface{}{"xc": "z"})
+	utils.Assert(t, d.Allowed, "%v", d)
+	utils.Equals(t, 0, len(d.Conditions))
+}
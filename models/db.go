@@ -10,6 +10,7 @@ import (
 	"gopkg.in/go-playground/validator.v9"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const (
@@ -29,6 +30,14 @@ type DBRequestHandler struct {
 	su 						   *UserData
 	orgcol					   string
 	ownercol			   	   string
+	permListener			   PermissionListener
+	authenticators			   []Authenticator
+}
+
+//notified when a change can affect permissions of logged in users
+type PermissionListener interface {
+	RoleChanged(id int64)
+	UserChanged(id int64)
 }
 
 func (dbm * DBRequestHandler) IsAuthTable(table string) bool {
@@ -47,10 +56,22 @@ type UserData struct {
 	Uuid string
 	Org_id int64
 	P *Permissions
+	Family string //refresh token family of the session
+	RoleId int64
+	Rv int64 //role permission version when P was loaded
+	Uv int64 //user permission version when P was loaded
+	Scope *Permissions //set when authenticated with a scoped token, P is already limited to it
+	ActorId int64 //SU impersonating this user, 0 for sessions of the user itself
+	Expires *time.Time `json:"-"` //expiry of the token used for the request, when known
 }
 
+//scoped tokens of SU only have the access given in their scope
 func (rm *DBRequestHandler) isSU(ud *UserData) bool {
-	return ud.Id == rm.su.Id
+	return ud.Id == rm.su.Id && ud.Scope == nil
+}
+
+func (rm *DBRequestHandler) IsSU(ud *UserData) bool {
+	return ud != nil && rm.isSU(ud)
 }
 
 func (rm *DBRequestHandler) RegisterDB(bq *QueryBuilder) error {
@@ -61,6 +82,40 @@ func (rm *DBRequestHandler) RegisterDB(bq *QueryBuilder) error {
 	return nil
 }
 
+func (rm *DBRequestHandler) SetPermissionListener(l PermissionListener) {
+	rm.permListener = l
+}
+
+//tells the listener about users/roles affected by change in given row
+func (rm *DBRequestHandler) permissionsChanged(table string, bm BaseModel) {
+	if rm.permListener == nil || bm == nil {
+		return
+	}
+	var role, user int64
+	switch table {
+	case rm.auth_table:
+		user = bm.GetId()
+	case rm.role_table:
+		role = bm.GetId()
+	case rm.auth_role_permission_table:
+		if p, ok := bm.(*UserRolePermission); ok {
+			role = p.UserRoleId
+		}
+	case rm.auth_permission_table:
+		if p, ok := bm.(*UserPermission); ok {
+			user = p.AuthUserId
+		}
+	}
+	if role > 0 {
+		log.Debugf("Permissions of role %d changed", role)
+		rm.permListener.RoleChanged(role)
+	}
+	if user > 0 {
+		log.Debugf("Permissions of user %d changed", user)
+		rm.permListener.UserChanged(user)
+	}
+}
+
 func InitDB(db *sql.DB, org string, owner string, sudo int, sudo_org int) *DBRequestHandler {
 	au := (&AuthUser{}).Register()
 	ur := (&UserRole{}).Register()
@@ -82,6 +137,7 @@ func InitDB(db *sql.DB, org string, owner string, sudo int, sudo_org int) *DBReq
 	}
 
 	rm.su = &UserData{Id:int64(sudo), Org_id:int64(sudo_org)}//super user
+	rm.authenticators = []Authenticator{NewLocalAuthenticator(&rm)}
 	rm.queryBuilders[au.GetName()] = au
 	rm.queryBuilders[up.GetName()] = up
 	rm.queryBuilders[urp.GetName()] = urp
@@ -94,79 +150,131 @@ func InitDB(db *sql.DB, org string, owner string, sudo int, sudo_org int) *DBReq
 }
 
 
-func (rm *DBRequestHandler) Authenticate(username string, pass string) (BaseModel, *Permissions, error) {
-	t_rm := rm.queryBuilders[rm.auth_table]
+//identifier is username or email, usernames are unique only within an org
+//orgSlug is needed when same username exists in more than one org
+//authenticators are tried in order, permissions always come from role & user permissions
+func (rm *DBRequestHandler) Authenticate(identifier string, orgSlug string, pass string) (BaseModel, *Permissions, error) {
+	if identifier == "" {
+		return nil, nil, INVALID_CREDENTIALS
+	}
+	var org *Org
+	if orgSlug != "" {
+		var err error
+		if org, err = rm.FindOrgBySlug(orgSlug); err != nil {
+			return nil, nil, err
+		} else if org == nil {
+			return nil, nil, INVALID_CREDENTIALS
+		}
+	}
+	var au *AuthUser
+	for _, a := range rm.authenticators {
+		u, err := a.Authenticate(identifier, org, pass)
+		if err == INVALID_CREDENTIALS || (err == nil && u == nil) {
+			continue
+		} else if err != nil {
+			return u, nil, err
+		}
+		log.Debugf("User %d authenticated by %s", u.ID, a.Name())
+		au = u
+		break
+	}
+	if au == nil {
+		return nil, nil, INVALID_CREDENTIALS
+	}
+	//only after credentials check, so status is not revealed to others
+	if err := au.CheckStatus(); err != nil {
+		return au, nil, err
+	}
+	ps, err := rm.loadPermissions(au)
+	if err != nil {
+		return nil, nil, err
+	}
+	return au, ps, nil
+}
+
+//users having identifier as username or email, only from org if given
+func (rm *DBRequestHandler) findLoginUsers(identifier string, org *Org) ([]*AuthUser, error) {
 	if m, err := rm.ReadObjOps(rm.auth_table,
-		[]Operation{{Name:"username", Value:username, Op:"=", NextOp:"noop"}},
+		[]Operation{{Name:"username", Value:identifier, Op:"=", NextOp:"or"},
+			{Name:"email", Value:identifier, Op:"=", NextOp:"noop"}},
 		0,500,true,"", rm.su); err != nil {
-			log.Error(err.Error())
-			return nil, nil, err
+		log.Error(err.Error())
+		return nil, err
+	} else if l, err := rm.queryBuilders[rm.auth_table].ConvertObj(m); err != nil {
+		return nil, err
 	} else {
-		switch len(*m) {
-		default:
-			log.Errorf("Multiple users found for %s",username)
-			return nil, nil, INVALID_CREDENTIALS
-		case 0 :
-			return nil, nil, INVALID_CREDENTIALS
-		case 1:
-			var au *AuthUser
-			if l, err := t_rm.ConvertObj(m); err != nil {
-				return nil, nil, err
-			} else {
-				au = l[0].(*AuthUser)
-			}
-			if err = au.validatePassword(pass); err != nil {
-				log.Error(err)
-				return au, nil, INVALID_CREDENTIALS
-			}
-			var rolep, userp *[]TableRow
-			if rolep, err = rm.ReadObjOps(rm.auth_role_permission_table,
-				[]Operation{{Name:"user_role_id", Value:au.UserRoleId, Op:"=", NextOp:"noop"}},
-				0,500000,true,"", rm.su); err != nil {
-				log.Error(err.Error())
-				return nil, nil, err
+		var users []*AuthUser
+		for _, bm := range l {
+			if au := bm.(*AuthUser); org == nil || au.OrgId == org.ID {
+				users = append(users, au)
 			}
+		}
+		return users, nil
+	}
+}
 
-			var conv_rolep []BaseModel
-			if conv_rolep, err = rm.queryBuilders[rm.auth_role_permission_table].ConvertObj(rolep); err != nil {
-				log.Errorf("User %s role permission could not be converted to model", au.Username)
-				return nil, nil, errors.New("Unable to read permissions for user "+au.Username)
-			}
+//reads role & user permissions of the user
+func (rm *DBRequestHandler) loadPermissions(au *AuthUser) (*Permissions, error) {
+	var rolep, userp *[]TableRow
+	var err error
+	if rolep, err = rm.ReadObjOps(rm.auth_role_permission_table,
+		[]Operation{{Name:"user_role_id", Value:au.UserRoleId, Op:"=", NextOp:"noop"}},
+		0,500000,true,"", rm.su); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
 
-			if userp, err = rm.ReadObjOps(rm.auth_permission_table,
-				[]Operation{{Name:"auth_user_id", Value:au.ID, Op:"=", NextOp:"noop"}},
-				0,500000,true,"", rm.su); err != nil {
-				log.Error(err.Error())
-				return nil, nil, err
-			}
+	var conv_rolep []BaseModel
+	if conv_rolep, err = rm.queryBuilders[rm.auth_role_permission_table].ConvertObj(rolep); err != nil {
+		log.Errorf("User %s role permission could not be converted to model", au.Username)
+		return nil, errors.New("Unable to read permissions for user "+au.Username)
+	}
 
-			var conv_userp []BaseModel
-			if conv_userp, err = rm.queryBuilders[rm.auth_permission_table].ConvertObj(userp); err != nil {
-				log.Errorf("User %s permission could not be converted to model", au.Username)
-				return nil, nil, errors.New("Unable to read permissions for user "+au.Username)
-			}
+	if userp, err = rm.ReadObjOps(rm.auth_permission_table,
+		[]Operation{{Name:"auth_user_id", Value:au.ID, Op:"=", NextOp:"noop"}},
+		0,500000,true,"", rm.su); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	var conv_userp []BaseModel
+	if conv_userp, err = rm.queryBuilders[rm.auth_permission_table].ConvertObj(userp); err != nil {
+		log.Errorf("User %s permission could not be converted to model", au.Username)
+		return nil, errors.New("Unable to read permissions for user "+au.Username)
+	}
 
-			lenr := len(conv_rolep)
-			lenu := len(conv_userp)
+	lenr := len(conv_rolep)
+	lenu := len(conv_userp)
 
-			allp := make([]BasePermissionModel, lenr+lenu)
-			for i, p := range conv_rolep{
-				allp[i] = p.(BasePermissionModel)
-			}
-			for i, p := range conv_userp {
-				allp[lenr+i] = p.(BasePermissionModel)
-			}
+	allp := make([]BasePermissionModel, lenr+lenu)
+	for i, p := range conv_rolep{
+		allp[i] = p.(BasePermissionModel)
+	}
+	for i, p := range conv_userp {
+		allp[lenr+i] = p.(BasePermissionModel)
+	}
 
-			log.Debugf("User %s has %d role, %d role permissions, %d user permissions",
-				au.Username, au.UserRoleId, lenr, lenu)
+	log.Debugf("User %s has %d role, %d role permissions, %d user permissions",
+		au.Username, au.UserRoleId, lenr, lenu)
 
-			ps := cacheUserPermissions(au, allp, rm)
-			//if au.IsActive <= 0 {
-			//	return au, server_errors.INACTIVE_USER
-			//}
-			return au, ps, nil
-		}
+	return cacheUserPermissions(au, allp, rm), nil
+}
+
+//reloads user & its permissions, used when permissions cached in a session are outdated
+//fails if user is no longer active
+func (rm *DBRequestHandler) LoadUser(id int64) (*AuthUser, *Permissions, error) {
+	au, err := rm.GetAuthUser(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = au.CheckStatus(); err != nil {
+		return nil, nil, err
 	}
+	ps, err := rm.loadPermissions(au)
+	if err != nil {
+		return nil, nil, err
+	}
+	return au, ps, nil
 }
 
 func (rm *DBRequestHandler) ReadObjJson(table string, data []byte, from int, limit int,
@@ -323,15 +431,40 @@ func (rm *DBRequestHandler) SetPassword(id int64, pass string) error {
 		}
 	}
 
+	if errmap := policy.Check(pass); errmap != nil {
+		return fieldError(errmap)
+	}
+	if reused, err := rm.passwordReused(id, obj.Password, pass); err != nil {
+		return err
+	} else if reused {
+		return fieldError(map[string]string{"password": "reused"})
+	}
+
 	obj.Password = pass
-	obj.maskWrite()
-	q := fmt.Sprintf("update %s set password=? where id=?",t_rm.GetName())
+	if _, err := obj.maskWrite(); err != nil {
+		return err
+	}
+	if err := rm.savePasswordHash(id, obj.Password, true); err != nil {
+		return err
+	}
+	if err := rm.addPasswordHistory(rm.db, id, obj.Password); err != nil {
+		log.Errorf("Unable to save password history of user %d : %s", id, err.Error())
+	}
+	return nil
+}
+
+//changed is false when only the hash is upgraded, password age is not reset then
+func (rm *DBRequestHandler) savePasswordHash(id int64, hash string, changed bool) error {
+	q := fmt.Sprintf("update %s set password=? where id=?", rm.auth_table)
+	if changed {
+		q = fmt.Sprintf("update %s set password=?, password_changed_at=now() where id=?", rm.auth_table)
+	}
 	log.Debug("Update: "+q)
 	insForm, err := rm.db.Prepare(q)
 	if err != nil {
 		return err
 	}
-	if s, err := insForm.Exec(obj.Password, id); err != nil {
+	if s, err := insForm.Exec(hash, id); err != nil {
 		return err
 	} else {
 		if upd, err := s.RowsAffected(); err != nil {
@@ -343,6 +476,188 @@ func (rm *DBRequestHandler) SetPassword(id int64, pass string) error {
 	}
 }
 
+//Self service signup, user is always created pending with the org & role decided by the server
+//returns the created user, password is set only after the user is created
+func (rm *DBRequestHandler) Signup(data []byte, pass string, org int64, role int64) (BaseModel, error) {
+	if org <= 0 || role <= 0 {
+		log.Error("signup org/role is not configured")
+		return nil, SERVER_ERROR
+	}
+	//checked before the user is created
+	if errmap := policy.Check(pass); errmap != nil {
+		return nil, fieldError(errmap)
+	}
+	var vmap map[string]interface{}
+	if err := json.Unmarshal(data, &vmap); err != nil {
+		return nil, err
+	}
+	if vmap == nil {
+		return nil, FORM_ERROR
+	}
+	//user cannot choose these
+	delete(vmap, "owner")
+	delete(vmap, "password")
+	vmap["org"] = org
+	vmap["user_role_id"] = role
+
+	var udata []byte
+	var err error
+	if udata, err = json.Marshal(vmap); err != nil {
+		return nil, err
+	}
+	hash, err := hasher.Hash(pass)
+	if err != nil {
+		log.Error(err)
+		return nil, SERVER_ERROR
+	}
+	tx, err := rm.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	//server creates the user on user's behalf
+	bm, err := rm.insertUser(tx, udata, hash)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return bm, nil
+}
+
+//creates the user as SU with its first password hash, if any
+//ex is a transaction, so a failed step does not leave a user without password behind
+func (rm *DBRequestHandler) insertUser(ex dbExecer, udata []byte, hash string) (BaseModel, error) {
+	bm, err := rm.saveObj(ex, udata, rm.auth_table, rm.su)
+	if err != nil {
+		return nil, err
+	}
+	if hash == "" {
+		return bm, nil
+	}
+	if _, err = ex.Exec("update "+rm.auth_table+" set password=?, password_changed_at=now() where id=?",
+		hash, bm.GetId()); err != nil {
+		return nil, err
+	}
+	if err = rm.addPasswordHistory(ex, bm.GetId(), hash); err != nil {
+		return nil, err
+	}
+	return bm, nil
+}
+
+//removes a user which never got active, when its signup could not be completed
+func (rm *DBRequestHandler) RemovePendingUser(id int64) error {
+	_, err := rm.db.Exec("delete from "+rm.auth_table+" where id=? and status=?", id, STATUS_PENDING)
+	return err
+}
+
+//finds user by username or email within org, or in all orgs when org is nil
+//email is unique across orgs, username only within an org, so returns nil if username is ambiguous
+func (rm *DBRequestHandler) FindAuthUser(identifier string, org *Org) (*AuthUser, error) {
+	if identifier == "" {
+		return nil, nil
+	}
+	users, err := rm.findLoginUsers(identifier, org)
+	if err != nil {
+		return nil, err
+	}
+	for _, au := range users {
+		if strings.EqualFold(au.Email, identifier) {
+			return au, nil
+		}
+	}
+	switch len(users) {
+	case 0:
+		return nil, nil
+	case 1:
+		return users[0], nil
+	default:
+		log.Errorf("Multiple users found for %s, org is required", identifier)
+		return nil, nil
+	}
+}
+
+//email is unique across orgs, returns nil if no user has it
+func (rm *DBRequestHandler) FindUserByEmail(email string) (*AuthUser, error) {
+	if email == "" {
+		return nil, nil
+	}
+	if m, err := rm.ReadObjOps(rm.auth_table,
+		[]Operation{{Name:"email", Value:email, Op:"=", NextOp:"noop"}},
+		0,1,true,"", rm.su); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	} else if l, err := rm.queryBuilders[rm.auth_table].ConvertObj(m); err != nil {
+		return nil, err
+	} else if len(l) == 0 {
+		return nil, nil
+	} else {
+		return l[0].(*AuthUser), nil
+	}
+}
+
+func (rm *DBRequestHandler) GetAuthUser(id int64) (*AuthUser, error) {
+	if id <= 0 {
+		return nil, errors.New("object id invalid")
+	}
+	if found, err := findById(rm.queryBuilders[rm.auth_table], rm.db, id); err != nil {
+		return nil, err
+	} else {
+		if found == nil || len(found) != 1 {
+			return nil, errors.New("Object with mentioned id could not be found")
+		}
+		return found[0].(*AuthUser), nil
+	}
+}
+
+func (rm *DBRequestHandler) GetOrg(id int64) (*Org, error) {
+	if id <= 0 {
+		return nil, errors.New("object id invalid")
+	}
+	if found, err := findById(rm.queryBuilders[rm.org_table], rm.db, id); err != nil {
+		return nil, err
+	} else {
+		if found == nil || len(found) != 1 {
+			return nil, errors.New("Object with mentioned id could not be found")
+		}
+		return found[0].(*Org), nil
+	}
+}
+
+//returns nil if no org has the slug
+func (rm *DBRequestHandler) FindOrgBySlug(slug string) (*Org, error) {
+	if slug == "" {
+		return nil, nil
+	}
+	if m, err := rm.ReadObjOps(rm.org_table,
+		[]Operation{{Name:"slug", Value:slug, Op:"=", NextOp:"noop"}},
+		0,1,true,"", rm.su); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	} else if len(*m) == 0 {
+		return nil, nil
+	} else if l, err := rm.queryBuilders[rm.org_table].ConvertObj(m); err != nil {
+		return nil, err
+	} else {
+		return l[0].(*Org), nil
+	}
+}
+
+func (rm *DBRequestHandler) GetUserRole(id int64) (*UserRole, error) {
+	if id <= 0 {
+		return nil, errors.New("object id invalid")
+	}
+	if found, err := findById(rm.queryBuilders[rm.role_table], rm.db, id); err != nil {
+		return nil, err
+	} else {
+		if found == nil || len(found) != 1 {
+			return nil, errors.New("Object with mentioned id could not be found")
+		}
+		return found[0].(*UserRole), nil
+	}
+}
+
 //Update fields of an entry
 func (rm *DBRequestHandler) UpdateObj(table string, id int64, data []byte, ud *UserData) (map[string]interface{}, error) {
 	if t_rm, ok := rm.queryBuilders[table]; ok {
@@ -377,7 +692,11 @@ func (rm *DBRequestHandler) UpdateObj(table string, id int64, data []byte, ud *U
 			return nil, err
 		}
 
-		if err := validateUnique(rm.db, t_rm, &kvp); err != nil {
+		var exist_org int64
+		if bom, ok := exist.(BaseOrgModel); ok {
+			exist_org = bom.GetOrgId()
+		}
+		if err := validateUnique(rm.db, t_rm, &kvp, rm.orgcol, exist_org); err != nil {
 			return nil, err
 		}
 
@@ -485,6 +804,9 @@ func (rm *DBRequestHandler) UpdateObj(table string, id int64, data []byte, ud *U
 					return nil, err
 				} else {
 					log.Debugf("Update the fields for id %d",upd)
+					//both old & new owner of the row are affected
+					rm.permissionsChanged(table, exist)
+					rm.permissionsChanged(table, covrt_obj)
 					//copy back the prev values
 					for k,v := range orig_vals {
 						kvp[k] = v
@@ -504,6 +826,18 @@ func (rm *DBRequestHandler) UpdateObj(table string, id int64, data []byte, ud *U
 }
 
 func (rm *DBRequestHandler) SaveObj(data []byte, table string, ud *UserData) (BaseModel, error) {
+	return rm.saveObj(rm.db, data, table, ud)
+}
+
+//*sql.DB or *sql.Tx, so a create can be part of a transaction
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (rm *DBRequestHandler) saveObj(ex dbExecer, data []byte, table string, ud *UserData) (BaseModel, error) {
 	if t_rm, ok := rm.queryBuilders[table]; ok {
 		fi := t_rm.GetFieldInfo()
 		obj := t_rm.GetInstance()
@@ -572,7 +906,7 @@ func (rm *DBRequestHandler) SaveObj(data []byte, table string, ud *UserData) (Ba
 			return nil, err
 		}
 
-		if err := validateUnique(rm.db, t_rm, &vmap); err != nil {
+		if err := validateUnique(ex, t_rm, &vmap, rm.orgcol, org); err != nil {
 			return nil, err
 		}
 
@@ -596,7 +930,7 @@ func (rm *DBRequestHandler) SaveObj(data []byte, table string, ud *UserData) (Ba
 				q+=", "+rm.ownercol+"=?"
 				params = append(params, owner)
 			}
-			insForm, err := rm.db.Prepare(q)
+			insForm, err := ex.Prepare(q)
 			if err != nil {
 				log.Errorf(err.Error())
 				return nil, err
@@ -620,6 +954,7 @@ func (rm *DBRequestHandler) SaveObj(data []byte, table string, ud *UserData) (Ba
 					if rm, ok := obj.(ReadMasker);ok {
 						rm.maskRead()
 					}
+					rm.permissionsChanged(table, obj)
 					return obj.(BaseModel), nil
 				}
 			}
@@ -694,6 +1029,7 @@ func (rm *DBRequestHandler) DeleteObj(table string, id int64, ud *UserData) erro
 				return UNAUTHORIZED
 			} else {
 				log.Debugf("Object deleted : %d",ins_id)
+				rm.permissionsChanged(table, exist)
 				return nil
 			}
 		}
@@ -748,14 +1084,19 @@ func findById(t_rm *QueryBuilder, db *sql.DB, id int64) ([]BaseModel, error) {
 	}
 }
 
-func validateUnique(db *sql.DB, t_rm *QueryBuilder, vmap *map[string]interface{}) error {
+//uq_org fields are checked only within org, globally when object does not belong to an org
+func validateUnique(db dbExecer, t_rm *QueryBuilder, vmap *map[string]interface{}, orgcol string, org int64) error {
 	//check for unique keys
 	uq_str := ""
 	var uq_params []interface{}
 	fi := t_rm.GetFieldInfo()
 	for k,val := range *vmap {
 		for _, f := range fi {
-			if f.UQ && k == f.Json {
+			if f.UQOrg && k == f.Json && org > 0 {
+				uq_str += " ("+f.DBN+"=? and "+orgcol+"=?) or"
+				uq_params = append(uq_params, val, org)
+				break;
+			} else if (f.UQ || f.UQOrg) && k == f.Json {
 				uq_str += " "+f.DBN+"=? or"
 				uq_params = append(uq_params, val)
 				break;
@@ -154,19 +154,26 @@ func TestRegister(t *testing.T) {
 
 func TestAuthenticate(t *testing.T) {
 	if dbmHandler == nil { t.Fatal("Database not initialized") }
-	_, _, err := dbmHandler.Authenticate("test", "WrongPass")
+	_, _, err := dbmHandler.Authenticate("test", "", "WrongPass")
 	utils.Assert(t, err != nil, "Should have an error while logging in with wrong username")
-	_, _, err = dbmHandler.Authenticate("su", "WrongPass")
+	_, _, err = dbmHandler.Authenticate("su", "", "WrongPass")
 	utils.Assert(t, err != nil, "Should have an error while logging in with wrong username")
-	bm, ps, err := dbmHandler.Authenticate("su", "nkktest")
+	bm, ps, err := dbmHandler.Authenticate("su", "", "nkktest")
 	utils.Assert(t, err == nil, "Should have logged in")
 	au := bm.(*models.AuthUser)
 	super_user = &models.UserData{Id: au.GetId(), Org_id:au.OrgId, Uuid:"su_uuid", P: ps}
 
-	bm, ps, err = dbmHandler.Authenticate("simple_user", "nkktest")
+	bm, ps, err = dbmHandler.Authenticate("simple_user", "", "nkktest")
 	utils.Assert(t, err == nil, "Should have logged in")
 	au = bm.(*models.AuthUser)
 	simple_user = &models.UserData{Id: au.GetId(), Org_id:au.OrgId, Uuid:"simple_user_uuid", P: ps}
+
+	_, _, err = dbmHandler.Authenticate("simple_user", "another_org", "nkktest")
+	utils.Assert(t, err == nil, "Should have logged in with org")
+	_, _, err = dbmHandler.Authenticate("simple_user", "super_users", "nkktest")
+	utils.Assert(t, err != nil, "Should not find user in another org")
+	_, _, err = dbmHandler.Authenticate("simple_user", "no_such_org", "nkktest")
+	utils.Assert(t, err != nil, "Should have an error for unknown org")
 }
 
 
@@ -289,6 +296,43 @@ func TestDelete(t *testing.T) {
 
 }
 
+func TestUpdateSelf(t *testing.T) {
+	mustHave(t)
+	au, err := dbmHandler.UpdateSelf(simple_user.Id, []byte(`{"email":"simple@example.org"}`))
+	utils.Ok(t, err)
+	utils.Equals(t, "simple@example.org", au.Email)
+	//unchanged username is not a duplicate of itself
+	_, err = dbmHandler.UpdateSelf(simple_user.Id, []byte(`{"username":"simple_user"}`))
+	utils.Ok(t, err)
+	_, err = dbmHandler.UpdateSelf(simple_user.Id, []byte(`{"user_role_id":1}`))
+	utils.Assert(t, err != nil, "Should not be able to change own role")
+	_, err = dbmHandler.UpdateSelf(simple_user.Id, []byte(`{"status":"active"}`))
+	utils.Assert(t, err != nil, "Should not be able to change read only field")
+	_, err = dbmHandler.UpdateSelf(simple_user.Id, []byte(`{"email":"not an email"}`))
+	utils.Assert(t, err != nil, "Should validate the email")
+	_, err = dbmHandler.UpdateSelf(super_user.Id, []byte(`{"email":"simple@example.org"}`))
+	utils.Assert(t, err != nil, "Email of another user should not be allowed")
+	utils.Equals(t, models.USER_ALREADY_EXISTS, dbmHandler.CheckNewEmail(super_user.Id, "simple@example.org"))
+	utils.Ok(t, dbmHandler.CheckNewEmail(simple_user.Id, "simple@example.org"))
+	utils.Assert(t, dbmHandler.CheckNewEmail(simple_user.Id, "not an email") != nil, "Should validate the new email")
+}
+
+func TestChangePassword(t *testing.T) {
+	mustHave(t)
+	err := dbmHandler.ChangePassword(simple_user.Id, "WrongPass", "nkktest22")
+	utils.Equals(t, models.INVALID_CREDENTIALS, err)
+	err = dbmHandler.ChangePassword(simple_user.Id, "nkktest", "short")
+	utils.Assert(t, err != nil, "Password policy should apply")
+	//db is set up again for every run, so password is not restored
+	utils.Ok(t, dbmHandler.ChangePassword(simple_user.Id, "nkktest", "nkktest22"))
+	_, _, err = dbmHandler.Authenticate("simple_user", "", "nkktest22")
+	utils.Ok(t, err)
+	_, _, err = dbmHandler.Authenticate("simple_user", "", "nkktest")
+	utils.Assert(t, err != nil, "Old password should not work")
+	err = dbmHandler.ChangePassword(simple_user.Id, "nkktest22", "nkktest22")
+	utils.Assert(t, err != nil, "Same password should not be allowed")
+}
+
 type TestTable struct {
 	ID int64 			`json:"test_id" v:"ro"`
 	Name string			`json:"name" validate:"required" v:"uq"`//is unique
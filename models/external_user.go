@@ -0,0 +1,165 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+//columns of auth_user holding the id of user at an identity provider
+var EXTERNAL_ID_COLUMNS = map[string]bool{"google_id": true, "facebook_id": true, "ldap_dn": true, "saml_id": true}
+
+//finds user linked with given id of identity provider, returns nil if none
+func (rm *DBRequestHandler) FindExternalUser(column string, extId string) (*AuthUser, error) {
+	if !EXTERNAL_ID_COLUMNS[column] || extId == "" {
+		return nil, errors.New("invalid external id")
+	}
+	if m, err := rm.ReadObjOps(rm.auth_table,
+		[]Operation{{Name:column, Value:extId, Op:"=", NextOp:"noop"}},
+		0,2,true,"", rm.su); err != nil {
+		log.Error(err.Error())
+		return nil, err
+	} else {
+		switch len(*m) {
+		case 0:
+			return nil, nil
+		case 1:
+			if l, err := rm.queryBuilders[rm.auth_table].ConvertObj(m); err != nil {
+				return nil, err
+			} else {
+				return l[0].(*AuthUser), nil
+			}
+		default:
+			log.Errorf("Multiple users found for %s %s", column, extId)
+			return nil, DUPLICATE_ENTRY
+		}
+	}
+}
+
+//links user with its id at an identity provider
+func (rm *DBRequestHandler) LinkExternalUser(id int64, column string, extId string) error {
+	return rm.linkExternalUser(rm.db, id, column, extId)
+}
+
+func (rm *DBRequestHandler) linkExternalUser(ex dbExecer, id int64, column string, extId string) error {
+	if !EXTERNAL_ID_COLUMNS[column] || extId == "" {
+		return errors.New("invalid external id")
+	}
+	if id <= 0 {
+		return errors.New("object id invalid")
+	}
+	q := fmt.Sprintf("update %s set %s=? where id=?", rm.auth_table, column)
+	log.Debug("Update: "+q)
+	if _, err := ex.Exec(q, extId, id); err != nil {
+		return err
+	}
+	log.Infof("User %d linked with %s", id, column)
+	return nil
+}
+
+//creates an active user for someone who logged in through an identity provider
+//username is generated if not given, user can change it later
+func (rm *DBRequestHandler) CreateExternalUser(column string, extId string, username string, email string,
+	org int64, role int64) (*AuthUser, error) {
+	if org <= 0 || role <= 0 {
+		log.Error("signup org/role is not configured")
+		return nil, SERVER_ERROR
+	}
+	if email == "" {
+		return nil, errors.New("{\"email\":\"required\"}")
+	}
+	if username == "" {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		username = "u" + strings.ToLower(base32.StdEncoding.EncodeToString(b))[:11]
+	}
+	vmap := map[string]interface{}{
+		"username": username,
+		"email": email,
+		"org": org,
+		"user_role_id": role,
+	}
+	udata, err := json.Marshal(vmap)
+	if err != nil {
+		return nil, err
+	}
+	//user is created linked & active or not at all
+	tx, err := rm.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	bm, err := rm.insertUser(tx, udata, "")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = rm.linkExternalUser(tx, bm.GetId(), column, extId); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	//identity provider has already verified the user
+	if _, err = tx.Exec("update "+rm.auth_table+" set status=? where id=?", STATUS_ACTIVE, bm.GetId()); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rm.GetAuthUser(bm.GetId())
+}
+
+//true if username can be given to a new user of the org
+func (rm *DBRequestHandler) usernameAvailable(username string, org int64) (bool, error) {
+	if err := rm.validate.Var(username, "min=3,max=12"); err != nil {
+		return false, nil
+	}
+	var count int
+	if err := rm.db.QueryRow("select count(*) from "+rm.auth_table+" where username=? and "+rm.orgcol+"=?",
+		username, org).Scan(&count); err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+//user managed by a directory, created on first login and its role follows the directory afterwards
+//existing local users are never linked by username, they have to be linked with LinkExternalUser
+func (rm *DBRequestHandler) SyncExternalUser(column string, extId string, username string, email string,
+	org int64, role int64) (*AuthUser, error) {
+	au, err := rm.FindExternalUser(column, extId)
+	if err != nil {
+		return nil, err
+	}
+	if au == nil {
+		//directory usernames may not be valid or free here, generated one is used then
+		if ok, err := rm.usernameAvailable(username, org); err != nil {
+			return nil, err
+		} else if !ok {
+			log.Debugf("Username %q cannot be used for %s user, generating one", username, column)
+			username = ""
+		}
+		if au, err = rm.CreateExternalUser(column, extId, username, email, org, role); err != nil {
+			return nil, err
+		}
+		log.Infof("User %d provisioned from %s", au.ID, column)
+		return au, nil
+	}
+	if au.OrgId != org {
+		log.Errorf("User %d linked with %s %s belongs to org %d", au.ID, column, extId, au.OrgId)
+		return nil, INVALID_CREDENTIALS
+	}
+	if au.UserRoleId != role {
+		if _, err = rm.db.Exec("update "+rm.auth_table+" set user_role_id=? where id=?", role, au.ID); err != nil {
+			return nil, err
+		}
+		log.Infof("Role of user %d changed from %d to %d by directory", au.ID, au.UserRoleId, role)
+		au.UserRoleId = role
+		rm.permissionsChanged(rm.auth_table, au)
+	}
+	return au, nil
+}
@@ -0,0 +1,314 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	INVITATION_TABLE = "invitation"
+)
+
+//invitee creates the account with the token, only its hash is stored
+type Invitation struct {
+	Id         int64      `json:"invitation_id"`
+	OrgId      int64      `json:"org_id"`
+	Email      string     `json:"email"`
+	UserRoleId int64      `json:"user_role_id"`
+	InvitedBy  int64      `json:"invited_by"`
+	Hash       string     `json:"-"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	AuthUserId int64      `json:"auth_user_id,omitempty"` //user created on accept
+	DateAdd    time.Time  `json:"date_add"`
+}
+
+//can still be accepted
+func (i *Invitation) Pending(now time.Time) bool {
+	return i.AcceptedAt == nil && i.RevokedAt == nil && now.Before(i.ExpiresAt)
+}
+
+const invitationColumns = "id, org_id, email, user_role_id, invited_by, token_hash, expires_at, accepted_at, revoked_at, auth_user_id, date_add"
+
+func scanInvitations(rows *sql.Rows) ([]*Invitation, error) {
+	defer rows.Close()
+	ret := make([]*Invitation, 0)
+	for rows.Next() {
+		i := &Invitation{}
+		var acc, rev sql.NullTime
+		var uid sql.NullInt64
+		if err := rows.Scan(&i.Id, &i.OrgId, &i.Email, &i.UserRoleId, &i.InvitedBy, &i.Hash,
+			&i.ExpiresAt, &acc, &rev, &uid, &i.DateAdd); err != nil {
+			return nil, err
+		}
+		if acc.Valid {
+			i.AcceptedAt = &acc.Time
+		}
+		if rev.Valid {
+			i.RevokedAt = &rev.Time
+		}
+		i.AuthUserId = uid.Int64
+		ret = append(ret, i)
+	}
+	return ret, rows.Err()
+}
+
+//same rights as creating the user directly, SU can invite into any org
+//others need create access to users with the role, in their own org
+func (rm *DBRequestHandler) canInvite(ud *UserData, org int64, role int64) bool {
+	if ud == nil {
+		return false
+	}
+	if rm.isSU(ud) {
+		return true
+	}
+	if org != ud.Org_id {
+		return false
+	}
+	au := &AuthUser{UserRoleId: role, OrgId: org}
+	if err := ud.P.HasCreateAccess(rm.auth_table, au, rm.queryBuilders[rm.auth_table].GetFieldInfo()); err != nil {
+		log.Debugf("User %d cannot invite with role %d : %s", ud.Id, role, err.Error())
+		return false
+	}
+	return true
+}
+
+//org is used only for SU, others always invite into their own org
+func (rm *DBRequestHandler) CreateInvitation(ud *UserData, email string, role int64, org int64,
+	hash string, expires time.Time) (*Invitation, error) {
+	if ud == nil {
+		return nil, UNAUTHORIZED
+	}
+	if !rm.isSU(ud) {
+		org = ud.Org_id
+	}
+	errmap := make(map[string]string)
+	if err := rm.validate.Var(email, "required,email"); err != nil {
+		errmap["email"] = "email"
+	}
+	if role <= 0 {
+		errmap["user_role_id"] = "required"
+	} else if _, err := rm.GetUserRole(role); err != nil {
+		errmap["user_role_id"] = "invalid"
+	}
+	if org <= 0 {
+		errmap["org"] = "required"
+	} else if _, err := rm.GetOrg(org); err != nil {
+		errmap["org"] = "invalid"
+	}
+	if len(errmap) > 0 {
+		return nil, fieldError(errmap)
+	}
+	if !rm.canInvite(ud, org, role) {
+		return nil, UNAUTHORIZED
+	}
+
+	//emails are unique across orgs
+	var count int
+	if err := rm.db.QueryRow("select count(*) from "+rm.auth_table+" where email=?", email).Scan(&count); err != nil {
+		return nil, err
+	} else if count > 0 {
+		return nil, USER_ALREADY_EXISTS
+	}
+	//pending invitation has to be resent instead
+	if err := rm.db.QueryRow("select count(*) from "+INVITATION_TABLE+" where email=? and org_id=? and "+
+		"accepted_at is null and revoked_at is null and expires_at > now()", email, org).Scan(&count); err != nil {
+		return nil, err
+	} else if count > 0 {
+		return nil, DUPLICATE_ENTRY
+	}
+
+	i := &Invitation{OrgId: org, Email: email, UserRoleId: role, InvitedBy: ud.Id, Hash: hash,
+		ExpiresAt: expires, DateAdd: time.Now()}
+	s, err := rm.db.Exec("insert into "+INVITATION_TABLE+"(org_id, email, user_role_id, invited_by, token_hash, expires_at) "+
+		"values(?,?,?,?,?,?)", i.OrgId, i.Email, i.UserRoleId, i.InvitedBy, i.Hash, i.ExpiresAt)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+	if i.Id, err = s.LastInsertId(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (rm *DBRequestHandler) GetInvitation(id int64) (*Invitation, error) {
+	rows, err := rm.db.Query("select "+invitationColumns+" from "+INVITATION_TABLE+" where id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	l, err := scanInvitations(rows)
+	if err != nil {
+		return nil, err
+	} else if len(l) == 0 {
+		return nil, INVALID_ENTRY
+	}
+	return l[0], nil
+}
+
+//invitation with given id which ud is allowed to manage
+func (rm *DBRequestHandler) GetManagedInvitation(id int64, ud *UserData) (*Invitation, error) {
+	i, err := rm.GetInvitation(id)
+	if err != nil {
+		return nil, err
+	}
+	if !rm.canInvite(ud, i.OrgId, i.UserRoleId) {
+		return nil, UNAUTHORIZED
+	}
+	return i, nil
+}
+
+//invitations of the org of ud which ud could have sent, all of them for SU
+func (rm *DBRequestHandler) ListInvitations(ud *UserData) ([]*Invitation, error) {
+	if ud == nil {
+		return nil, UNAUTHORIZED
+	}
+	var rows *sql.Rows
+	var err error
+	if rm.isSU(ud) {
+		rows, err = rm.db.Query("select " + invitationColumns + " from " + INVITATION_TABLE + " order by id desc")
+	} else {
+		rows, err = rm.db.Query("select "+invitationColumns+" from "+INVITATION_TABLE+
+			" where org_id=? order by id desc", ud.Org_id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l, err := scanInvitations(rows)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Invitation, 0, len(l))
+	for _, i := range l {
+		if rm.canInvite(ud, i.OrgId, i.UserRoleId) {
+			ret = append(ret, i)
+		}
+	}
+	return ret, nil
+}
+
+//nil if no invitation has the hash
+func (rm *DBRequestHandler) FindInvitation(hash string) (*Invitation, error) {
+	rows, err := rm.db.Query("select "+invitationColumns+" from "+INVITATION_TABLE+" where token_hash=?", hash)
+	if err != nil {
+		return nil, err
+	}
+	l, err := scanInvitations(rows)
+	if err != nil || len(l) == 0 {
+		return nil, err
+	}
+	return l[0], nil
+}
+
+//new token & expiry, old token stops working
+func (rm *DBRequestHandler) RenewInvitation(id int64, hash string, expires time.Time) error {
+	s, err := rm.db.Exec("update "+INVITATION_TABLE+" set token_hash=?, expires_at=? "+
+		"where id=? and accepted_at is null and revoked_at is null", hash, expires, id)
+	if err != nil {
+		return err
+	}
+	if upd, err := s.RowsAffected(); err != nil {
+		return err
+	} else if upd == 0 {
+		return errors.New("invitation is already accepted or revoked")
+	}
+	return nil
+}
+
+func (rm *DBRequestHandler) RevokeInvitation(id int64) error {
+	s, err := rm.db.Exec("update "+INVITATION_TABLE+" set revoked_at=now() "+
+		"where id=? and accepted_at is null and revoked_at is null", id)
+	if err != nil {
+		return err
+	}
+	if upd, err := s.RowsAffected(); err != nil {
+		return err
+	} else if upd == 0 {
+		return errors.New("invitation is already accepted or revoked")
+	}
+	return nil
+}
+
+//creates an active user in the org of invitation, data has the username chosen by invitee
+//email, org & role always come from the invitation
+func (rm *DBRequestHandler) AcceptInvitation(i *Invitation, data []byte, pass string) (*AuthUser, error) {
+	if !i.Pending(time.Now()) {
+		return nil, INVALID_TOKEN
+	}
+	org, err := rm.GetOrg(i.OrgId)
+	if err != nil {
+		return nil, err
+	}
+	//checked before the user is created, users of orgs without password login have none
+	if !org.PasswordDisabled {
+		if errmap := policy.Check(pass); errmap != nil {
+			return nil, fieldError(errmap)
+		}
+	}
+	var vmap map[string]interface{}
+	if err := json.Unmarshal(data, &vmap); err != nil {
+		return nil, err
+	}
+	if vmap == nil {
+		return nil, FORM_ERROR
+	}
+	delete(vmap, "owner")
+	delete(vmap, "password")
+	vmap["email"] = i.Email
+	vmap["org"] = i.OrgId
+	vmap["user_role_id"] = i.UserRoleId
+
+	udata, err := json.Marshal(vmap)
+	if err != nil {
+		return nil, err
+	}
+	hash := ""
+	if !org.PasswordDisabled {
+		if hash, err = hasher.Hash(pass); err != nil {
+			log.Error(err)
+			return nil, SERVER_ERROR
+		}
+	}
+
+	tx, err := rm.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	//only one request can claim the invitation
+	s, err := tx.Exec("update "+INVITATION_TABLE+" set accepted_at=now() "+
+		"where id=? and accepted_at is null and revoked_at is null and expires_at > now()", i.Id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if upd, err := s.RowsAffected(); err != nil {
+		tx.Rollback()
+		return nil, err
+	} else if upd != 1 {
+		tx.Rollback()
+		return nil, INVALID_TOKEN
+	}
+	//server creates the user on behalf of the inviter, who was checked when inviting
+	bm, err := rm.insertUser(tx, udata, hash)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	//email is verified by the token
+	if _, err = tx.Exec("update "+rm.auth_table+" set status=? where id=?", STATUS_ACTIVE, bm.GetId()); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err = tx.Exec("update "+INVITATION_TABLE+" set auth_user_id=? where id=?", bm.GetId(), i.Id); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rm.GetAuthUser(bm.GetId())
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+//second factor tables are never exposed through data api
+const (
+	TOTP_TABLE = "user_totp"
+	RECOVERY_CODE_TABLE = "user_recovery_code"
+)
+
+//recovery codes are random, a fast hash is enough and allows lookup by hash
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.Replace(code, "-", "", -1))))
+	return hex.EncodeToString(sum[:])
+}
+
+//returns totp secret of the user, empty if user has not enrolled
+func (rm *DBRequestHandler) GetTOTPSecret(id int64) (string, error) {
+	var secret string
+	err := rm.db.QueryRow("select secret from "+TOTP_TABLE+" where auth_user_id=?", id).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		log.Error(err.Error())
+		return "", err
+	}
+	return secret, nil
+}
+
+//enables totp for the user, previous secret & recovery codes are replaced
+func (rm *DBRequestHandler) EnableTOTP(id int64, secret string, codes []string) error {
+	if id <= 0 || secret == "" {
+		return errors.New("object id invalid")
+	}
+	tx, err := rm.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("replace into "+TOTP_TABLE+"(auth_user_id, secret) values(?,?)", id, secret); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = replaceRecoveryCodes(tx, id, codes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//removes second factor of the user
+func (rm *DBRequestHandler) DisableTOTP(id int64) error {
+	tx, err := rm.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("delete from "+RECOVERY_CODE_TABLE+" where auth_user_id=?", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec("delete from "+TOTP_TABLE+" where auth_user_id=?", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//invalidates existing recovery codes of the user and stores the new ones
+func (rm *DBRequestHandler) SetRecoveryCodes(id int64, codes []string) error {
+	tx, err := rm.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = replaceRecoveryCodes(tx, id, codes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, id int64, codes []string) error {
+	if _, err := tx.Exec("delete from "+RECOVERY_CODE_TABLE+" where auth_user_id=?", id); err != nil {
+		return err
+	}
+	for _, c := range codes {
+		if _, err := tx.Exec("insert into "+RECOVERY_CODE_TABLE+"(auth_user_id, code_hash) values(?,?)",
+			id, hashRecoveryCode(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//marks the recovery code used, returns false if code is invalid or already used
+func (rm *DBRequestHandler) UseRecoveryCode(id int64, code string) (bool, error) {
+	s, err := rm.db.Exec("update "+RECOVERY_CODE_TABLE+" set used_at=now() where auth_user_id=? and code_hash=? and used_at is null",
+		id, hashRecoveryCode(code))
+	if err != nil {
+		log.Error(err.Error())
+		return false, err
+	}
+	upd, err := s.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return upd == 1, nil
+}
@@ -7,6 +7,9 @@ import (
 type Org struct {
 	ID int64 			`json:"org_id" v:"ro"`
 	Name string 		`json:"name" validate:"required"`
+	Slug string 		`json:"slug" validate:"omitempty,max=63" v:"uq"` //used to pick the org at login
+	MagicLink bool 		`json:"magic_link"` //users can login with a link sent to their email
+	PasswordDisabled bool `json:"password_disabled"` //users cannot login with password
 	DateAdd time.Time 	`json:"date_add" v:"ro"`
 	DateUpd time.Time 	`json:"date_upd" v:"ro"`
 }
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	HASH_BCRYPT = "bcrypt"
+	HASH_ARGON2ID = "argon2id"
+	PEPPER_PREFIX = "$pep$" //hash was created from peppered password
+)
+
+//Hashes are self describing, so hashes created with older settings can still be verified
+type PasswordHasher interface {
+	Hash(pass string) (string, error)
+	Verify(hash string, pass string) error
+	//true if hash was not created with current settings
+	NeedsRehash(hash string) bool
+}
+
+type Argon2Config struct {
+	Time    uint32 `mapstructure:"time"`
+	Memory  uint32 `mapstructure:"memory"` //KiB
+	Threads uint8  `mapstructure:"threads"`
+	KeyLen  uint32 `mapstructure:"key_len"`
+	SaltLen uint32 `mapstructure:"salt_len"`
+}
+
+//as configured in password section
+type HasherConfig struct {
+	Algorithm  string       `mapstructure:"algorithm"`
+	BcryptCost int          `mapstructure:"bcrypt_cost"`
+	Argon2     Argon2Config `mapstructure:"argon2"`
+	Pepper     string       `mapstructure:"pepper"` //server side secret mixed into every password
+}
+
+type passwordHasher struct {
+	cfg HasherConfig
+}
+
+var ErrPasswordMismatch = errors.New("password does not match")
+
+//used by AuthUser, replaced with SetPasswordHasher
+var hasher PasswordHasher = &passwordHasher{cfg: HasherConfig{Algorithm: HASH_BCRYPT, BcryptCost: bcrypt.DefaultCost}}
+
+func SetPasswordHasher(h PasswordHasher) {
+	hasher = h
+}
+
+//zero values fallback to defaults
+func NewPasswordHasher(cfg HasherConfig) (PasswordHasher, error) {
+	switch cfg.Algorithm {
+	case "", HASH_BCRYPT:
+		cfg.Algorithm = HASH_BCRYPT
+		if cfg.BcryptCost == 0 {
+			cfg.BcryptCost = bcrypt.DefaultCost
+		}
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost should be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case HASH_ARGON2ID:
+		a := &cfg.Argon2
+		if a.Time == 0 {
+			a.Time = 3
+		}
+		if a.Memory == 0 {
+			a.Memory = 64 * 1024
+		}
+		if a.Threads == 0 {
+			a.Threads = 2
+		}
+		if a.KeyLen == 0 {
+			a.KeyLen = 32
+		}
+		if a.SaltLen == 0 {
+			a.SaltLen = 16
+		}
+	default:
+		return nil, errors.New("unsupported password hash algorithm " + cfg.Algorithm)
+	}
+	return &passwordHasher{cfg: cfg}, nil
+}
+
+//bcrypt only uses first 72 bytes, mac output keeps peppered input short
+func (h *passwordHasher) pepper(pass string) string {
+	m := hmac.New(sha256.New, []byte(h.cfg.Pepper))
+	m.Write([]byte(pass))
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
+
+func (h *passwordHasher) Hash(pass string) (string, error) {
+	prefix := ""
+	if h.cfg.Pepper != "" {
+		pass = h.pepper(pass)
+		prefix = PEPPER_PREFIX
+	}
+	switch h.cfg.Algorithm {
+	case HASH_ARGON2ID:
+		a := h.cfg.Argon2
+		salt := make([]byte, a.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(pass), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+		return fmt.Sprintf("%s$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", prefix, argon2.Version, a.Memory, a.Time,
+			a.Threads, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), h.cfg.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return prefix + string(hash), nil
+	}
+}
+
+func (h *passwordHasher) Verify(hash string, pass string) error {
+	if strings.HasPrefix(hash, PEPPER_PREFIX) {
+		if h.cfg.Pepper == "" {
+			return errors.New("password hash needs pepper, none configured")
+		}
+		hash = strings.TrimPrefix(hash, PEPPER_PREFIX)
+		pass = h.pepper(pass)
+	}
+	if strings.HasPrefix(hash, "$argon2id$") {
+		a, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey([]byte(pass), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)); err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordMismatch
+	} else {
+		return err
+	}
+}
+
+func (h *passwordHasher) NeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, PEPPER_PREFIX) != (h.cfg.Pepper != "") {
+		return true
+	}
+	hash = strings.TrimPrefix(hash, PEPPER_PREFIX)
+	switch h.cfg.Algorithm {
+	case HASH_ARGON2ID:
+		a, _, _, err := decodeArgon2(hash)
+		return err != nil || a != h.cfg.Argon2
+	default:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.cfg.BcryptCost
+	}
+}
+
+//parses $argon2id$v=19$m=65536,t=3,p=2$salt$key
+func decodeArgon2(hash string) (Argon2Config, []byte, []byte, error) {
+	var a Argon2Config
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != HASH_ARGON2ID {
+		return a, nil, nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return a, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.Memory, &a.Time, &a.Threads); err != nil {
+		return a, nil, nil, errors.New("invalid argon2id params")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return a, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return a, nil, nil, err
+	}
+	a.SaltLen = uint32(len(salt))
+	a.KeyLen = uint32(len(key))
+	return a, salt, key, nil
+}
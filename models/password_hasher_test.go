@@ -0,0 +1,65 @@
+package models
+
+import (
+	"github.com/auth_backend/utils"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+//small params, only format & compatibility are tested here
+var testArgon2 = Argon2Config{Time: 1, Memory: 1024, Threads: 1, KeyLen: 16, SaltLen: 8}
+
+func TestHasherRoundTrip(t *testing.T) {
+	test_table := map[string]HasherConfig{
+		"bcrypt":        {Algorithm: HASH_BCRYPT, BcryptCost: bcrypt.MinCost},
+		"bcrypt_pepper": {Algorithm: HASH_BCRYPT, BcryptCost: bcrypt.MinCost, Pepper: "secret"},
+		"argon2":        {Algorithm: HASH_ARGON2ID, Argon2: testArgon2},
+		"argon2_pepper": {Algorithm: HASH_ARGON2ID, Argon2: testArgon2, Pepper: "secret"},
+	}
+	for name, cfg := range test_table {
+		h, err := NewPasswordHasher(cfg)
+		utils.Ok(t, err)
+		hash, err := h.Hash("nkktest")
+		utils.Ok(t, err)
+		utils.Assert(t, h.Verify(hash, "nkktest") == nil, "%s: password should match", name)
+		utils.Equals(t, ErrPasswordMismatch, h.Verify(hash, "nkktest2"))
+		utils.Assert(t, !h.NeedsRehash(hash), "%s: fresh hash should not need rehash", name)
+		utils.Equals(t, cfg.Pepper != "", strings.HasPrefix(hash, PEPPER_PREFIX))
+	}
+}
+
+func TestHasherNeedsRehash(t *testing.T) {
+	//hash from init.sql, created with bcrypt.MinCost
+	legacy := "$2a$04$p9zm7fqZVajMyiSE1bXgl.kJpt4Nw2mOzdAoY57Wp43NqVJ.kGMOq"
+
+	argon, err := NewPasswordHasher(HasherConfig{Algorithm: HASH_ARGON2ID, Argon2: testArgon2})
+	utils.Ok(t, err)
+	utils.Ok(t, argon.Verify(legacy, "nkktest"))
+	utils.Assert(t, argon.NeedsRehash(legacy), "bcrypt hash should be moved to argon2id")
+
+	stronger := testArgon2
+	stronger.Time = 2
+	argon2, err := NewPasswordHasher(HasherConfig{Algorithm: HASH_ARGON2ID, Argon2: stronger})
+	utils.Ok(t, err)
+	hash, err := argon.Hash("nkktest")
+	utils.Ok(t, err)
+	utils.Ok(t, argon2.Verify(hash, "nkktest"))
+	utils.Assert(t, argon2.NeedsRehash(hash), "argon2id hash with old params should be rehashed")
+
+	bc, err := NewPasswordHasher(HasherConfig{BcryptCost: bcrypt.MinCost + 1})
+	utils.Ok(t, err)
+	utils.Assert(t, bc.NeedsRehash(legacy), "bcrypt hash with lower cost should be rehashed")
+	utils.Assert(t, bc.NeedsRehash(hash), "argon2id hash should be moved to bcrypt")
+
+	peppered, err := NewPasswordHasher(HasherConfig{BcryptCost: bcrypt.MinCost, Pepper: "secret"})
+	utils.Ok(t, err)
+	utils.Ok(t, peppered.Verify(legacy, "nkktest"))
+	utils.Assert(t, peppered.NeedsRehash(legacy), "hash without pepper should be rehashed")
+	phash, err := peppered.Hash("nkktest")
+	utils.Ok(t, err)
+	utils.Assert(t, bc.Verify(phash, "nkktest") != nil, "peppered hash cannot be verified without pepper")
+
+	_, err = NewPasswordHasher(HasherConfig{Algorithm: "md5"})
+	utils.Assert(t, err != nil, "unsupported algorithm should fail")
+}
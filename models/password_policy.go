@@ -0,0 +1,169 @@
+package models
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	PASSWORD_MIN_LENGTH = 8
+	PASSWORD_HISTORY_TABLE = "password_history"
+)
+
+//as configured in password_policy section
+type PasswordPolicyConfig struct {
+	MinLength     int    `mapstructure:"min_length"`
+	RequireUpper  bool   `mapstructure:"require_upper"`
+	RequireLower  bool   `mapstructure:"require_lower"`
+	RequireDigit  bool   `mapstructure:"require_digit"`
+	RequireSymbol bool   `mapstructure:"require_symbol"`
+	DenyList      string `mapstructure:"deny_list"` //file with one common password per line
+	History       int    `mapstructure:"history"`   //last N passwords which cannot be reused
+	MaxAge        int    `mapstructure:"max_age"`   //days, password has to be changed after this
+}
+
+type PasswordPolicy struct {
+	cfg  PasswordPolicyConfig
+	deny map[string]bool
+}
+
+//used by SetPassword & Authenticate, replaced with SetPasswordPolicy
+var policy = &PasswordPolicy{cfg: PasswordPolicyConfig{MinLength: PASSWORD_MIN_LENGTH}}
+
+func SetPasswordPolicy(p *PasswordPolicy) {
+	policy = p
+}
+
+func NewPasswordPolicy(cfg PasswordPolicyConfig) (*PasswordPolicy, error) {
+	if cfg.MinLength <= 0 {
+		cfg.MinLength = PASSWORD_MIN_LENGTH
+	}
+	if cfg.History < 0 || cfg.MaxAge < 0 {
+		return nil, errors.New("password history & max age cannot be negative")
+	}
+	p := &PasswordPolicy{cfg: cfg, deny: make(map[string]bool)}
+	if cfg.DenyList != "" {
+		f, err := os.Open(cfg.DenyList)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if l := strings.TrimSpace(sc.Text()); l != "" {
+				p.deny[strings.ToLower(l)] = true
+			}
+		}
+		if err = sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+//returns violations as field errors, nil if password is acceptable
+func (p *PasswordPolicy) Check(pass string) map[string]string {
+	if pass == "" {
+		return map[string]string{"password": "required"}
+	}
+	var failed []string
+	if len([]rune(pass)) < p.cfg.MinLength {
+		failed = append(failed, "min")
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range pass {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.cfg.RequireUpper && !upper {
+		failed = append(failed, "upper")
+	}
+	if p.cfg.RequireLower && !lower {
+		failed = append(failed, "lower")
+	}
+	if p.cfg.RequireDigit && !digit {
+		failed = append(failed, "digit")
+	}
+	if p.cfg.RequireSymbol && !symbol {
+		failed = append(failed, "symbol")
+	}
+	if p.deny[strings.ToLower(pass)] {
+		failed = append(failed, "common")
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return map[string]string{"password": strings.Join(failed, ",")}
+}
+
+//true if password set at changed is older than max age
+func (p *PasswordPolicy) Expired(changed time.Time) bool {
+	if p.cfg.MaxAge <= 0 || changed.IsZero() {
+		return false
+	}
+	return time.Since(changed) > time.Duration(p.cfg.MaxAge)*24*time.Hour
+}
+
+//same shape as validation errors of SaveObj
+func fieldError(errmap map[string]string) error {
+	resp, _ := json.Marshal(errmap)
+	return errors.New(string(resp))
+}
+
+//true if pass matches current or one of the last N passwords of the user
+func (rm *DBRequestHandler) passwordReused(id int64, current string, pass string) (bool, error) {
+	if policy.cfg.History <= 0 {
+		return false, nil
+	}
+	hashes := []string{}
+	if current != "" {
+		hashes = append(hashes, current)
+	}
+	rows, err := rm.db.Query("select password from "+PASSWORD_HISTORY_TABLE+
+		" where auth_user_id=? order by id desc limit ?", id, policy.cfg.History)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h string
+		if err = rows.Scan(&h); err != nil {
+			return false, err
+		}
+		hashes = append(hashes, h)
+	}
+	for _, h := range hashes {
+		if hasher.Verify(h, pass) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//keeps only last N hashes of the user
+func (rm *DBRequestHandler) addPasswordHistory(ex dbExecer, id int64, hash string) error {
+	if policy.cfg.History <= 0 {
+		return nil
+	}
+	if _, err := ex.Exec("insert into "+PASSWORD_HISTORY_TABLE+"(auth_user_id, password) values(?,?)",
+		id, hash); err != nil {
+		return err
+	}
+	_, err := ex.Exec("delete from "+PASSWORD_HISTORY_TABLE+" where auth_user_id=? and id not in "+
+		"(select id from (select id from "+PASSWORD_HISTORY_TABLE+" where auth_user_id=? order by id desc limit ?) h)",
+		id, id, policy.cfg.History)
+	return err
+}
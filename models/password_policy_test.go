@@ -0,0 +1,54 @@
+package models
+
+import (
+	"github.com/auth_backend/utils"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	f, err := ioutil.TempFile("", "deny")
+	utils.Ok(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("Password123\n\nqwertyuiop1\n")
+	f.Close()
+
+	p, err := NewPasswordPolicy(PasswordPolicyConfig{MinLength: 10, RequireUpper: true, RequireLower: true,
+		RequireDigit: true, RequireSymbol: true, DenyList: f.Name()})
+	utils.Ok(t, err)
+
+	test_table := map[string]struct {
+		pass string
+		exp  map[string]string
+	}{
+		"empty":   {"", map[string]string{"password": "required"}},
+		"short":   {"Ab1!", map[string]string{"password": "min"}},
+		"classes": {"abcdefghijkl", map[string]string{"password": "upper,digit,symbol"}},
+		"common":  {"PASSWORD123", map[string]string{"password": "lower,symbol,common"}},
+		"unicode": {"Ünïcödé pässwörd 1", nil},
+		"ok":      {"Correct-Horse-9", nil},
+	}
+	for name, tc := range test_table {
+		act := p.Check(tc.pass)
+		utils.Assert(t, len(act) == len(tc.exp) && act["password"] == tc.exp["password"],
+			"%s: expected %v got %v", name, tc.exp, act)
+	}
+
+	_, err = NewPasswordPolicy(PasswordPolicyConfig{DenyList: f.Name() + ".missing"})
+	utils.Assert(t, err != nil, "missing deny list should fail")
+}
+
+func TestPasswordPolicyExpired(t *testing.T) {
+	p, err := NewPasswordPolicy(PasswordPolicyConfig{MaxAge: 30})
+	utils.Ok(t, err)
+	utils.Assert(t, !p.Expired(time.Now().Add(-29*24*time.Hour)), "29 days old password is valid")
+	utils.Assert(t, p.Expired(time.Now().Add(-31*24*time.Hour)), "31 days old password has expired")
+	utils.Assert(t, !p.Expired(time.Time{}), "unknown change time should not expire")
+
+	p, err = NewPasswordPolicy(PasswordPolicyConfig{})
+	utils.Ok(t, err)
+	utils.Assert(t, !p.Expired(time.Now().Add(-1000*24*time.Hour)), "passwords do not expire without max age")
+	utils.Equals(t, map[string]string{"password": "min"}, p.Check("1234567"))
+}
@@ -300,3 +300,152 @@ func cacheUserPermissions(au *AuthUser, allp []BasePermissionModel, rm *DBReques
 	return ps
 }
 
+
+func (tp *TablePermission) condition(pt string) *Condition {
+	switch pt {
+	case PERMISSION_R : return tp.Read
+	case PERMISSION_C : return tp.Create
+	case PERMISSION_U : return tp.Update
+	case PERMISSION_D : return tp.Delete
+	}
+	return nil
+}
+
+//conditions on different columns are and'ed, values of a column are or'ed
+//so other is within mine if it has all columns of mine with a subset of values
+func conditionCovers(mine *Condition, other *Condition) bool {
+	for col, _ := range *mine {
+		ovals, ok := (*other)[col]
+		if !ok {
+			return false
+		}
+		for _, ov := range ovals {
+			if !hasCUPermissionForCondition(col, ov, mine) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//Check that every access in scope is also given by p
+//used to validate that a user gives only the access which it has
+func (p *Permissions) Covers(scope *Permissions) error {
+	if scope == nil {
+		return nil
+	}
+	for table, stp := range scope.Ps {
+		var tp *TablePermission
+		if p != nil {
+			tp = p.Ps[table]
+		}
+		for _, pt := range []string{PERMISSION_R, PERMISSION_C, PERMISSION_U, PERMISSION_D} {
+			sc := stp.condition(pt)
+			if sc == nil {
+				continue
+			}
+			if tp == nil || tp.condition(pt) == nil || !conditionCovers(tp.condition(pt), sc) {
+				return errors.New(fmt.Sprintf("cannot give %s access on table %s", pt, table))
+			}
+		}
+	}
+	return nil
+}
+
+//returns false if no value can satisfy both conditions
+func intersectConditions(a *Condition, b *Condition) (Condition, bool) {
+	ret := Condition{}
+	for col, vals := range *a {
+		ret[col] = vals
+	}
+	for col, bvals := range *b {
+		if _, ok := ret[col]; !ok {
+			ret[col] = bvals
+			continue
+		}
+		var common []string
+		for _, v := range bvals {
+			if hasCUPermissionForCondition(col, v, a) {
+				common = append(common, v)
+			}
+		}
+		if len(common) == 0 {
+			return nil, false
+		}
+		ret[col] = common
+	}
+	return ret, true
+}
+
+//Access given by both p and scope
+//for example read on test_table intersected with read on test_table where s_value in (B)
+//gives read on test_table where s_value in (B)
+func (p *Permissions) Intersect(scope *Permissions) *Permissions {
+	ret := &Permissions{make(map[string]*TablePermission)}
+	if p == nil || scope == nil {
+		return ret
+	}
+	for table, stp := range scope.Ps {
+		tp, ok := p.Ps[table]
+		if !ok {
+			continue
+		}
+		for _, pt := range []string{PERMISSION_R, PERMISSION_C, PERMISSION_U, PERMISSION_D} {
+			if tp.condition(pt) == nil || stp.condition(pt) == nil {
+				continue
+			}
+			cond, ok := intersectConditions(tp.condition(pt), stp.condition(pt))
+			if !ok {
+				continue
+			}
+			if len(cond) == 0 {
+				ret.addPermission(table, pt, "", "")
+			}
+			for col, vals := range cond {
+				for _, v := range vals {
+					ret.addPermission(table, pt, col, v)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+//access of one kind on a table, no conditions means access to all rows
+type Access struct {
+	Allowed    bool      `json:"allowed"`
+	Conditions Condition `json:"conditions,omitempty"`
+}
+
+type TableAccess struct {
+	Create Access `json:"create"`
+	Read   Access `json:"read"`
+	Update Access `json:"update"`
+	Delete Access `json:"delete"`
+}
+
+func describeCondition(cond *Condition) Access {
+	if cond == nil {
+		return Access{}
+	}
+	return Access{Allowed: true, Conditions: *cond}
+}
+
+//Effective access per table in a form which can be shown to clients
+//for example read on test_table where s_value in (B, C) is
+// {"test_table": {"read": {"allowed": true, "conditions": {"s_value": ["B", "C"]}}, ...}}
+func (p *Permissions) Describe() map[string]TableAccess {
+	ret := make(map[string]TableAccess)
+	if p == nil {
+		return ret
+	}
+	for table, tp := range p.Ps {
+		ret[table] = TableAccess{
+			Create: describeCondition(tp.Create),
+			Read:   describeCondition(tp.Read),
+			Update: describeCondition(tp.Update),
+			Delete: describeCondition(tp.Delete),
+		}
+	}
+	return ret
+}
@@ -232,3 +232,101 @@ func TestValidatePermission(t *testing.T) {
 		utils.Equals(t, test.ua, ne)
 	}
 }
+
+func TestCoversPermission(t *testing.T) {
+	ps := Permissions{Ps:make(map[string]*TablePermission)}
+	ps.addPermission("all", PERMISSION_R,"", "")
+	ps.addPermission("all", PERMISSION_U,"", "")
+	ps.addPermission("ro_c", PERMISSION_R,"xc", "a")
+	ps.addPermission("ro_c", PERMISSION_R,"xc", "b")
+	ps.addPermission("ro_c", PERMISSION_R,"xi", "1")
+
+	test_table := map[string]struct{
+		covers bool
+		scope []ScopeEntry
+	} {
+		"1.1:all_r": {true, []ScopeEntry{{"all", "", "", PERMISSION_R}}},
+		"1.2:all_r_c": {true, []ScopeEntry{{"all", "xc", "b", PERMISSION_R}}},
+		"1.3:all_d": {false, []ScopeEntry{{"all", "", "", PERMISSION_D}}},
+		"1.4:noaccess": {false, []ScopeEntry{{"none", "", "", PERMISSION_R}}},
+		"2.1:ro_c": {true, []ScopeEntry{{"ro_c", "xc", "b", PERMISSION_R}, {"ro_c", "xi", "1", PERMISSION_R}}},
+		"2.2:ro_c_num": {true, []ScopeEntry{{"ro_c", "xc", "a", PERMISSION_R}, {"ro_c", "xi", "1.0", PERMISSION_R}}},
+		"2.3:ro_c_wider": {false, []ScopeEntry{{"ro_c", "", "", PERMISSION_R}}},
+		"2.4:ro_c_missing_col": {false, []ScopeEntry{{"ro_c", "xc", "a", PERMISSION_R}}},
+		"2.5:ro_c_other_val": {false, []ScopeEntry{{"ro_c", "xc", "z", PERMISSION_R}, {"ro_c", "xi", "1", PERMISSION_R}}},
+		"2.6:ro_c_extra_col": {true, []ScopeEntry{{"ro_c", "xc", "a", PERMISSION_R}, {"ro_c", "xi", "1", PERMISSION_R},
+			{"ro_c", "xf", "1.1", PERMISSION_R}}},
+	}
+
+	for k, test := range test_table {
+		fmt.Printf("Executing %s\n", k)
+		scope := &Permissions{Ps:make(map[string]*TablePermission)}
+		for _, se := range test.scope {
+			scope.addPermission(se.TableName, se.Permission, se.ColumnName, se.Value)
+		}
+		err := ps.Covers(scope)
+		utils.Assert(t, test.covers == (err == nil), "%s : %v", k, err)
+	}
+
+	var nop *Permissions
+	utils.Assert(t, nop.Covers(&Permissions{Ps:map[string]*TablePermission{"all": {Read: &Condition{}}}}) != nil,
+		"nil permissions should not cover anything")
+}
+
+func TestIntersectPermission(t *testing.T) {
+	ps := Permissions{Ps:make(map[string]*TablePermission)}
+	ps.addPermission("all", PERMISSION_R,"", "")
+	ps.addPermission("all", PERMISSION_C,"", "")
+	ps.addPermission("ro_c", PERMISSION_R,"xc", "a")
+	ps.addPermission("ro_c", PERMISSION_R,"xc", "b")
+
+	scope := Permissions{Ps:make(map[string]*TablePermission)}
+	scope.addPermission("all", PERMISSION_R,"xc", "b")
+	scope.addPermission("all", PERMISSION_D,"", "")
+	scope.addPermission("ro_c", PERMISSION_R,"xc", "b")
+	scope.addPermission("ro_c", PERMISSION_R,"xc", "z")
+	scope.addPermission("ro_c", PERMISSION_R,"xi", "1")
+	scope.addPermission("none", PERMISSION_R,"", "")
+
+	ip := ps.Intersect(&scope)
+
+	//read only where xc is b
+	a, b, c := ip.HasReadAccess("all")
+	utils.Equals(t, true, a)
+	utils.Assert(t, strings.Contains(b, "xc"), "A : %s", b)
+	utils.Equals(t, []interface{}{"b"}, *c)
+	a, _, _ = ip.HasDeleteAccess("all")
+	utils.Equals(t, false, a)
+	utils.Assert(t, ip.hasAccessUC("all", map[string]interface{}{"XC": "a"}, map[string]FieldInfo{"XC": {DBN:"xc"}},
+		PERMISSION_C) != nil, "create should not be given by scope")
+
+	//value z is not accessible to user, extra column of scope is kept
+	utils.Equals(t, &Condition{"xc": {"b"}, "xi": {"1"}}, ip.Ps["ro_c"].Read)
+
+	a, _, _ = ip.HasReadAccess("none")
+	utils.Equals(t, false, a)
+
+	//no common value means no access
+	scope2 := Permissions{Ps:make(map[string]*TablePermission)}
+	scope2.addPermission("ro_c", PERMISSION_R,"xc", "z")
+	a, _, _ = ps.Intersect(&scope2).HasReadAccess("ro_c")
+	utils.Equals(t, false, a)
+}
+
+func TestDescribePermission(t *testing.T) {
+	ps := Permissions{Ps:make(map[string]*TablePermission)}
+	ps.addPermission("test_table", PERMISSION_R,"s_value", "B")
+	ps.addPermission("test_table", PERMISSION_R,"s_value", "C")
+	ps.addPermission("test_table", PERMISSION_U,"", "")
+
+	d := ps.Describe()
+	utils.Equals(t, 1, len(d))
+	ta := d["test_table"]
+	utils.Equals(t, Access{Allowed: true, Conditions: Condition{"s_value": {"B", "C"}}}, ta.Read)
+	utils.Equals(t, Access{Allowed: true, Conditions: Condition{}}, ta.Update)
+	utils.Equals(t, Access{}, ta.Create)
+	utils.Equals(t, Access{}, ta.Delete)
+
+	var nop *Permissions
+	utils.Equals(t, 0, len(nop.Describe()))
+}
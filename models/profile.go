@@ -0,0 +1,141 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/go-playground/validator.v9"
+	"strings"
+)
+
+//fields of auth_user users can change on their own account, email is changed only after the new one is verified
+var SELF_UPDATE_FIELDS = map[string]bool{"username": true, "email": true}
+
+//updates own account of the user without checking permissions on auth_user
+//only SELF_UPDATE_FIELDS can be changed, ro & uq flags of the fields are still respected
+func (rm *DBRequestHandler) UpdateSelf(id int64, data []byte) (*AuthUser, error) {
+	au, err := rm.GetAuthUser(id)
+	if err != nil {
+		return nil, err
+	}
+	var kvp map[string]interface{}
+	if err = json.Unmarshal(data, &kvp); err != nil {
+		return nil, err
+	}
+	if len(kvp) == 0 {
+		return nil, FORM_ERROR
+	}
+	t_rm := rm.queryBuilders[rm.auth_table]
+	fis := t_rm.GetFieldInfo()
+	errmap := make(map[string]string)
+	for k := range kvp {
+		if !SELF_UPDATE_FIELDS[k] {
+			errmap[k] = "not_allowed"
+		}
+	}
+	//username of a directory or saml user decides which identity it is linked with
+	if _, ok := kvp["username"]; ok && au.ExternallyManaged() {
+		errmap["username"] = "managed"
+	}
+	if len(errmap) > 0 {
+		return nil, fieldError(errmap)
+	}
+	if err = validateFields(&kvp, &fis, true); err != nil {
+		return nil, err
+	}
+
+	upd := &AuthUser{}
+	if err = json.Unmarshal(data, upd); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(kvp))
+	for _, fi := range fis {
+		if _, ok := kvp[fi.Json]; ok {
+			names = append(names, fi.FN)
+		}
+	}
+	if err = rm.validate.StructPartial(upd, names...); err != nil {
+		if verrs, ok := err.(validator.ValidationErrors); ok {
+			for _, e := range verrs {
+				for _, fi := range fis {
+					if fi.FN == e.Field() {
+						errmap[fi.Json] = e.Tag()
+					}
+				}
+			}
+			return nil, fieldError(errmap)
+		}
+		return nil, err
+	}
+
+	//values differing only in case would be found as duplicates of the user itself
+	uq := make(map[string]interface{})
+	if _, ok := kvp["username"]; ok && !strings.EqualFold(upd.Username, au.Username) {
+		uq["username"] = upd.Username
+	}
+	if _, ok := kvp["email"]; ok && !strings.EqualFold(upd.Email, au.Email) {
+		uq["email"] = upd.Email
+	}
+	if err = validateUnique(rm.db, t_rm, &uq, rm.orgcol, au.OrgId); err != nil {
+		return nil, err
+	}
+	q, params := buildUpdateQuery(kvp, fis)
+	if q == "" {
+		return au, nil
+	}
+	q = fmt.Sprintf("update %s set %s where id=?", rm.auth_table, q)
+	params = append(params, id)
+	log.Debug("Update: "+q)
+	if _, err = rm.db.Exec(q, params...); err != nil {
+		return nil, err
+	}
+	log.Infof("User %d updated own fields", id)
+	return rm.GetAuthUser(id)
+}
+
+//users linked with a directory or saml identity provider
+func (au *AuthUser) ExternallyManaged() bool {
+	return au.LdapDn != "" || au.SamlId != ""
+}
+
+//checks the password of a logged in user before a sensitive change of its account
+func (rm *DBRequestHandler) CheckPassword(id int64, pass string) (*AuthUser, error) {
+	au, err := rm.GetAuthUser(id)
+	if err != nil {
+		return nil, err
+	}
+	//service accounts & users provisioned without password cannot have one
+	if au.AccountType == ACCOUNT_SERVICE || au.Password == "" {
+		return nil, INVALID_CREDENTIALS
+	}
+	if err = au.validatePassword(pass); err != nil {
+		log.Debugf("Wrong current password for user %d", id)
+		return nil, INVALID_CREDENTIALS
+	}
+	return au, nil
+}
+
+//new email of the user has to be valid & not used by another user
+func (rm *DBRequestHandler) CheckNewEmail(id int64, email string) error {
+	if err := rm.validate.Var(email, "required,email"); err != nil {
+		return fieldError(map[string]string{"email": "email"})
+	}
+	var count int
+	if err := rm.db.QueryRow("select count(*) from "+rm.auth_table+" where email=? and id<>?", email, id).Scan(&count); err != nil {
+		return err
+	} else if count > 0 {
+		return USER_ALREADY_EXISTS
+	}
+	return nil
+}
+
+//sets a new password after checking the current one, password policy applies as for reset
+func (rm *DBRequestHandler) ChangePassword(id int64, current string, pass string) error {
+	if _, err := rm.CheckPassword(id, current); err != nil {
+		return err
+	}
+	if pass == current {
+		return fieldError(map[string]string{"password": "reused"})
+	}
+	return rm.SetPassword(id, pass)
+}
@@ -135,6 +135,7 @@ type FieldInfo struct {
 	DBN         string
 	RO          bool
 	UQ 			bool
+	UQOrg		bool //unique only within an org
 	NotReadable bool
 	IsPassword  bool
 	IsRef		bool
@@ -214,6 +215,7 @@ func initFieldInfo(table BaseModel) (map[string]FieldInfo, string, string) {
 				switch f {
 				case "ro" : fi.RO = true
 				case "uq" : fi.UQ = true
+				case "uq_org" : fi.UQOrg = true
 				case "noread" : fi.NotReadable = true
 				case "password" : fi.IsPassword = true
 				case "ref" : {
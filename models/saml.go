@@ -0,0 +1,128 @@
+package models
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	SAML_CONFIG_TABLE = "saml_config"
+)
+
+//users with the value in role_attr get the role
+type SamlRoleMap struct {
+	Value string `json:"value"`
+	Role  int64  `json:"role"`
+}
+
+//identity provider of an org, users of the org login through it with SAML SSO
+type SamlConfig struct {
+	OrgId             int64         `json:"org_id"`
+	Enabled           bool          `json:"enabled"`
+	IdpEntityId       string        `json:"idp_entity_id"`
+	IdpSsoUrl         string        `json:"idp_sso_url"`
+	IdpCert           string        `json:"idp_cert"`      //PEM, assertions have to be signed with its key
+	UsernameAttr      string        `json:"username_attr"` //NameID is used if empty
+	EmailAttr         string        `json:"email_attr"`
+	RoleAttr          string        `json:"role_attr"`
+	RoleMap           []SamlRoleMap `json:"role_map"`     //first entry matching any value of role_attr decides the role
+	DefaultRole       int64         `json:"default_role"` //for users without a mapped value, 0 denies them
+	AllowIdpInitiated bool          `json:"allow_idp_initiated"`
+	DateAdd           time.Time     `json:"date_add"`
+	DateUpd           time.Time     `json:"date_upd"`
+}
+
+//certificate of the identity provider
+func (c *SamlConfig) Certificate() (*x509.Certificate, error) {
+	b, _ := pem.Decode([]byte(c.IdpCert))
+	if b == nil || b.Type != "CERTIFICATE" {
+		return nil, errors.New("idp_cert is not a PEM certificate")
+	}
+	return x509.ParseCertificate(b.Bytes)
+}
+
+//returns nil if org has no saml config
+func (rm *DBRequestHandler) GetSamlConfig(org int64) (*SamlConfig, error) {
+	c := &SamlConfig{}
+	var roleMap string
+	err := rm.db.QueryRow("select org_id, enabled, idp_entity_id, idp_sso_url, idp_cert, username_attr, email_attr, "+
+		"role_attr, role_map, default_role, allow_idp_initiated, date_add, date_upd from "+SAML_CONFIG_TABLE+
+		" where org_id=?", org).Scan(&c.OrgId, &c.Enabled, &c.IdpEntityId, &c.IdpSsoUrl, &c.IdpCert, &c.UsernameAttr,
+		&c.EmailAttr, &c.RoleAttr, &roleMap, &c.DefaultRole, &c.AllowIdpInitiated, &c.DateAdd, &c.DateUpd)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if roleMap != "" {
+		if err = json.Unmarshal([]byte(roleMap), &c.RoleMap); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//only SU can configure the identity provider of an org, existing config is replaced
+func (rm *DBRequestHandler) SaveSamlConfig(ud *UserData, c *SamlConfig) (*SamlConfig, error) {
+	if ud == nil || !rm.isSU(ud) {
+		return nil, UNAUTHORIZED
+	}
+	if _, err := rm.GetOrg(c.OrgId); err != nil {
+		return nil, INVALID_ENTRY
+	}
+	errmap := make(map[string]string)
+	if c.IdpEntityId == "" {
+		errmap["idp_entity_id"] = "required"
+	}
+	if err := rm.validate.Var(c.IdpSsoUrl, "required,url"); err != nil {
+		errmap["idp_sso_url"] = "url"
+	}
+	if _, err := c.Certificate(); err != nil {
+		errmap["idp_cert"] = "invalid"
+	}
+	if c.EmailAttr == "" {
+		c.EmailAttr = "email"
+	}
+	if c.DefaultRole > 0 {
+		if _, err := rm.GetUserRole(c.DefaultRole); err != nil {
+			errmap["default_role"] = "invalid"
+		}
+	}
+	for _, m := range c.RoleMap {
+		if m.Value == "" || m.Role <= 0 {
+			errmap["role_map"] = "invalid"
+		} else if _, err := rm.GetUserRole(m.Role); err != nil {
+			errmap["role_map"] = "invalid"
+		}
+	}
+	if len(c.RoleMap) > 0 && c.RoleAttr == "" {
+		errmap["role_attr"] = "required"
+	}
+	if len(errmap) > 0 {
+		return nil, fieldError(errmap)
+	}
+	if c.RoleMap == nil {
+		c.RoleMap = []SamlRoleMap{}
+	}
+	roleMap, err := json.Marshal(c.RoleMap)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = rm.db.Exec("insert into "+SAML_CONFIG_TABLE+" (org_id, enabled, idp_entity_id, idp_sso_url, idp_cert, "+
+		"username_attr, email_attr, role_attr, role_map, default_role, allow_idp_initiated) values (?,?,?,?,?,?,?,?,?,?,?) "+
+		"on duplicate key update enabled=values(enabled), idp_entity_id=values(idp_entity_id), "+
+		"idp_sso_url=values(idp_sso_url), idp_cert=values(idp_cert), username_attr=values(username_attr), "+
+		"email_attr=values(email_attr), role_attr=values(role_attr), role_map=values(role_map), "+
+		"default_role=values(default_role), allow_idp_initiated=values(allow_idp_initiated)",
+		c.OrgId, c.Enabled, c.IdpEntityId, c.IdpSsoUrl, c.IdpCert, c.UsernameAttr, c.EmailAttr, c.RoleAttr,
+		string(roleMap), c.DefaultRole, c.AllowIdpInitiated); err != nil {
+		return nil, err
+	}
+	log.Infof("SAML config of org %d saved by user %d", c.OrgId, ud.Id)
+	return rm.GetSamlConfig(c.OrgId)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	MSG_WELCOME        = "welcome"
+	MSG_SET_PASSWORD   = "set_password"
+	MSG_RESET_PASSWORD = "reset_password"
+	MSG_VERIFICATION   = "verification"
+	MSG_INVITATION     = "invitation"
+	MSG_MAGIC_LINK     = "magic_link"
+	MSG_EMAIL_CHANGE   = "email_change"
+)
+
+//message sent to a user, Type decides the template used
+type Message struct {
+	Type     string
+	To       string
+	Username string
+	Org      string //set for invitations
+	Token    string
+	Link     string
+}
+
+//Implement this to deliver account messages (tokens, welcome etc) to user
+type Notifier interface {
+	Notify(msg *Message) error
+}
+
+var defaultTemplates = map[string][2]string{
+	MSG_WELCOME: {"Welcome {{.Username}}",
+		"Hi {{.Username}},\n\nYour account is now active.\n"},
+	MSG_SET_PASSWORD: {"Set your password",
+		"Hi {{.Username}},\n\nAn account has been created for you. Set your password using the link below\n{{.Link}}\n\nToken : {{.Token}}\n"},
+	MSG_RESET_PASSWORD: {"Reset your password",
+		"Hi {{.Username}},\n\nUse the link below to reset your password. If you did not ask for it, ignore this mail.\n{{.Link}}\n\nToken : {{.Token}}\n"},
+	MSG_VERIFICATION: {"Verify your account",
+		"Hi {{.Username}},\n\nVerify your account using the link below\n{{.Link}}\n\nToken : {{.Token}}\n"},
+	MSG_MAGIC_LINK: {"Your login link",
+		"Hi {{.Username}},\n\nUse the link below to login. It can be used only once. If you did not ask for it, ignore this mail.\n{{.Link}}\n\nToken : {{.Token}}\n"},
+	MSG_EMAIL_CHANGE: {"Confirm your new email",
+		"Hi {{.Username}},\n\nConfirm this email for your account using the link below. If you did not ask for it, ignore this mail.\n{{.Link}}\n\nToken : {{.Token}}\n"},
+	MSG_INVITATION: {"You are invited to {{.Org}}",
+		"Hi,\n\nYou have been invited to join {{.Org}}. Choose a username & password using the link below\n{{.Link}}\n\nToken : {{.Token}}\n"},
+}
+
+//subject & body templates for each message type
+type MessageTemplates struct {
+	subject map[string]*template.Template
+	body    map[string]*template.Template
+	baseUrl string
+}
+
+//Loads templates from dir, <type>.subject and <type>.body override the defaults
+//baseUrl is used to create the link sent to user : <baseUrl>/<type>?token=<token>
+func NewMessageTemplates(dir string, baseUrl string) (*MessageTemplates, error) {
+	mt := &MessageTemplates{subject: make(map[string]*template.Template),
+		body: make(map[string]*template.Template), baseUrl: strings.TrimSuffix(baseUrl, "/")}
+	for typ, def := range defaultTemplates {
+		sub, body := def[0], def[1]
+		if dir != "" {
+			if b, err := ioutil.ReadFile(filepath.Join(dir, typ+".subject")); err == nil {
+				sub = strings.TrimSpace(string(b))
+			}
+			if b, err := ioutil.ReadFile(filepath.Join(dir, typ+".body")); err == nil {
+				body = string(b)
+			}
+		}
+		var err error
+		if mt.subject[typ], err = template.New(typ + ".subject").Parse(sub); err != nil {
+			return nil, errors.Wrap(err, "invalid subject template for "+typ)
+		}
+		if mt.body[typ], err = template.New(typ + ".body").Parse(body); err != nil {
+			return nil, errors.Wrap(err, "invalid body template for "+typ)
+		}
+	}
+	return mt, nil
+}
+
+//returns subject & body for the message
+func (mt *MessageTemplates) Render(msg *Message) (string, string, error) {
+	st, ok := mt.subject[msg.Type]
+	if !ok {
+		return "", "", errors.New("no template for message type " + msg.Type)
+	}
+	if msg.Link == "" && msg.Token != "" && mt.baseUrl != "" {
+		msg.Link = fmt.Sprintf("%s/%s?token=%s", mt.baseUrl, msg.Type, msg.Token)
+	}
+	var sub, body bytes.Buffer
+	if err := st.Execute(&sub, msg); err != nil {
+		return "", "", err
+	}
+	if err := mt.body[msg.Type].Execute(&body, msg); err != nil {
+		return "", "", err
+	}
+	return sub.String(), body.String(), nil
+}
+
+//header values come from templates & user data, line breaks would add headers
+func headerValue(v string) string {
+	return strings.NewReplacer("\r", "", "\n", " ").Replace(v)
+}
+
+func buildMail(from string, to string, subject string, body string) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%s",
+		headerValue(from), headerValue(to), mime.QEncoding.Encode("utf-8", headerValue(subject)),
+		time.Now().Format(time.RFC1123Z), body))
+}
+
+//sends messages through a smtp server
+type SMTPNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	tmpl *MessageTemplates
+}
+
+func NewSMTPNotifier(host string, port int, user string, pass string, from string, tmpl *MessageTemplates) *SMTPNotifier {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, pass, host)
+	}
+	return &SMTPNotifier{addr: fmt.Sprintf("%s:%d", host, port), auth: auth, from: from, tmpl: tmpl}
+}
+
+func (n *SMTPNotifier) Notify(msg *Message) error {
+	if msg.To == "" {
+		return errors.New("no email address to send " + msg.Type)
+	}
+	sub, body, err := n.tmpl.Render(msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(n.addr, n.auth, n.from, []string{msg.To}, buildMail(n.from, msg.To, sub, body))
+}
+
+//writes messages as files in a directory, to be used for local testing
+type OutboxNotifier struct {
+	dir  string
+	from string
+	tmpl *MessageTemplates
+}
+
+func NewOutboxNotifier(dir string, from string, tmpl *MessageTemplates) (*OutboxNotifier, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &OutboxNotifier{dir: dir, from: from, tmpl: tmpl}, nil
+}
+
+func (n *OutboxNotifier) Notify(msg *Message) error {
+	sub, body, err := n.tmpl.Render(msg)
+	if err != nil {
+		return err
+	}
+	f := filepath.Join(n.dir, fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), msg.Type))
+	log.Debugf("Writing %s for %s to %s", msg.Type, msg.To, f)
+	return ioutil.WriteFile(f, buildMail(n.from, msg.To, sub, body), 0600)
+}
+
+//only logs the message, used when no notifier is configured
+type logNotifier struct{}
+
+func (n logNotifier) Notify(msg *Message) error {
+	log.Debugf("notifier not configured, %s for %s token=%s", msg.Type, msg.To, msg.Token)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/auth_backend/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMessageTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	utils.Ok(t, err)
+	defer os.RemoveAll(dir)
+	utils.Ok(t, ioutil.WriteFile(filepath.Join(dir, MSG_WELCOME+".subject"), []byte("Hello {{.Username}}\n"), 0600))
+	utils.Ok(t, ioutil.WriteFile(filepath.Join(dir, MSG_WELCOME+".body"), []byte("Body of {{.Username}}"), 0600))
+
+	mt, err := NewMessageTemplates(dir, "https://app.example.org/")
+	utils.Ok(t, err)
+	sub, body, err := mt.Render(&Message{Type: MSG_WELCOME, Username: "alice"})
+	utils.Ok(t, err)
+	utils.Equals(t, "Hello alice", sub)
+	utils.Equals(t, "Body of alice", body)
+
+	//link is built from base url when not given
+	msg := &Message{Type: MSG_RESET_PASSWORD, Username: "alice", Token: "tok"}
+	sub, body, err = mt.Render(msg)
+	utils.Ok(t, err)
+	utils.Equals(t, "Reset your password", sub)
+	utils.Equals(t, "https://app.example.org/reset_password?token=tok", msg.Link)
+	utils.Assert(t, strings.Contains(body, msg.Link) && strings.Contains(body, "Token : tok"), "body has link & token : %s", body)
+
+	msg = &Message{Type: MSG_INVITATION, Org: "Acme", Token: "tok", Link: "https://other.example.org/join"}
+	sub, body, err = mt.Render(msg)
+	utils.Ok(t, err)
+	utils.Equals(t, "You are invited to Acme", sub)
+	utils.Assert(t, strings.Contains(body, "https://other.example.org/join"), "given link is kept : %s", body)
+
+	_, _, err = mt.Render(&Message{Type: "unknown"})
+	utils.Assert(t, err != nil, "unknown type should fail")
+
+	utils.Ok(t, ioutil.WriteFile(filepath.Join(dir, MSG_WELCOME+".body"), []byte("{{.Username"), 0600))
+	_, err = NewMessageTemplates(dir, "")
+	utils.Assert(t, err != nil, "invalid template should fail")
+}
+
+func TestBuildMail(t *testing.T) {
+	mail := string(buildMail("noreply@example.org", "alice@example.org\r\nBcc: eve@example.org",
+		"You are invited to Acme\r\nBcc: eve@example.org", "body\r\n"))
+	head := mail[:strings.Index(mail, "\r\n\r\n")]
+	for _, l := range strings.Split(head, "\r\n") {
+		utils.Assert(t, !strings.HasPrefix(l, "Bcc:"), "header injected : %q", head)
+	}
+	utils.Assert(t, strings.Contains(head, "\r\nSubject: You are invited to Acme Bcc: eve@example.org\r\n"), "subject on one line : %q", head)
+	utils.Assert(t, strings.HasSuffix(mail, "\r\n\r\nbody\r\n"), "body is kept : %q", mail)
+
+	mail = string(buildMail("noreply@example.org", "alice@example.org", "Invité", ""))
+	utils.Assert(t, strings.Contains(mail, "\r\nSubject: =?utf-8?q?Invit=C3=A9?=\r\n"), "non ascii subject is encoded : %q", mail)
+}
+
+func TestOutboxNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	utils.Ok(t, err)
+	defer os.RemoveAll(dir)
+	mt, err := NewMessageTemplates("", "https://app.example.org")
+	utils.Ok(t, err)
+	n, err := NewOutboxNotifier(filepath.Join(dir, "mails"), "noreply@example.org", mt)
+	utils.Ok(t, err)
+
+	utils.Ok(t, n.Notify(&Message{Type: MSG_MAGIC_LINK, To: "alice@example.org", Username: "alice", Token: "tok"}))
+	files, err := filepath.Glob(filepath.Join(dir, "mails", "*_"+MSG_MAGIC_LINK+".eml"))
+	utils.Ok(t, err)
+	utils.Equals(t, 1, len(files))
+	b, err := ioutil.ReadFile(files[0])
+	utils.Ok(t, err)
+	mail := string(b)
+	utils.Assert(t, strings.HasPrefix(mail, "From: noreply@example.org\r\nTo: alice@example.org\r\nSubject: Your login link\r\n"),
+		"headers : %q", mail)
+	utils.Assert(t, strings.Contains(mail, "https://app.example.org/magic_link?token=tok"), "link in body : %q", mail)
+
+	utils.Assert(t, n.Notify(&Message{Type: "unknown", To: "alice@example.org"}) != nil, "unknown type should fail")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_OAUTH_STATE = "OAUTH_STATE:"
+	REDIS_OAUTH_EXPIRY = 10 //minutes
+	OAUTH_TIMEOUT = 10 //seconds
+)
+
+//identity provider as configured in oauth.providers
+//endpoints are configurable, so any OIDC/OAuth2 provider (or a local mock) can be used
+type OAuthProviderConfig struct {
+	Name         string   `mapstructure:"name"`
+	ClientId     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	AuthUrl      string   `mapstructure:"auth_url"`
+	TokenUrl     string   `mapstructure:"token_url"`
+	UserinfoUrl  string   `mapstructure:"userinfo_url"`
+	RedirectUrl  string   `mapstructure:"redirect_url"`
+	Scopes       []string `mapstructure:"scopes"`
+	Column       string   `mapstructure:"column"`       //google_id or facebook_id
+	IdField      string   `mapstructure:"id_field"`     //user id in userinfo response, sub by default
+	TrustEmail   bool     `mapstructure:"trust_email"`  //link by email even if provider does not mark it verified
+	CreateUsers  bool     `mapstructure:"create_users"` //create user in signup org/role if none is linked
+}
+
+type OAuthProvider struct {
+	cfg  OAuthProviderConfig
+	conf *oauth2.Config
+}
+
+//saved till the provider redirects back
+type oauthState struct {
+	Provider string
+	Verifier string
+}
+
+//user as returned by userinfo endpoint
+type oauthIdentity struct {
+	Id            string
+	Email         string
+	EmailVerified bool
+}
+
+func NewOAuthProviders(cfgs []OAuthProviderConfig) (map[string]*OAuthProvider, error) {
+	providers := make(map[string]*OAuthProvider)
+	for _, c := range cfgs {
+		if c.Name == "" {
+			return nil, errors.New("oauth provider without name")
+		}
+		if _, ok := providers[c.Name]; ok {
+			return nil, errors.New("duplicate oauth provider " + c.Name)
+		}
+		if !models.EXTERNAL_ID_COLUMNS[c.Column] {
+			return nil, errors.New("invalid column for oauth provider " + c.Name)
+		}
+		if c.ClientId == "" || c.AuthUrl == "" || c.TokenUrl == "" || c.UserinfoUrl == "" || c.RedirectUrl == "" {
+			return nil, errors.New("client_id, auth_url, token_url, userinfo_url & redirect_url are required for " + c.Name)
+		}
+		if c.IdField == "" {
+			c.IdField = "sub"
+		}
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{"openid", "email", "profile"}
+		}
+		providers[c.Name] = &OAuthProvider{cfg: c, conf: &oauth2.Config{
+			ClientID:     c.ClientId,
+			ClientSecret: c.ClientSecret,
+			Endpoint:     oauth2.Endpoint{AuthURL: c.AuthUrl, TokenURL: c.TokenUrl},
+			RedirectURL:  c.RedirectUrl,
+			Scopes:       c.Scopes,
+		}}
+	}
+	return providers, nil
+}
+
+func oauthContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), OAUTH_TIMEOUT*time.Second)
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Timeout: OAUTH_TIMEOUT * time.Second}), cancel
+}
+
+//url of provider to which user is redirected, state & pkce verifier are kept in session store
+func (ac *AuthController) oauthRedirect(name string) (string, error) {
+	p, ok := ac.oauth[name]
+	if !ok {
+		return "", models.INVALID_ENTRY
+	}
+	state, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	st := &oauthState{Provider: name, Verifier: oauth2.GenerateVerifier()}
+	sjson, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	k := fmt.Sprintf("%s%s", REDIS_OAUTH_STATE, state)
+	if err = ac.store.Set(k, sjson, REDIS_OAUTH_EXPIRY*time.Minute); err != nil {
+		return "", err
+	}
+	return p.conf.AuthCodeURL(state, oauth2.S256ChallengeOption(st.Verifier)), nil
+}
+
+//exchanges the code, finds or creates the linked user & starts a session
+func (ac *AuthController) oauthCallback(name string, code string, state string, client *SessionMeta) (*SessionTokens, *MFAChallenge, error) {
+	p, ok := ac.oauth[name]
+	if !ok {
+		return nil, nil, models.INVALID_ENTRY
+	}
+	k := fmt.Sprintf("%s%s", REDIS_OAUTH_STATE, state)
+	str, err := ac.store.Get(k)
+	if err == KEY_NOT_FOUND {
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	} else if err != nil {
+		return nil, nil, err
+	}
+	//state can be used only once
+	if n, err := ac.store.Del(k); err != nil {
+		return nil, nil, err
+	} else if n == 0 {
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+	st := &oauthState{}
+	if err = json.Unmarshal([]byte(str), st); err != nil {
+		return nil, nil, err
+	}
+	if st.Provider != name {
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+
+	ctx, cancel := oauthContext()
+	defer cancel()
+	tok, err := p.conf.Exchange(ctx, code, oauth2.VerifierOption(st.Verifier))
+	if err != nil {
+		log.Errorf("oauth code exchange failed for %s : %s", name, err.Error())
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+	ident, err := p.userinfo(ctx, tok)
+	if err != nil {
+		log.Errorf("oauth userinfo failed for %s : %s", name, err.Error())
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+	au, err := ac.externalUser(p, ident)
+	if err != nil {
+		return nil, nil, err
+	}
+	ud, err := ac.buildUserData(au.GetId())
+	if err != nil {
+		return nil, nil, err
+	}
+	return ac.startSession(ud, client)
+}
+
+func (p *OAuthProvider) userinfo(ctx context.Context, tok *oauth2.Token) (*oauthIdentity, error) {
+	resp, err := p.conf.Client(ctx, tok).Get(p.cfg.UserinfoUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo returned %d", resp.StatusCode)
+	}
+	var info map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	ident := &oauthIdentity{}
+	switch id := info[p.cfg.IdField].(type) {
+	case string:
+		ident.Id = id
+	case float64:
+		ident.Id = fmt.Sprintf("%.0f", id)
+	}
+	if ident.Id == "" {
+		return nil, errors.New("userinfo has no " + p.cfg.IdField)
+	}
+	ident.Email, _ = info["email"].(string)
+	ident.Email = strings.ToLower(ident.Email)
+	ident.EmailVerified, _ = info["email_verified"].(bool)
+	return ident, nil
+}
+
+//user linked with the identity, links by verified email or creates one if allowed
+func (ac *AuthController) externalUser(p *OAuthProvider, ident *oauthIdentity) (*models.AuthUser, error) {
+	au, err := ac.dbHandler.FindExternalUser(p.cfg.Column, ident.Id)
+	if err != nil || au != nil {
+		return au, err
+	}
+	if ident.Email != "" && (ident.EmailVerified || p.cfg.TrustEmail) {
+		if au, err = ac.dbHandler.FindUserByEmail(ident.Email); err != nil {
+			return nil, err
+		} else if au != nil && strings.EqualFold(au.Email, ident.Email) {
+			//pending signups may not own the email, service & directory users are never linked
+			if au.CheckStatus() != nil || au.AccountType == models.ACCOUNT_SERVICE || au.ExternallyManaged() {
+				log.Warnf("%s identity not linked with user %d, user cannot be linked", p.cfg.Name, au.GetId())
+				return nil, models.EXTERNAL_USER_NOT_FOUND
+			}
+			if err = ac.dbHandler.LinkExternalUser(au.GetId(), p.cfg.Column, ident.Id); err != nil {
+				return nil, err
+			}
+			return au, nil
+		}
+	}
+	if !p.cfg.CreateUsers {
+		return nil, models.EXTERNAL_USER_NOT_FOUND
+	}
+	au, err = ac.dbHandler.CreateExternalUser(p.cfg.Column, ident.Id, "", ident.Email, ac.signupOrg, ac.signupRole)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("User %d created through %s", au.GetId(), p.cfg.Name)
+	ac.notify(MSG_WELCOME, au, "")
+	return au, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/auth_backend/models"
+	"strconv"
+)
+
+const (
+	REDIS_ROLE_PERM_VERSION = "ROLE_PERM_VERSION:"
+	REDIS_USER_PERM_VERSION = "USER_PERM_VERSION:"
+)
+
+//sessions created before this change will reload their permissions
+func (ac *AuthController) RoleChanged(id int64) {
+	if _, err := ac.store.Incr(fmt.Sprintf("%s%d", REDIS_ROLE_PERM_VERSION, id)); err != nil {
+		log.Errorf("Unable to update permission version of role %d : %s", id, err.Error())
+	}
+}
+
+//sessions created before this change will reload their permissions
+func (ac *AuthController) UserChanged(id int64) {
+	if _, err := ac.store.Incr(fmt.Sprintf("%s%d", REDIS_USER_PERM_VERSION, id)); err != nil {
+		log.Errorf("Unable to update permission version of user %d : %s", id, err.Error())
+	}
+}
+
+//current permission version of role & user
+func (ac *AuthController) permVersions(role int64, user int64) (int64, int64, error) {
+	vals, err := ac.store.MGet(fmt.Sprintf("%s%d", REDIS_ROLE_PERM_VERSION, role),
+		fmt.Sprintf("%s%d", REDIS_USER_PERM_VERSION, user))
+	if err != nil {
+		return 0, 0, err
+	}
+	var ver [2]int64
+	for i, v := range vals {
+		if v == nil {
+			continue
+		}
+		if ver[i], err = strconv.ParseInt(fmt.Sprintf("%v", v), 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return ver[0], ver[1], nil
+}
+
+//creates user data with the versions of permissions it was built from
+//versions are read before the user is loaded, so a change in between only causes another reload
+func (ac *AuthController) buildUserData(id int64) (*models.UserData, error) {
+	_, uv, err := ac.permVersions(0, id)
+	if err != nil {
+		return nil, err
+	}
+	au, perms, err := ac.dbHandler.LoadUser(id)
+	if err != nil {
+		return nil, err
+	}
+	rv, _, err := ac.permVersions(au.UserRoleId, id)
+	if err != nil {
+		return nil, err
+	}
+	return &models.UserData{Id: au.GetId(), Org_id: au.GetOrgId(), P: perms, RoleId: au.UserRoleId, Rv: rv, Uv: uv}, nil
+}
+
+//sets the versions for the permissions loaded during login
+func (ac *AuthController) setPermVersions(ud *models.UserData) error {
+	rv, uv, err := ac.permVersions(ud.RoleId, ud.Id)
+	if err != nil {
+		return err
+	}
+	ud.Rv, ud.Uv = rv, uv
+	return nil
+}
+
+//returns user data with permissions reloaded if role or user permissions changed after they were cached
+func (ac *AuthController) currentUserData(ud *models.UserData) (*models.UserData, bool, error) {
+	rv, uv, err := ac.permVersions(ud.RoleId, ud.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	if rv == ud.Rv && uv == ud.Uv {
+		return ud, false, nil
+	}
+	log.Debugf("Permissions of user %d changed, reloading", ud.Id)
+	nud, err := ac.buildUserData(ud.Id)
+	if err != nil {
+		//user removed, it should not be able to use its sessions anymore
+		log.Error(err)
+		return nil, false, models.USER_NOT_AUTHENTICATED
+	}
+	nud.Uuid = ud.Uuid
+	nud.Family = ud.Family
+	nud.ActorId = ud.ActorId
+	nud.Expires = ud.Expires
+	return nud, true, nil
+}
+
+//reloads permissions of the session if outdated and writes them back to the session
+func (ac *AuthController) refreshPermissions(ud *models.UserData) (*models.UserData, error) {
+	nud, changed, err := ac.currentUserData(ud)
+	if err != nil || !changed {
+		return nud, err
+	}
+	if f, err := ac.getFamily(ud.Family); err == nil {
+		f.Ud = nud
+		if err = ac.saveFamily(f); err != nil {
+			log.Error(err)
+		}
+	}
+	if ac.jwt == nil {
+		//signed tokens cannot be changed, permissions are reloaded till next refresh
+		k := fmt.Sprintf("%s%s", REDIS_USER_UUID_KEY, ud.Uuid)
+		if ttl, err := ac.store.TTL(k); err == nil && ttl > 0 {
+			if udjson, err := json.Marshal(nud); err == nil {
+				ac.store.Set(k, udjson, ttl)
+			}
+		}
+	}
+	return nud, nil
+}
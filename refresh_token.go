@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/auth_backend/models"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_ACCESS_EXPIRY = 15 //minutes
+	REDIS_REFRESH_TOKEN = "REFRESH_TOKEN:"
+	REDIS_REFRESH_FAMILY = "REFRESH_FAMILY:"
+	REDIS_REFRESH_EXPIRY = REDIS_USER_EXPIRY //hours
+	REDIS_REFRESH_USED = "REFRESH_USED:"
+	REFRESH_TOKEN_USED = "used:"
+)
+
+//returned to the client on login/refresh
+type SessionTokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"` //not issued for impersonation
+	ExpiresIn    int64  `json:"expires_in"` //seconds
+}
+
+//all the refresh tokens created from a single login belong to a family
+//if any of the used refresh token is presented again whole family is revoked
+type refreshFamily struct {
+	Id      string
+	Ud      *models.UserData
+	Access  string   //current access token
+	Refresh []string //all refresh tokens issued for this family
+	Meta    SessionMeta
+}
+
+func newUUID() (string, error) {
+	if uuid, err := uuid.NewV4(); err != nil {
+		return "", errors.New("Unable to generate unique identifier at this time. Please try again")
+	} else {
+		return uuid.String(), nil
+	}
+}
+
+//creates a new token family for the user, each family is listed as a session of the user
+func (ac *AuthController) createSession(ud *models.UserData, client *SessionMeta) (*SessionTokens, error) {
+	fid, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	ud.Family = fid
+	f := &refreshFamily{Id: fid, Ud: ud}
+	if client != nil {
+		f.Meta = *client
+	}
+	f.Meta.Id = fid
+	f.Meta.Created = time.Now()
+	if err = ac.addSession(ud.Id, fid); err != nil {
+		return nil, err
+	}
+	return ac.issueSessionTokens(f)
+}
+
+//issues new access & refresh token for the family, previous access token is removed
+func (ac *AuthController) issueSessionTokens(f *refreshFamily) (*SessionTokens, error) {
+	var access, refresh string
+	var err error
+	if access, err = newUUID(); err != nil {
+		return nil, err
+	}
+	if refresh, err = newUUID(); err != nil {
+		return nil, err
+	}
+	if err = ac.revokeAccess(f.Access); err != nil {
+		return nil, err
+	}
+
+	ud := *f.Ud
+	ud.Uuid = access
+	token := access
+	if ac.jwt != nil {
+		if token, err = ac.signAccess(&ud, 0); err != nil {
+			return nil, err
+		}
+	} else {
+		var udjson []byte
+		if udjson, err = json.Marshal(&ud); err != nil {
+			return nil, err
+		}
+		k := fmt.Sprintf("%s%s", REDIS_USER_UUID_KEY, access)
+		if err = ac.store.Set(k, udjson, REDIS_ACCESS_EXPIRY*time.Minute); err != nil {
+			return nil, err
+		}
+	}
+	k := fmt.Sprintf("%s%s", REDIS_REFRESH_TOKEN, refresh)
+	if err = ac.store.Set(k, f.Id, REDIS_REFRESH_EXPIRY*time.Hour); err != nil {
+		return nil, err
+	}
+
+	f.Access = access
+	f.Refresh = append(f.Refresh, refresh)
+	//access tokens are short lived, refresh is a good enough marker of activity
+	f.Meta.LastSeen = time.Now()
+	if err = ac.saveFamily(f); err != nil {
+		return nil, err
+	}
+	return &SessionTokens{Token: token, RefreshToken: refresh, ExpiresIn: REDIS_ACCESS_EXPIRY * 60}, nil
+}
+
+func (ac *AuthController) saveFamily(f *refreshFamily) error {
+	fjson, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	k := fmt.Sprintf("%s%s", REDIS_REFRESH_FAMILY, f.Id)
+	err = ac.store.Set(k, fjson, REDIS_REFRESH_EXPIRY*time.Hour)
+	return err
+}
+
+func (ac *AuthController) getFamily(id string) (*refreshFamily, error) {
+	k := fmt.Sprintf("%s%s", REDIS_REFRESH_FAMILY, id)
+	str, err := ac.store.Get(k)
+	if err == KEY_NOT_FOUND {
+		return nil, models.USER_NOT_AUTHENTICATED
+	} else if err != nil {
+		return nil, err
+	}
+	f := &refreshFamily{}
+	if err = json.Unmarshal([]byte(str), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//exchanges a refresh token for a new access & refresh token
+//refresh token can be used only once, reusing it revokes all the tokens of its family
+func (ac *AuthController) refresh(token string, client *SessionMeta) (*SessionTokens, error) {
+	k := fmt.Sprintf("%s%s", REDIS_REFRESH_TOKEN, token)
+	fid, err := ac.store.Get(k)
+	if err == KEY_NOT_FOUND {
+		return nil, models.USER_NOT_AUTHENTICATED
+	} else if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(fid, REFRESH_TOKEN_USED) {
+		return nil, ac.refreshReused(strings.TrimPrefix(fid, REFRESH_TOKEN_USED))
+	}
+	//only one request can claim the token, others are treated as reuse
+	if ok, err := ac.store.SetNX(fmt.Sprintf("%s%s", REDIS_REFRESH_USED, token), fid, REDIS_REFRESH_EXPIRY*time.Hour); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ac.refreshReused(fid)
+	}
+	//keep it around with its family, used to detect reuse
+	if err = ac.store.Set(k, REFRESH_TOKEN_USED+fid, REDIS_REFRESH_EXPIRY*time.Hour); err != nil {
+		return nil, err
+	}
+
+	f, err := ac.getFamily(fid)
+	if err != nil {
+		return nil, err
+	}
+	if client != nil && client.Ip != "" {
+		f.Meta.Ip = client.Ip
+	}
+	if ud, changed, err := ac.currentUserData(f.Ud); err != nil {
+		ac.revokeFamily(f.Id)
+		return nil, err
+	} else if changed {
+		f.Ud = ud
+	}
+	return ac.issueSessionTokens(f)
+}
+
+func (ac *AuthController) refreshReused(fid string) error {
+	log.Warnf("Refresh token reused, revoking token family %s", fid)
+	if err := ac.revokeFamily(fid); err != nil {
+		log.Error(err)
+	}
+	return models.REFRESH_TOKEN_REUSED
+}
+
+//removes access & refresh tokens of the family
+func (ac *AuthController) revokeFamily(id string) error {
+	if id == "" {
+		return nil
+	}
+	f, err := ac.getFamily(id)
+	if err == models.USER_NOT_AUTHENTICATED {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = ac.revokeAccess(f.Access); err != nil {
+		return err
+	}
+	keys := []string{fmt.Sprintf("%s%s", REDIS_REFRESH_FAMILY, f.Id)}
+	for _, r := range f.Refresh {
+		keys = append(keys, fmt.Sprintf("%s%s", REDIS_REFRESH_TOKEN, r))
+	}
+	if _, err = ac.store.Del(keys...); err != nil {
+		return err
+	}
+	if err = ac.removeSession(f.Ud.Id, f.Id); err != nil {
+		return err
+	}
+	log.Infof("Token family %s of user %d revoked", f.Id, f.Ud.Id)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/auth_backend/utils"
+	"testing"
+)
+
+func TestRefreshRotation(t *testing.T) {
+	ms := NewMemoryStore(0)
+	defer ms.Close()
+	ac := &AuthController{store: ms}
+
+	first, err := ac.createSession(&models.UserData{Id: 5, Org_id: 2, RoleId: 3}, &SessionMeta{Ip: "10.0.0.1"})
+	utils.Ok(t, err)
+	ud, err := ac.authenticate(first.Token)
+	utils.Ok(t, err)
+	fid := ud.Family
+	utils.Assert(t, fid != "", "session should have a family")
+
+	second, err := ac.refresh(first.RefreshToken, &SessionMeta{Ip: "10.0.0.2"})
+	utils.Ok(t, err)
+	utils.Assert(t, second.Token != first.Token && second.RefreshToken != first.RefreshToken, "tokens are rotated")
+	_, err = ac.authenticate(first.Token)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+	ud, err = ac.authenticate(second.Token)
+	utils.Ok(t, err)
+	utils.Equals(t, fid, ud.Family)
+	f, err := ac.getFamily(fid)
+	utils.Ok(t, err)
+	utils.Equals(t, "10.0.0.2", f.Meta.Ip)
+	utils.Equals(t, 2, len(f.Refresh))
+
+	third, err := ac.refresh(second.RefreshToken, nil)
+	utils.Ok(t, err)
+
+	_, err = ac.refresh("unknown", nil)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	//used token presented again revokes the whole family
+	_, err = ac.refresh(first.RefreshToken, nil)
+	utils.Equals(t, models.REFRESH_TOKEN_REUSED, err)
+	_, err = ac.authenticate(third.Token)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+	_, err = ac.refresh(third.RefreshToken, nil)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+	_, err = ac.getFamily(fid)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+	ok, err := ms.SIsMember(fmt.Sprintf("%s%d", REDIS_USER_SESSIONS, 5), fid)
+	utils.Ok(t, err)
+	utils.Equals(t, false, ok)
+}
+
+func TestRefreshConcurrentReuse(t *testing.T) {
+	ms := NewMemoryStore(0)
+	defer ms.Close()
+	ac := &AuthController{store: ms}
+	tokens, err := ac.createSession(&models.UserData{Id: 5, Org_id: 2, RoleId: 3}, nil)
+	utils.Ok(t, err)
+	other, err := ac.createSession(&models.UserData{Id: 5, Org_id: 2, RoleId: 3}, nil)
+	utils.Ok(t, err)
+	ud, err := ac.authenticate(tokens.Token)
+	utils.Ok(t, err)
+
+	//another request claimed the token but has not marked it used yet
+	ok, err := ms.SetNX(REDIS_REFRESH_USED+tokens.RefreshToken, ud.Family, 0)
+	utils.Ok(t, err)
+	utils.Assert(t, ok, "token should not be claimed yet")
+	_, err = ac.refresh(tokens.RefreshToken, nil)
+	utils.Equals(t, models.REFRESH_TOKEN_REUSED, err)
+	_, err = ac.authenticate(tokens.Token)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+	_, err = ac.getFamily(ud.Family)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	//other sessions of the user are not affected
+	_, err = ac.refresh(other.RefreshToken, nil)
+	utils.Ok(t, err)
+	utils.Ok(t, ac.revokeFamily(""))
+}
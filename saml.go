@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/crewjam/saml"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_SAML_REQUEST = "SAML_REQUEST:"
+	REDIS_SAML_ASSERTION = "SAML_ASSERTION:"
+	REDIS_SAML_EXPIRY = 10 //minutes
+	SAML_ID_COLUMN = "saml_id"
+)
+
+//service provider of an org, built from its saml_config for each request
+type samlSP struct {
+	sp  *saml.ServiceProvider
+	cfg *models.SamlConfig
+	org *models.Org
+}
+
+//saved till the identity provider posts back to acs
+type samlState struct {
+	Org       int64
+	RequestId string
+}
+
+//user as asserted by the identity provider
+type samlIdentity struct {
+	AssertionId string
+	NameId      string
+	Username    string
+	Email       string
+	Role        int64
+	Expires     time.Time
+}
+
+//endpoints of the org are under baseUrl, which is the public url of this server
+func newSamlSP(baseUrl string, org *models.Org, cfg *models.SamlConfig) (*samlSP, error) {
+	if org.Slug == "" {
+		return nil, errors.New("org without slug cannot use saml")
+	}
+	cert, err := cfg.Certificate()
+	if err != nil {
+		return nil, err
+	}
+	root, err := url.Parse(strings.TrimRight(baseUrl, "/") + "/api/v1/auth/saml/" + url.PathEscape(org.Slug))
+	if err != nil {
+		return nil, err
+	}
+	metadataUrl, acsUrl := *root, *root
+	metadataUrl.Path += "/metadata"
+	acsUrl.Path += "/acs"
+	idp := &saml.EntityDescriptor{
+		EntityID: cfg.IdpEntityId,
+		IDPSSODescriptors: []saml.IDPSSODescriptor{{
+			SSODescriptor: saml.SSODescriptor{RoleDescriptor: saml.RoleDescriptor{
+				KeyDescriptors: []saml.KeyDescriptor{{Use: "signing", KeyInfo: saml.KeyInfo{X509Data: saml.X509Data{
+					X509Certificates: []saml.X509Certificate{{Data: base64.StdEncoding.EncodeToString(cert.Raw)}},
+				}}}},
+			}},
+			SingleSignOnServices: []saml.Endpoint{{Binding: saml.HTTPRedirectBinding, Location: cfg.IdpSsoUrl}},
+		}},
+	}
+	return &samlSP{cfg: cfg, org: org, sp: &saml.ServiceProvider{
+		EntityID:          metadataUrl.String(),
+		MetadataURL:       metadataUrl,
+		AcsURL:            acsUrl,
+		IDPMetadata:       idp,
+		AuthnNameIDFormat: saml.PersistentNameIDFormat,
+		AllowIDPInitiated: cfg.AllowIdpInitiated,
+	}}, nil
+}
+
+func (s *samlSP) metadata() ([]byte, error) {
+	return xml.MarshalIndent(s.sp.Metadata(), "", "  ")
+}
+
+//url of the identity provider to which user is redirected, with the id of the request
+func (s *samlSP) redirect(relayState string) (string, string, error) {
+	req, err := s.sp.MakeAuthenticationRequest(s.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+	u, err := req.Redirect(relayState, s.sp)
+	if err != nil {
+		return "", "", err
+	}
+	return u.String(), req.ID, nil
+}
+
+//checks signature, issuer, audience, recipient & validity of the response posted to acs
+//requestIds are the requests it may answer, empty for identity provider initiated logins
+func (s *samlSP) parse(response string, requestIds []string) (*samlIdentity, error) {
+	raw, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	a, err := s.sp.ParseXMLResponse(raw, requestIds)
+	if err != nil {
+		if ire, ok := err.(*saml.InvalidResponseError); ok {
+			err = ire.PrivateErr
+		}
+		log.Errorf("Invalid saml response for org %d : %s", s.org.ID, err.Error())
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	if a.Subject == nil || a.Subject.NameID == nil || a.Subject.NameID.Value == "" {
+		log.Errorf("saml assertion %s for org %d has no NameID", a.ID, s.org.ID)
+		return nil, models.USER_NOT_AUTHENTICATED
+	}
+	ident := &samlIdentity{AssertionId: a.ID, NameId: a.Subject.NameID.Value, Expires: time.Now()}
+	if a.Conditions != nil {
+		ident.Expires = a.Conditions.NotOnOrAfter
+	}
+	ident.Expires = ident.Expires.Add(saml.MaxClockSkew)
+	ident.Username = ident.NameId
+	if s.cfg.UsernameAttr != "" {
+		ident.Username = firstValue(samlValues(a, s.cfg.UsernameAttr))
+	}
+	ident.Email = strings.ToLower(firstValue(samlValues(a, s.cfg.EmailAttr)))
+	ident.Role = s.role(samlValues(a, s.cfg.RoleAttr))
+	return ident, nil
+}
+
+func (s *samlSP) role(values []string) int64 {
+	for _, m := range s.cfg.RoleMap {
+		for _, v := range values {
+			if strings.EqualFold(v, m.Value) {
+				return m.Role
+			}
+		}
+	}
+	return s.cfg.DefaultRole
+}
+
+//values of the attribute, matched by name or friendly name
+func samlValues(a *saml.Assertion, name string) []string {
+	values := []string{}
+	if name == "" {
+		return values
+	}
+	for _, st := range a.AttributeStatements {
+		for _, attr := range st.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+			for _, v := range attr.Values {
+				values = append(values, strings.TrimSpace(v.Value))
+			}
+		}
+	}
+	return values
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+//service provider of the org with the slug, INVALID_ENTRY if it has no enabled saml config
+func (ac *AuthController) samlProvider(slug string) (*samlSP, error) {
+	org, err := ac.dbHandler.FindOrgBySlug(slug)
+	if err != nil {
+		return nil, err
+	} else if org == nil {
+		return nil, models.INVALID_ENTRY
+	}
+	cfg, err := ac.dbHandler.GetSamlConfig(org.ID)
+	if err != nil {
+		return nil, err
+	} else if cfg == nil || !cfg.Enabled {
+		return nil, models.INVALID_ENTRY
+	}
+	return newSamlSP(ac.samlBaseUrl, org, cfg)
+}
+
+func (ac *AuthController) samlMetadata(slug string) ([]byte, error) {
+	s, err := ac.samlProvider(slug)
+	if err != nil {
+		return nil, err
+	}
+	return s.metadata()
+}
+
+//url of identity provider to which user is redirected, request id is kept in session store
+func (ac *AuthController) samlRedirect(slug string) (string, error) {
+	s, err := ac.samlProvider(slug)
+	if err != nil {
+		return "", err
+	}
+	state, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	u, reqId, err := s.redirect(state)
+	if err != nil {
+		return "", err
+	}
+	sjson, err := json.Marshal(&samlState{Org: s.org.ID, RequestId: reqId})
+	if err != nil {
+		return "", err
+	}
+	if err = ac.store.Set(fmt.Sprintf("%s%s", REDIS_SAML_REQUEST, state), sjson, REDIS_SAML_EXPIRY*time.Minute); err != nil {
+		return "", err
+	}
+	return u, nil
+}
+
+//validates the response posted by identity provider, provisions the user & starts a session
+func (ac *AuthController) samlACS(slug string, response string, relayState string, client *SessionMeta) (*SessionTokens, *MFAChallenge, error) {
+	s, err := ac.samlProvider(slug)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestIds := []string{}
+	if relayState != "" {
+		k := fmt.Sprintf("%s%s", REDIS_SAML_REQUEST, relayState)
+		if str, err := ac.store.Get(k); err == nil {
+			//request can be answered only once
+			if n, err := ac.store.Del(k); err != nil {
+				return nil, nil, err
+			} else if n == 0 {
+				return nil, nil, models.USER_NOT_AUTHENTICATED
+			}
+			st := &samlState{}
+			if err = json.Unmarshal([]byte(str), st); err != nil {
+				return nil, nil, err
+			}
+			if st.Org != s.org.ID {
+				return nil, nil, models.USER_NOT_AUTHENTICATED
+			}
+			requestIds = append(requestIds, st.RequestId)
+		} else if err != KEY_NOT_FOUND {
+			return nil, nil, err
+		}
+	}
+	if len(requestIds) == 0 && !s.cfg.AllowIdpInitiated {
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+	ident, err := s.parse(response, requestIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	//assertion cannot be replayed while it is valid
+	if ok, err := ac.store.SetNX(fmt.Sprintf("%s%d:%s", REDIS_SAML_ASSERTION, s.org.ID, ident.AssertionId), 1,
+		time.Until(ident.Expires)); err != nil {
+		return nil, nil, err
+	} else if !ok {
+		log.Errorf("saml assertion %s replayed for org %d", ident.AssertionId, s.org.ID)
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+	if ident.Role <= 0 {
+		log.Warnf("%s has no role mapped in saml config of org %d", ident.NameId, s.org.ID)
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	}
+	//NameID is unique only at the identity provider of the org
+	au, err := ac.dbHandler.SyncExternalUser(SAML_ID_COLUMN, fmt.Sprintf("%d/%s", s.org.ID, ident.NameId),
+		ident.Username, ident.Email, s.org.ID, ident.Role)
+	if err == models.INVALID_CREDENTIALS {
+		return nil, nil, models.USER_NOT_AUTHENTICATED
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if err = au.CheckStatus(); err != nil {
+		return nil, nil, err
+	}
+	ud, err := ac.buildUserData(au.GetId())
+	if err != nil {
+		return nil, nil, err
+	}
+	return ac.startSession(ud, client)
+}
+
+//only SU manages saml configs
+func (ac *AuthController) samlConfig(ud *models.UserData, slug string) (*models.SamlConfig, error) {
+	if !ac.dbHandler.IsSU(ud) {
+		return nil, models.UNAUTHORIZED
+	}
+	org, err := ac.dbHandler.FindOrgBySlug(slug)
+	if err != nil {
+		return nil, err
+	} else if org == nil {
+		return nil, models.INVALID_ENTRY
+	}
+	if c, err := ac.dbHandler.GetSamlConfig(org.ID); err != nil {
+		return nil, err
+	} else if c == nil {
+		return nil, models.INVALID_ENTRY
+	} else {
+		return c, nil
+	}
+}
+
+func (ac *AuthController) saveSamlConfig(ud *models.UserData, slug string, c *models.SamlConfig) (*models.SamlConfig, error) {
+	if !ac.dbHandler.IsSU(ud) {
+		return nil, models.UNAUTHORIZED
+	}
+	org, err := ac.dbHandler.FindOrgBySlug(slug)
+	if err != nil {
+		return nil, err
+	} else if org == nil {
+		return nil, models.INVALID_ENTRY
+	}
+	c.OrgId = org.ID
+	return ac.dbHandler.SaveSamlConfig(ud, c)
+}
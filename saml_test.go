@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/auth_backend/models"
+	"github.com/auth_backend/utils"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+//identity provider with a freshly generated keypair
+func newTestIdP(t *testing.T) *saml.IdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	utils.Ok(t, err)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp.example.org"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	utils.Ok(t, err)
+	cert, err := x509.ParseCertificate(der)
+	utils.Ok(t, err)
+	mu, _ := url.Parse("https://idp.example.org/metadata")
+	su, _ := url.Parse("https://idp.example.org/sso")
+	return &saml.IdentityProvider{Key: key, Certificate: cert, MetadataURL: *mu, SSOURL: *su}
+}
+
+func certPEM(idp *saml.IdentityProvider) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.Certificate.Raw}))
+}
+
+//base64 response as posted by the identity provider, change can alter the assertion before it is signed
+func signedResponse(t *testing.T, idp *saml.IdentityProvider, s *samlSP, requestId string, session *saml.Session,
+	change func(a *saml.Assertion)) string {
+	acs := s.sp.AcsURL.String()
+	req := &saml.IdpAuthnRequest{IDP: idp, HTTPRequest: httptest.NewRequest("POST", acs, nil),
+		Request:                 saml.AuthnRequest{ID: requestId, IssueInstant: saml.TimeNow()},
+		ServiceProviderMetadata: &saml.EntityDescriptor{EntityID: s.sp.EntityID},
+		SPSSODescriptor:         &saml.SPSSODescriptor{},
+		ACSEndpoint:             &saml.IndexedEndpoint{Binding: saml.HTTPPostBinding, Location: acs},
+		Now:                     saml.TimeNow()}
+	utils.Ok(t, saml.DefaultAssertionMaker{}.MakeAssertion(req, session))
+	if change != nil {
+		change(req.Assertion)
+	}
+	utils.Ok(t, req.MakeResponse())
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	b, err := doc.WriteToBytes()
+	utils.Ok(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func TestSamlResponse(t *testing.T) {
+	idp := newTestIdP(t)
+	org := &models.Org{ID: 2, Slug: "another_org"}
+	cfg := &models.SamlConfig{OrgId: 2, Enabled: true, IdpEntityId: idp.MetadataURL.String(),
+		IdpSsoUrl: idp.SSOURL.String(), IdpCert: certPEM(idp), UsernameAttr: "uid", EmailAttr: "email",
+		RoleAttr: "groups", DefaultRole: 2,
+		RoleMap: []models.SamlRoleMap{{Value: "Admins", Role: 3}, {Value: "staff", Role: 4}}}
+	s, err := newSamlSP("https://auth.example.org/", org, cfg)
+	utils.Ok(t, err)
+	utils.Equals(t, "https://auth.example.org/api/v1/auth/saml/another_org/acs", s.sp.AcsURL.String())
+
+	md, err := s.metadata()
+	utils.Ok(t, err)
+	utils.Assert(t, strings.Contains(string(md), `entityID="https://auth.example.org/api/v1/auth/saml/another_org/metadata"`),
+		"metadata has entity id")
+	utils.Assert(t, strings.Contains(string(md), `Location="https://auth.example.org/api/v1/auth/saml/another_org/acs"`),
+		"metadata has acs")
+
+	u, reqId, err := s.redirect("state")
+	utils.Ok(t, err)
+	utils.Assert(t, strings.HasPrefix(u, idp.SSOURL.String()+"?SAMLRequest="), "redirect to idp sso, got %s", u)
+	utils.Assert(t, strings.HasSuffix(u, "&RelayState=state"), "relay state kept, got %s", u)
+
+	session := &saml.Session{NameID: "alice-1234", UserName: "alice", CustomAttributes: []saml.Attribute{
+		{Name: "email", Values: []saml.AttributeValue{{Value: "Alice@Example.org"}}},
+		{Name: "groups", Values: []saml.AttributeValue{{Value: "staff"}, {Value: "admins"}}}}}
+	resp := signedResponse(t, idp, s, reqId, session, nil)
+	ident, err := s.parse(resp, []string{reqId})
+	utils.Ok(t, err)
+	utils.Equals(t, "alice-1234", ident.NameId)
+	utils.Equals(t, "alice", ident.Username)
+	utils.Equals(t, "alice@example.org", ident.Email)
+	utils.Equals(t, int64(3), ident.Role)
+	utils.Assert(t, ident.AssertionId != "" && ident.Expires.After(time.Now()), "assertion id & expiry are set")
+
+	//response to another request
+	_, err = s.parse(resp, []string{"id-other"})
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	//attribute changed after signing
+	raw, _ := base64.StdEncoding.DecodeString(resp)
+	tampered := strings.Replace(string(raw), "Alice@Example.org", "mallory@example.org", 1)
+	utils.Assert(t, tampered != string(raw), "email should be in the response")
+	_, err = s.parse(base64.StdEncoding.EncodeToString([]byte(tampered)), []string{reqId})
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	//signed with another key by same issuer
+	other := newTestIdP(t)
+	_, err = s.parse(signedResponse(t, other, s, reqId, session, nil), []string{reqId})
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	//meant for another service provider
+	_, err = s.parse(signedResponse(t, idp, s, reqId, session, func(a *saml.Assertion) {
+		a.Conditions.AudienceRestrictions[0].Audience.Value = "https://other.example.org/metadata"
+	}), []string{reqId})
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	//issued too long ago
+	_, err = s.parse(signedResponse(t, idp, s, reqId, session, func(a *saml.Assertion) {
+		a.IssueInstant = time.Now().Add(-time.Hour)
+	}), []string{reqId})
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	_, err = s.parse("not base64", []string{reqId})
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	//identity provider initiated, NameID is the username & default role without groups
+	cfg.AllowIdpInitiated, cfg.UsernameAttr = true, ""
+	s, err = newSamlSP("https://auth.example.org", org, cfg)
+	utils.Ok(t, err)
+	ident, err = s.parse(signedResponse(t, idp, s, "", &saml.Session{NameID: "bob", CustomAttributes: []saml.Attribute{
+		{Name: "email", Values: []saml.AttributeValue{{Value: "bob@example.org"}}}}}, nil), nil)
+	utils.Ok(t, err)
+	utils.Equals(t, &samlIdentity{AssertionId: ident.AssertionId, NameId: "bob", Username: "bob",
+		Email: "bob@example.org", Role: 2, Expires: ident.Expires}, ident)
+
+	_, err = newSamlSP("https://auth.example.org", &models.Org{ID: 3}, cfg)
+	utils.Assert(t, err != nil, "org without slug should fail")
+	cfg.IdpCert = "invalid"
+	_, err = newSamlSP("https://auth.example.org", org, cfg)
+	utils.Assert(t, err != nil, "invalid idp cert should fail")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/auth_backend/models"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_USER_SESSIONS = "USER_SESSIONS:"
+)
+
+//device details of a session, session id is the refresh token family
+type SessionMeta struct {
+	Id        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	Ip        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+//ip of the client, forwarded headers are only used when running behind a trusted proxy
+func clientIp(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+		if rip := r.Header.Get("X-Real-IP"); rip != "" {
+			return rip
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func clientMeta(s *Server, r *http.Request) *SessionMeta {
+	return &SessionMeta{UserAgent: r.UserAgent(), Ip: clientIp(r, s.trustProxy)}
+}
+
+func (ac *AuthController) addSession(uid int64, fid string) error {
+	k := fmt.Sprintf("%s%d", REDIS_USER_SESSIONS, uid)
+	if err := ac.store.SAdd(k, fid); err != nil {
+		return err
+	}
+	err := ac.store.Expire(k, REDIS_REFRESH_EXPIRY*time.Hour)
+	return err
+}
+
+func (ac *AuthController) removeSession(uid int64, fid string) error {
+	err := ac.store.SRem(fmt.Sprintf("%s%d", REDIS_USER_SESSIONS, uid), fid)
+	return err
+}
+
+//sessions of the user, latest first
+func (ac *AuthController) listSessions(ud *models.UserData) ([]SessionMeta, error) {
+	fids, err := ac.store.SMembers(fmt.Sprintf("%s%d", REDIS_USER_SESSIONS, ud.Id))
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]SessionMeta, 0, len(fids))
+	for _, fid := range fids {
+		f, err := ac.getFamily(fid)
+		if err == models.USER_NOT_AUTHENTICATED {
+			//expired, clean up the index
+			ac.removeSession(ud.Id, fid)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		m := f.Meta
+		m.Current = fid == ud.Family
+		ret = append(ret, m)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.After(ret[j].Created)
+	})
+	return ret, nil
+}
+
+//revokes one of the sessions of the user
+func (ac *AuthController) revokeSession(ud *models.UserData, fid string) error {
+	if ok, err := ac.store.SIsMember(fmt.Sprintf("%s%d", REDIS_USER_SESSIONS, ud.Id), fid); err != nil {
+		return err
+	} else if !ok {
+		return models.INVALID_ENTRY
+	}
+	return ac.revokeFamily(fid)
+}
+
+//revokes all sessions of the user except the current one
+//api keys, scoped tokens & impersonation have no session of their own to keep
+func (ac *AuthController) revokeOtherSessions(ud *models.UserData) error {
+	if !accountSession(ud) || ud.Family == "" {
+		return models.UNAUTHORIZED
+	}
+	fids, err := ac.store.SMembers(fmt.Sprintf("%s%d", REDIS_USER_SESSIONS, ud.Id))
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		if fid == ud.Family {
+			continue
+		}
+		if err = ac.revokeFamily(fid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//removes all active sessions of the user
+func (ac *AuthController) revokeSessions(id int64) error {
+	//signed tokens issued till now are no longer valid
+	if _, err := ac.store.Incr(fmt.Sprintf("%s%d", REDIS_SESSION_VERSION, id)); err != nil {
+		return err
+	}
+	k := fmt.Sprintf("%s%d", REDIS_USER_SESSIONS, id)
+	fids, err := ac.store.SMembers(k)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		if err = ac.revokeFamily(fid); err != nil {
+			return err
+		}
+	}
+	if _, err = ac.store.Del(k); err != nil {
+		return err
+	}
+	log.Infof("Sessions revoked for user %d", id)
+	return nil
+}
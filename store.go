@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	STORE_REDIS = "redis"
+	STORE_MEMORY = "memory" //single node only, everything is lost on restart
+	STORE_SQL = "sql"
+	STORE_CLEANUP_INTERVAL = 1 //minutes, expired keys of memory & sql store are removed in this interval
+)
+
+var KEY_NOT_FOUND = errors.New("key not found")
+
+//Key value store for sessions, tokens, counters & session lists
+//semantics follow redis, a ttl of 0 means the key never expires
+type SessionStore interface {
+	//KEY_NOT_FOUND if key is missing or expired
+	Get(key string) (string, error)
+	//values are nil for missing keys
+	MGet(keys ...string) ([]interface{}, error)
+	Set(key string, value interface{}, ttl time.Duration) error
+	//sets only if key does not exist, returns true if it was set
+	SetNX(key string, value interface{}, ttl time.Duration) (bool, error)
+	//sets without expiry and returns previous value, KEY_NOT_FOUND if there was none
+	GetSet(key string, value interface{}) (string, error)
+	//returns number of keys removed
+	Del(keys ...string) (int64, error)
+	//missing keys start at 0, expiry of key is kept
+	Incr(key string) (int64, error)
+	Expire(key string, ttl time.Duration) error
+	//time till key expires, <= 0 if it is missing or never expires
+	TTL(key string) (time.Duration, error)
+	SAdd(key string, member string) error
+	SRem(key string, member string) error
+	SMembers(key string) ([]string, error)
+	SIsMember(key string, member string) (bool, error)
+	Close() error
+}
+
+//creates store as configured in session_store section, redis is the default
+func initStore(db *sql.DB, typ string, addr string, password string, rdb int) (SessionStore, error) {
+	switch typ {
+	case "", STORE_REDIS:
+		rc := redis.NewClient(&redis.Options{Addr: addr, Password: password, DB: rdb})
+		if _, err := rc.Ping().Result(); err != nil {
+			return nil, err
+		}
+		return &redisStore{rc: rc}, nil
+	case STORE_MEMORY:
+		return NewMemoryStore(STORE_CLEANUP_INTERVAL * time.Minute), nil
+	case STORE_SQL:
+		return NewSQLStore(db, STORE_CLEANUP_INTERVAL*time.Minute), nil
+	default:
+		return nil, fmt.Errorf("invalid session store %s", typ)
+	}
+}
+
+//values are stored as strings as in redis
+func storeValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var WRONG_TYPE = errors.New("operation against a key holding the wrong kind of value")
+
+type memEntry struct {
+	val     string
+	set     map[string]bool //nil for string values
+	expires time.Time       //zero if key never expires
+}
+
+func (e *memEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+//SessionStore kept in process memory, for a single node or development
+type MemoryStore struct {
+	mu   sync.Mutex
+	data map[string]*memEntry
+	done chan struct{}
+}
+
+func NewMemoryStore(cleanup time.Duration) *MemoryStore {
+	ms := &MemoryStore{data: make(map[string]*memEntry), done: make(chan struct{})}
+	if cleanup > 0 {
+		go ms.cleanup(cleanup)
+	}
+	return ms
+}
+
+func (ms *MemoryStore) cleanup(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ms.done:
+			return
+		case now := <-t.C:
+			ms.mu.Lock()
+			for k, e := range ms.data {
+				if e.expired(now) {
+					delete(ms.data, k)
+				}
+			}
+			ms.mu.Unlock()
+		}
+	}
+}
+
+//live entry of key, caller holds the lock
+func (ms *MemoryStore) entry(key string) *memEntry {
+	e, ok := ms.data[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(time.Now()) {
+		delete(ms.data, key)
+		return nil
+	}
+	return e
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (ms *MemoryStore) Get(key string) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e := ms.entry(key)
+	if e == nil {
+		return "", KEY_NOT_FOUND
+	} else if e.set != nil {
+		return "", WRONG_TYPE
+	}
+	return e.val, nil
+}
+
+func (ms *MemoryStore) MGet(keys ...string) ([]interface{}, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	vals := make([]interface{}, len(keys))
+	for i, k := range keys {
+		if e := ms.entry(k); e != nil && e.set == nil {
+			vals[i] = e.val
+		}
+	}
+	return vals, nil
+}
+
+func (ms *MemoryStore) Set(key string, value interface{}, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.data[key] = &memEntry{val: storeValue(value), expires: expiry(ttl)}
+	return nil
+}
+
+func (ms *MemoryStore) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.entry(key) != nil {
+		return false, nil
+	}
+	ms.data[key] = &memEntry{val: storeValue(value), expires: expiry(ttl)}
+	return true, nil
+}
+
+func (ms *MemoryStore) GetSet(key string, value interface{}) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e := ms.entry(key)
+	if e != nil && e.set != nil {
+		return "", WRONG_TYPE
+	}
+	ms.data[key] = &memEntry{val: storeValue(value)}
+	if e == nil {
+		return "", KEY_NOT_FOUND
+	}
+	return e.val, nil
+}
+
+func (ms *MemoryStore) Del(keys ...string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var n int64
+	for _, k := range keys {
+		if ms.entry(k) != nil {
+			delete(ms.data, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (ms *MemoryStore) Incr(key string) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e := ms.entry(key)
+	if e == nil {
+		ms.data[key] = &memEntry{val: "1"}
+		return 1, nil
+	} else if e.set != nil {
+		return 0, WRONG_TYPE
+	}
+	n, err := strconv.ParseInt(e.val, 10, 64)
+	if err != nil {
+		return 0, errors.New("value is not an integer")
+	}
+	n++
+	e.val = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (ms *MemoryStore) Expire(key string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if e := ms.entry(key); e != nil {
+		if ttl <= 0 {
+			delete(ms.data, key)
+		} else {
+			e.expires = expiry(ttl)
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) TTL(key string) (time.Duration, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e := ms.entry(key)
+	if e == nil || e.expires.IsZero() {
+		return 0, nil
+	}
+	return time.Until(e.expires), nil
+}
+
+//set entry of key, created if missing
+func (ms *MemoryStore) setEntry(key string, create bool) (*memEntry, error) {
+	e := ms.entry(key)
+	if e == nil {
+		if !create {
+			return nil, nil
+		}
+		e = &memEntry{set: make(map[string]bool)}
+		ms.data[key] = e
+	} else if e.set == nil {
+		return nil, WRONG_TYPE
+	}
+	return e, nil
+}
+
+func (ms *MemoryStore) SAdd(key string, member string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e, err := ms.setEntry(key, true)
+	if err != nil {
+		return err
+	}
+	e.set[member] = true
+	return nil
+}
+
+func (ms *MemoryStore) SRem(key string, member string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e, err := ms.setEntry(key, false)
+	if err != nil || e == nil {
+		return err
+	}
+	delete(e.set, member)
+	if len(e.set) == 0 {
+		delete(ms.data, key)
+	}
+	return nil
+}
+
+func (ms *MemoryStore) SMembers(key string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	members := make([]string, 0)
+	e, err := ms.setEntry(key, false)
+	if err != nil || e == nil {
+		return members, err
+	}
+	for m, _ := range e.set {
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (ms *MemoryStore) SIsMember(key string, member string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	e, err := ms.setEntry(key, false)
+	if err != nil || e == nil {
+		return false, err
+	}
+	return e.set[member], nil
+}
+
+func (ms *MemoryStore) Close() error {
+	close(ms.done)
+	return nil
+}
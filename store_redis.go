@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/go-redis/redis"
+	"time"
+)
+
+type redisStore struct {
+	rc *redis.Client
+}
+
+func redisErr(err error) error {
+	if err == redis.Nil {
+		return KEY_NOT_FOUND
+	}
+	return err
+}
+
+func (rs *redisStore) Get(key string) (string, error) {
+	str, err := rs.rc.Get(key).Result()
+	return str, redisErr(err)
+}
+
+func (rs *redisStore) MGet(keys ...string) ([]interface{}, error) {
+	return rs.rc.MGet(keys...).Result()
+}
+
+func (rs *redisStore) Set(key string, value interface{}, ttl time.Duration) error {
+	return rs.rc.Set(key, value, ttl).Err()
+}
+
+func (rs *redisStore) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+	return rs.rc.SetNX(key, value, ttl).Result()
+}
+
+func (rs *redisStore) GetSet(key string, value interface{}) (string, error) {
+	str, err := rs.rc.GetSet(key, value).Result()
+	return str, redisErr(err)
+}
+
+func (rs *redisStore) Del(keys ...string) (int64, error) {
+	return rs.rc.Del(keys...).Result()
+}
+
+func (rs *redisStore) Incr(key string) (int64, error) {
+	return rs.rc.Incr(key).Result()
+}
+
+func (rs *redisStore) Expire(key string, ttl time.Duration) error {
+	return rs.rc.Expire(key, ttl).Err()
+}
+
+func (rs *redisStore) TTL(key string) (time.Duration, error) {
+	return rs.rc.TTL(key).Result()
+}
+
+func (rs *redisStore) SAdd(key string, member string) error {
+	return rs.rc.SAdd(key, member).Err()
+}
+
+func (rs *redisStore) SRem(key string, member string) error {
+	return rs.rc.SRem(key, member).Err()
+}
+
+func (rs *redisStore) SMembers(key string) ([]string, error) {
+	return rs.rc.SMembers(key).Result()
+}
+
+func (rs *redisStore) SIsMember(key string, member string) (bool, error) {
+	return rs.rc.SIsMember(key, member).Result()
+}
+
+func (rs *redisStore) Close() error {
+	return rs.rc.Close()
+}
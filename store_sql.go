@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	STORE_TABLE = "session_store"
+	STORE_MEMBER_TABLE = "session_store_member" //members of sets, they share expiry of the set
+	storeLive = " (expires_at is null or expires_at > ?) "
+)
+
+//SessionStore in MySQL tables, for deployments without redis
+//expired rows are ignored on read and removed periodically
+type SQLStore struct {
+	db   *sql.DB
+	done chan struct{}
+}
+
+func NewSQLStore(db *sql.DB, cleanup time.Duration) *SQLStore {
+	ss := &SQLStore{db: db, done: make(chan struct{})}
+	if cleanup > 0 {
+		go ss.cleanup(cleanup)
+	}
+	return ss
+}
+
+func (ss *SQLStore) cleanup(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ss.done:
+			return
+		case now := <-t.C:
+			for _, table := range []string{STORE_TABLE, STORE_MEMBER_TABLE} {
+				if _, err := ss.db.Exec("delete from "+table+" where expires_at <= ?", now); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+	}
+}
+
+func sqlExpiry(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+	return time.Now().Add(ttl)
+}
+
+func (ss *SQLStore) Get(key string) (string, error) {
+	var v string
+	err := ss.db.QueryRow("select v from "+STORE_TABLE+" where k=? and"+storeLive, key, time.Now()).Scan(&v)
+	if err == sql.ErrNoRows {
+		return "", KEY_NOT_FOUND
+	}
+	return v, err
+}
+
+func (ss *SQLStore) MGet(keys ...string) ([]interface{}, error) {
+	vals := make([]interface{}, len(keys))
+	if len(keys) == 0 {
+		return vals, nil
+	}
+	params := []interface{}{}
+	for _, k := range keys {
+		params = append(params, k)
+	}
+	params = append(params, time.Now())
+	rows, err := ss.db.Query("select k, v from "+STORE_TABLE+" where k in (?"+strings.Repeat(",?", len(keys)-1)+
+		") and"+storeLive, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err = rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		found[k] = v
+	}
+	for i, k := range keys {
+		if v, ok := found[k]; ok {
+			vals[i] = v
+		}
+	}
+	return vals, rows.Err()
+}
+
+func (ss *SQLStore) Set(key string, value interface{}, ttl time.Duration) error {
+	_, err := ss.db.Exec("insert into "+STORE_TABLE+"(k, v, expires_at) values(?,?,?) "+
+		"on duplicate key update v=values(v), expires_at=values(expires_at)", key, storeValue(value), sqlExpiry(ttl))
+	return err
+}
+
+//removes the key if it has expired, so it can be inserted again
+func (ss *SQLStore) dropExpired(key string) error {
+	_, err := ss.db.Exec("delete from "+STORE_TABLE+" where k=? and expires_at <= ?", key, time.Now())
+	return err
+}
+
+func (ss *SQLStore) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+	if err := ss.dropExpired(key); err != nil {
+		return false, err
+	}
+	//primary key makes sure only one insert succeeds
+	s, err := ss.db.Exec("insert ignore into "+STORE_TABLE+"(k, v, expires_at) values(?,?,?)",
+		key, storeValue(value), sqlExpiry(ttl))
+	if err != nil {
+		return false, err
+	}
+	n, err := s.RowsAffected()
+	return n == 1, err
+}
+
+func (ss *SQLStore) GetSet(key string, value interface{}) (string, error) {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var old string
+	err = tx.QueryRow("select v from "+STORE_TABLE+" where k=? and"+storeLive+"for update", key, time.Now()).Scan(&old)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	found := err == nil
+	if _, err = tx.Exec("insert into "+STORE_TABLE+"(k, v, expires_at) values(?,?,null) "+
+		"on duplicate key update v=values(v), expires_at=null", key, storeValue(value)); err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+	if !found {
+		return "", KEY_NOT_FOUND
+	}
+	return old, nil
+}
+
+func (ss *SQLStore) Del(keys ...string) (int64, error) {
+	var n int64
+	now := time.Now()
+	for _, k := range keys {
+		s, err := ss.db.Exec("delete from "+STORE_TABLE+" where k=? and"+storeLive, k, now)
+		if err != nil {
+			return n, err
+		}
+		kv, _ := s.RowsAffected()
+		if s, err = ss.db.Exec("delete from "+STORE_MEMBER_TABLE+" where k=? and"+storeLive, k, now); err != nil {
+			return n, err
+		}
+		members, _ := s.RowsAffected()
+		if kv > 0 || members > 0 {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (ss *SQLStore) Incr(key string) (int64, error) {
+	if err := ss.dropExpired(key); err != nil {
+		return 0, err
+	}
+	//LAST_INSERT_ID(expr) returns the new value along with the result
+	s, err := ss.db.Exec("insert into "+STORE_TABLE+"(k, v, expires_at) values(?, LAST_INSERT_ID(1), null) "+
+		"on duplicate key update v=LAST_INSERT_ID(cast(v as unsigned)+1)", key)
+	if err != nil {
+		return 0, err
+	}
+	return s.LastInsertId()
+}
+
+func (ss *SQLStore) Expire(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		_, err := ss.Del(key)
+		return err
+	}
+	now := time.Now()
+	for _, table := range []string{STORE_TABLE, STORE_MEMBER_TABLE} {
+		if _, err := ss.db.Exec("update "+table+" set expires_at=? where k=? and"+storeLive,
+			now.Add(ttl), key, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *SQLStore) TTL(key string) (time.Duration, error) {
+	now := time.Now()
+	var exp sql.NullTime
+	err := ss.db.QueryRow("select expires_at from "+STORE_TABLE+" where k=? and"+storeLive, key, now).Scan(&exp)
+	if err == sql.ErrNoRows {
+		err = ss.db.QueryRow("select max(expires_at) from "+STORE_MEMBER_TABLE+" where k=? and"+storeLive,
+			key, now).Scan(&exp)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if !exp.Valid {
+		return 0, nil
+	}
+	return exp.Time.Sub(now), nil
+}
+
+func (ss *SQLStore) SAdd(key string, member string) error {
+	now := time.Now()
+	if _, err := ss.db.Exec("delete from "+STORE_MEMBER_TABLE+" where k=? and expires_at <= ?", key, now); err != nil {
+		return err
+	}
+	//new member gets the expiry of the set
+	var exp sql.NullTime
+	if err := ss.db.QueryRow("select max(expires_at) from "+STORE_MEMBER_TABLE+" where k=?", key).Scan(&exp); err != nil {
+		return err
+	}
+	var e interface{}
+	if exp.Valid {
+		e = exp.Time
+	}
+	_, err := ss.db.Exec("insert ignore into "+STORE_MEMBER_TABLE+"(k, member, expires_at) values(?,?,?)", key, member, e)
+	return err
+}
+
+func (ss *SQLStore) SRem(key string, member string) error {
+	_, err := ss.db.Exec("delete from "+STORE_MEMBER_TABLE+" where k=? and member=?", key, member)
+	return err
+}
+
+func (ss *SQLStore) SMembers(key string) ([]string, error) {
+	rows, err := ss.db.Query("select member from "+STORE_MEMBER_TABLE+" where k=? and"+storeLive, key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]string, 0)
+	for rows.Next() {
+		var m string
+		if err = rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (ss *SQLStore) SIsMember(key string, member string) (bool, error) {
+	var one int
+	err := ss.db.QueryRow("select 1 from "+STORE_MEMBER_TABLE+" where k=? and member=? and"+storeLive,
+		key, member, time.Now()).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ss *SQLStore) Close() error {
+	close(ss.done)
+	return nil
+}
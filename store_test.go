@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/auth_backend/models"
+	"github.com/auth_backend/utils"
+	"github.com/pkg/errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ms := NewMemoryStore(0)
+	defer ms.Close()
+
+	_, err := ms.Get("a")
+	utils.Equals(t, KEY_NOT_FOUND, err)
+	utils.Ok(t, ms.Set("a", []byte("x"), 0))
+	v, err := ms.Get("a")
+	utils.Ok(t, err)
+	utils.Equals(t, "x", v)
+
+	ok, err := ms.SetNX("a", 1, 0)
+	utils.Ok(t, err)
+	utils.Equals(t, false, ok)
+	ok, _ = ms.SetNX("b", 1, 0)
+	utils.Equals(t, true, ok)
+
+	vals, err := ms.MGet("a", "missing", "b")
+	utils.Ok(t, err)
+	utils.Equals(t, []interface{}{"x", nil, "1"}, vals)
+
+	old, err := ms.GetSet("a", "y")
+	utils.Ok(t, err)
+	utils.Equals(t, "x", old)
+	_, err = ms.GetSet("c", "y")
+	utils.Equals(t, KEY_NOT_FOUND, err)
+
+	n, _ := ms.Incr("b")
+	utils.Equals(t, int64(2), n)
+	n, _ = ms.Incr("counter")
+	utils.Equals(t, int64(1), n)
+	_, err = ms.Incr("a")
+	utils.Assert(t, err != nil, "incr of non integer should fail")
+
+	n, _ = ms.Del("a", "b", "missing")
+	utils.Equals(t, int64(2), n)
+
+	//expiry
+	utils.Ok(t, ms.Set("e", "v", 20*time.Millisecond))
+	ttl, _ := ms.TTL("e")
+	utils.Assert(t, ttl > 0 && ttl <= 20*time.Millisecond, "unexpected ttl %s", ttl)
+	ttl, _ = ms.TTL("counter")
+	utils.Equals(t, time.Duration(0), ttl)
+	time.Sleep(30 * time.Millisecond)
+	_, err = ms.Get("e")
+	utils.Equals(t, KEY_NOT_FOUND, err)
+	ok, _ = ms.SetNX("e", "v", 0)
+	utils.Equals(t, true, ok)
+
+	//sets
+	utils.Ok(t, ms.SAdd("s", "m1"))
+	utils.Ok(t, ms.SAdd("s", "m2"))
+	utils.Ok(t, ms.SAdd("s", "m1"))
+	members, _ := ms.SMembers("s")
+	sort.Strings(members)
+	utils.Equals(t, []string{"m1", "m2"}, members)
+	ok, _ = ms.SIsMember("s", "m2")
+	utils.Equals(t, true, ok)
+	utils.Ok(t, ms.SRem("s", "m2"))
+	ok, _ = ms.SIsMember("s", "m2")
+	utils.Equals(t, false, ok)
+	_, err = ms.Get("s")
+	utils.Equals(t, WRONG_TYPE, err)
+	members, _ = ms.SMembers("missing")
+	utils.Equals(t, 0, len(members))
+}
+
+//sessions & throttling work without redis or a database
+func TestSessionWithMemoryStore(t *testing.T) {
+	ms := NewMemoryStore(0)
+	defer ms.Close()
+	ac := &AuthController{store: ms, throttle: NewLoginThrottle(ms, 3, 0, 0, 0, 0)}
+
+	ud := &models.UserData{Id: 5, Org_id: 2, RoleId: 2}
+	tokens, err := ac.createSession(ud, &SessionMeta{Ip: "127.0.0.1"})
+	utils.Ok(t, err)
+	aud, err := ac.authenticate(tokens.Token)
+	utils.Ok(t, err)
+	utils.Equals(t, int64(5), aud.Id)
+	utils.Equals(t, ud.Family, aud.Family)
+
+	sessions, err := ac.listSessions(aud)
+	utils.Ok(t, err)
+	utils.Equals(t, 1, len(sessions))
+
+	//refresh rotates both tokens
+	next, err := ac.refresh(tokens.RefreshToken, nil)
+	utils.Ok(t, err)
+	_, err = ac.authenticate(tokens.Token)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+	_, err = ac.authenticate(next.Token)
+	utils.Ok(t, err)
+
+	//reuse revokes the whole family
+	_, err = ac.refresh(tokens.RefreshToken, nil)
+	utils.Equals(t, models.REFRESH_TOKEN_REUSED, err)
+	_, err = ac.authenticate(next.Token)
+	utils.Equals(t, models.USER_NOT_AUTHENTICATED, err)
+
+	//lock after max failures
+	k := ac.throttle.userKey(ud.Id)
+	for i := 0; i < 3; i++ {
+		utils.Ok(t, ac.throttle.check(k))
+		ac.throttle.fail(k)
+	}
+	err = ac.throttle.check(k)
+	utils.Equals(t, models.ACCOUNT_LOCKED, errors.Cause(err))
+	ac.throttle.reset(k)
+	utils.Ok(t, ac.throttle.check(k))
+}
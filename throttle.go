@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"github.com/auth_backend/models"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	REDIS_LOGIN_FAIL = "LOGIN_FAIL:"
+	REDIS_LOGIN_LOCK = "LOGIN_LOCK:"
+	REDIS_LOGIN_LOCKS = "LOGIN_LOCKS:" //lockouts in last day, used for backoff
+	THROTTLE_USER_MAX = 5
+	THROTTLE_IP_MAX = 50
+	THROTTLE_WINDOW = 15 //minutes
+	THROTTLE_LOCKOUT = 1 //minutes, doubled on every lockout
+	THROTTLE_MAX_LOCKOUT = 24*60 //minutes
+)
+
+//counts failures in a sliding window, the key is locked once failures reach max
+type throttleKey struct {
+	id  string
+	max int64
+}
+
+//ACCOUNT_LOCKED along with time till the lock expires, errors.Cause returns ACCOUNT_LOCKED
+type lockedError struct {
+	wait time.Duration
+}
+
+func (e *lockedError) Error() string {
+	return models.ACCOUNT_LOCKED.Error()
+}
+
+func (e *lockedError) Cause() error {
+	return models.ACCOUNT_LOCKED
+}
+
+//Failure counters with exponential lockout
+type LoginThrottle struct {
+	store        SessionStore
+	userMax      int64
+	ipMax        int64
+	window       time.Duration
+	lockout      time.Duration
+	maxLockout   time.Duration
+}
+
+//zero values fallback to defaults
+func NewLoginThrottle(store SessionStore, userMax int64, ipMax int64, window time.Duration, lockout time.Duration,
+	maxLockout time.Duration) *LoginThrottle {
+	if userMax <= 0 {
+		userMax = THROTTLE_USER_MAX
+	}
+	if ipMax <= 0 {
+		ipMax = THROTTLE_IP_MAX
+	}
+	if window <= 0 {
+		window = THROTTLE_WINDOW * time.Minute
+	}
+	if lockout <= 0 {
+		lockout = THROTTLE_LOCKOUT * time.Minute
+	}
+	if maxLockout <= 0 {
+		maxLockout = THROTTLE_MAX_LOCKOUT * time.Minute
+	}
+	return &LoginThrottle{store: store, userMax: userMax, ipMax: ipMax, window: window,
+		lockout: lockout, maxLockout: maxLockout}
+}
+
+//failures of an account are counted on its id, whichever identifier was used to login
+func (lt *LoginThrottle) userKey(id int64) throttleKey {
+	return throttleKey{id: fmt.Sprintf("user:%d", id), max: lt.userMax}
+}
+
+//used when identifier does not match an account, same username can exist in different orgs
+//so org is part of the key
+func (lt *LoginThrottle) identifierKey(org string, identifier string) throttleKey {
+	id := "ident:" + strings.ToLower(identifier)
+	if org != "" {
+		id = "ident:" + strings.ToLower(org) + "/" + strings.ToLower(identifier)
+	}
+	return throttleKey{id: id, max: lt.userMax}
+}
+
+//magic link requests are counted per email
+func (lt *LoginThrottle) magicKey(email string) throttleKey {
+	return throttleKey{id: "magic:" + strings.ToLower(email), max: lt.userMax}
+}
+
+func (lt *LoginThrottle) ipKey(ip string) throttleKey {
+	return throttleKey{id: "ip:" + ip, max: lt.ipMax}
+}
+
+//second factor failures are counted per user, password is already known to the caller
+func (lt *LoginThrottle) mfaKey(id int64) throttleKey {
+	return throttleKey{id: fmt.Sprintf("mfa:%d", id), max: lt.userMax}
+}
+
+//returns how long till all the keys are unlocked, 0 if none is locked
+func (lt *LoginThrottle) lockedFor(keys ...throttleKey) time.Duration {
+	var wait time.Duration
+	for _, k := range keys {
+		ttl, err := lt.store.TTL(REDIS_LOGIN_LOCK + k.id)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+	return wait
+}
+
+func (lt *LoginThrottle) check(keys ...throttleKey) error {
+	if wait := lt.lockedFor(keys...); wait > 0 {
+		return &lockedError{wait: wait}
+	}
+	return nil
+}
+
+//failures in the sliding window, approximated from current & previous fixed window
+func (lt *LoginThrottle) count(id string, now time.Time) (int64, error) {
+	slot := now.UnixNano() / int64(lt.window)
+	vals, err := lt.store.MGet(fmt.Sprintf("%s%s:%d", REDIS_LOGIN_FAIL, id, slot),
+		fmt.Sprintf("%s%s:%d", REDIS_LOGIN_FAIL, id, slot-1))
+	if err != nil {
+		return 0, err
+	}
+	var cnt [2]int64
+	for i, v := range vals {
+		if v == nil {
+			continue
+		}
+		if cnt[i], err = strconv.ParseInt(fmt.Sprintf("%v", v), 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	elapsed := float64(now.UnixNano()%int64(lt.window)) / float64(lt.window)
+	return cnt[0] + int64(float64(cnt[1])*(1-elapsed)), nil
+}
+
+//records a failure, locks the key when failures in window reach its max
+func (lt *LoginThrottle) fail(keys ...throttleKey) {
+	now := time.Now()
+	slot := now.UnixNano() / int64(lt.window)
+	for _, k := range keys {
+		fk := fmt.Sprintf("%s%s:%d", REDIS_LOGIN_FAIL, k.id, slot)
+		if _, err := lt.store.Incr(fk); err != nil {
+			log.Error(err)
+			continue
+		}
+		lt.store.Expire(fk, 2*lt.window)
+		if cnt, err := lt.count(k.id, now); err != nil {
+			log.Error(err)
+		} else if cnt >= k.max {
+			lt.lock(k.id)
+		}
+	}
+}
+
+//every lockout in a day doubles the lock duration
+func (lt *LoginThrottle) lock(id string) {
+	lk := REDIS_LOGIN_LOCKS + id
+	n, err := lt.store.Incr(lk)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	lt.store.Expire(lk, 24*time.Hour)
+	d := lt.lockout
+	for i := int64(1); i < n && d < lt.maxLockout; i++ {
+		d *= 2
+	}
+	if d > lt.maxLockout {
+		d = lt.maxLockout
+	}
+	log.Warnf("Too many failed attempts for %s, locked for %s", id, d)
+	lt.store.Set(REDIS_LOGIN_LOCK+id, 1, d)
+}
+
+//clears failures & lock of the keys
+func (lt *LoginThrottle) reset(keys ...throttleKey) {
+	slot := time.Now().UnixNano() / int64(lt.window)
+	for _, k := range keys {
+		if _, err := lt.store.Del(REDIS_LOGIN_LOCK+k.id, REDIS_LOGIN_LOCKS+k.id,
+			fmt.Sprintf("%s%s:%d", REDIS_LOGIN_FAIL, k.id, slot),
+			fmt.Sprintf("%s%s:%d", REDIS_LOGIN_FAIL, k.id, slot-1)); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+//key the login failures are counted on, the account if identifier matches one
+func (ac *AuthController) loginKey(identifier string, orgSlug string) throttleKey {
+	var org *models.Org
+	if orgSlug != "" {
+		var err error
+		if org, err = ac.dbHandler.FindOrgBySlug(orgSlug); err != nil {
+			log.Error(err)
+			return ac.throttle.identifierKey(orgSlug, identifier)
+		} else if org == nil {
+			return ac.throttle.identifierKey(orgSlug, identifier)
+		}
+	}
+	if au, err := ac.dbHandler.FindAuthUser(identifier, org); err != nil {
+		log.Error(err)
+	} else if au != nil {
+		return ac.throttle.userKey(au.GetId())
+	}
+	return ac.throttle.identifierKey(orgSlug, identifier)
+}
+
+//SU only, removes lock on the user
+func (ac *AuthController) unlockUser(id int64) error {
+	if _, err := ac.dbHandler.GetAuthUser(id); err != nil {
+		return models.INVALID_ENTRY
+	}
+	ac.throttle.reset(ac.throttle.userKey(id), ac.throttle.mfaKey(id))
+	log.Infof("User %d unlocked", id)
+	return nil
+}
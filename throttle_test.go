@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/auth_backend/models"
+	"github.com/auth_backend/utils"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func TestThrottleLockout(t *testing.T) {
+	test_table := map[string]struct {
+		key    func(lt *LoginThrottle) throttleKey
+		fails  int
+		locked bool
+	}{
+		"user below max":    {func(lt *LoginThrottle) throttleKey { return lt.userKey(9) }, 2, false},
+		"user at max":       {func(lt *LoginThrottle) throttleKey { return lt.userKey(9) }, 3, true},
+		"identifier at max": {func(lt *LoginThrottle) throttleKey { return lt.identifierKey("acme", "Alice") }, 3, true},
+		"ip below max":      {func(lt *LoginThrottle) throttleKey { return lt.ipKey("10.0.0.1") }, 9, false},
+		"ip at max":         {func(lt *LoginThrottle) throttleKey { return lt.ipKey("10.0.0.1") }, 10, true},
+		"mfa at max":        {func(lt *LoginThrottle) throttleKey { return lt.mfaKey(7) }, 3, true},
+		"magic at max":      {func(lt *LoginThrottle) throttleKey { return lt.magicKey("a@example.org") }, 3, true},
+	}
+	for name, test := range test_table {
+		ms := NewMemoryStore(0)
+		lt := NewLoginThrottle(ms, 3, 10, time.Minute, time.Minute, time.Hour)
+		k := test.key(lt)
+		for i := 0; i < test.fails; i++ {
+			utils.Ok(t, lt.check(k))
+			lt.fail(k)
+		}
+		err := lt.check(k)
+		if !test.locked {
+			utils.Assert(t, err == nil, "%s : should not be locked, got %v", name, err)
+			ms.Close()
+			continue
+		}
+		utils.Assert(t, err != nil, "%s : should be locked", name)
+		utils.Equals(t, models.ACCOUNT_LOCKED, errors.Cause(err))
+		le, ok := err.(*lockedError)
+		utils.Assert(t, ok && le.wait > 0 && le.wait <= time.Minute, "%s : unexpected wait %v", name, err)
+		//other keys are not affected
+		utils.Ok(t, lt.check(lt.identifierKey("", "bob")))
+		lt.reset(k)
+		utils.Assert(t, lt.check(k) == nil, "%s : should be unlocked by reset", name)
+		ms.Close()
+	}
+
+	//same identifier in another org is counted separately
+	ms := NewMemoryStore(0)
+	defer ms.Close()
+	lt := NewLoginThrottle(ms, 1, 0, 0, 0, 0)
+	lt.fail(lt.identifierKey("acme", "alice"))
+	utils.Assert(t, lt.check(lt.identifierKey("acme", "ALICE")) != nil, "identifier is not case sensitive")
+	utils.Ok(t, lt.check(lt.identifierKey("other", "alice")))
+	utils.Ok(t, lt.check(lt.identifierKey("", "alice")))
+	//identifier which looks like an id does not share the lock of that account
+	lt.fail(lt.identifierKey("", "12"))
+	utils.Ok(t, lt.check(lt.userKey(12)))
+}
+
+func TestThrottleCount(t *testing.T) {
+	window := 10 * time.Minute
+	test_table := map[string]struct {
+		prev, cur int64
+		elapsed   time.Duration
+		count     int64
+	}{
+		"empty":             {0, 0, time.Minute, 0},
+		"only current":      {0, 3, 9 * time.Minute, 3},
+		"start of window":   {8, 1, 0, 9},
+		"quarter of window": {8, 1, 2*time.Minute + 30*time.Second, 7},
+		"half of window":    {8, 0, 5 * time.Minute, 4},
+		"end of window":     {8, 2, window - time.Nanosecond, 2},
+	}
+	for name, test := range test_table {
+		ms := NewMemoryStore(0)
+		lt := NewLoginThrottle(ms, 0, 0, window, 0, 0)
+		slot := time.Now().UnixNano() / int64(window)
+		now := time.Unix(0, slot*int64(window)).Add(test.elapsed)
+		if test.prev > 0 {
+			utils.Ok(t, ms.Set(fmt.Sprintf("%s%s:%d", REDIS_LOGIN_FAIL, "k", slot-1), test.prev, 0))
+		}
+		if test.cur > 0 {
+			utils.Ok(t, ms.Set(fmt.Sprintf("%s%s:%d", REDIS_LOGIN_FAIL, "k", slot), test.cur, 0))
+		}
+		cnt, err := lt.count("k", now)
+		utils.Ok(t, err)
+		utils.Assert(t, cnt == test.count, "%s : expected %d got %d", name, test.count, cnt)
+		ms.Close()
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	ms := NewMemoryStore(0)
+	defer ms.Close()
+	lt := NewLoginThrottle(ms, 0, 0, 0, time.Minute, 5*time.Minute)
+	//lock doubles every time till max
+	for i, d := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		lt.lock("k")
+		wait := lt.lockedFor(throttleKey{id: "k"})
+		utils.Assert(t, wait <= d && wait > d-time.Second, "lock %d : expected %s got %s", i+1, d, wait)
+	}
+	//reset forgets earlier lockouts
+	lt.reset(throttleKey{id: "k"})
+	utils.Equals(t, time.Duration(0), lt.lockedFor(throttleKey{id: "k"}))
+	lt.lock("k")
+	wait := lt.lockedFor(throttleKey{id: "k"})
+	utils.Assert(t, wait <= time.Minute && wait > 59*time.Second, "lock after reset, got %s", wait)
+}
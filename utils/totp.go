@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//RFC 6238 defaults, these are the only values supported by most authenticator apps
+const (
+	TOTP_DIGITS = 6
+	TOTP_PERIOD = 30 //seconds
+	TOTP_SECRET_SIZE = 20 //bytes
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//random base32 encoded secret
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, TOTP_SECRET_SIZE)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+//time step of t
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTP_PERIOD
+}
+
+//HOTP (RFC 4226) value of secret for the counter
+func HOTP(key []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	m := hmac.New(sha1.New, key)
+	m.Write(msg)
+	sum := m.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return b32.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+//code for base32 encoded secret at time t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return HOTP(key, TOTPStep(t), TOTP_DIGITS), nil
+}
+
+//checks code against time steps within skew of t, returns the matching step
+//callers should reject a step that was already used to prevent replay
+func ValidateTOTP(secret string, code string, t time.Time, skew int64) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	step := TOTPStep(t)
+	for i := -skew; i <= skew; i++ {
+		if subtle.ConstantTimeCompare([]byte(HOTP(key, step+i, TOTP_DIGITS)), []byte(code)) == 1 {
+			return step + i, true
+		}
+	}
+	return 0, false
+}
+
+//otpauth uri understood by authenticator apps, usually shown as a QR code
+func TOTPProvisioningURI(issuer string, account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", TOTP_DIGITS))
+	v.Set("period", fmt.Sprintf("%d", TOTP_PERIOD))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//test vectors from RFC 6238 appendix B (SHA1)
+func TestTOTPVectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	test_table := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for ts, exp := range test_table {
+		Equals(t, exp, HOTP(key, TOTPStep(time.Unix(ts, 0)), 8))
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	Ok(t, err)
+	now := time.Unix(1600000000, 0)
+	code, err := TOTPCode(secret, now)
+	Ok(t, err)
+	Equals(t, TOTP_DIGITS, len(code))
+
+	step, ok := ValidateTOTP(secret, code, now, 1)
+	Assert(t, ok, "current code should be valid")
+	Equals(t, TOTPStep(now), step)
+
+	//previous step is accepted within skew
+	_, ok = ValidateTOTP(secret, code, now.Add(TOTP_PERIOD*time.Second), 1)
+	Assert(t, ok, "code of previous step should be valid")
+	_, ok = ValidateTOTP(secret, code, now.Add(3*TOTP_PERIOD*time.Second), 1)
+	Assert(t, !ok, "old code should not be valid")
+	_, ok = ValidateTOTP(secret, "12345", now, 1)
+	Assert(t, !ok, "short code should not be valid")
+	_, ok = ValidateTOTP("not base32!", code, now, 1)
+	Assert(t, !ok, "invalid secret should not validate")
+
+	uri := TOTPProvisioningURI("auth backend", "su", secret)
+	Assert(t, strings.HasPrefix(uri, "otpauth://totp/auth%20backend:su?"), "unexpected uri %s", uri)
+	Assert(t, strings.Contains(uri, "secret="+secret), "secret missing in uri %s", uri)
+}